@@ -0,0 +1,531 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	url2 "net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every resolution of an alias is stored as a click under
+// click_<alias>:<unix nano>-<sequence>. Aliases can't contain a ':', so the
+// clicks of one alias never share a prefix with those of another.
+const clickPrefix = "click_"
+
+// The clicks of every alias are also counted under clickcount_<alias>, in total
+// and for each of the last days, so showing stats doesn't have to go through
+// all clicks. The counts are rebuilt from the clicks when restoring a backup.
+const clickCountPrefix = "clickcount_"
+
+// Number of days clicks are counted per day for.
+const clickCountDays = 31
+
+// Number of days shown in the time series on the index page.
+const statsDays = 14
+
+// Clicks are written in batches of at most this size, or whatever has been
+// collected after clickFlushInterval.
+const clickBatchSize = 100
+const clickFlushInterval = time.Second
+
+// Clicks are moved and removed in batches of this size.
+const clickCleanupBatchSize = 1000
+
+type Click struct {
+	Alias      string
+	Time       time.Time
+	Referrer   string
+	Agent      string
+	Authorized bool
+}
+
+type DayCount struct {
+	Day   time.Time
+	Count int
+	// Percent is Count relative to the busiest day in the series.
+	Percent int
+}
+
+type AliasStats struct {
+	Total int
+	Daily []DayCount
+}
+
+func clickAliasPrefix(alias string) []byte {
+	return prefix(clickPrefix, alias+":")
+}
+
+func clickKey(click Click, sequence uint64) []byte {
+	return prefix(clickPrefix, fmt.Sprintf("%s:%020d-%d", click.Alias, click.Time.UnixNano(), sequence))
+}
+
+// clickKeyTime returns the time a click was made from its key, which starts
+// with aliasPrefix.
+func clickKeyTime(key []byte, aliasPrefix []byte) (time.Time, bool) {
+	rest := string(key[len(aliasPrefix):])
+	if i := strings.IndexByte(rest, '-'); i >= 0 {
+		rest = rest[:i]
+	}
+
+	nanos, err := strconv.ParseInt(rest, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return time.Unix(0, nanos), true
+}
+
+// clickCount is what is stored under clickcount_<alias>.
+type clickCount struct {
+	Total int
+	// Days counts the clicks on each of the last clickCountDays days that
+	// had any, by their date like 2006-01-02 in local time.
+	Days map[string]int `json:",omitempty"`
+}
+
+func clickDay(t time.Time) string {
+	return t.Local().Format("2006-01-02")
+}
+
+// add counts a click at t, and forgets the days that are too long before it.
+func (c *clickCount) add(t time.Time) {
+	if c.Days == nil {
+		c.Days = map[string]int{}
+	}
+	c.Total += 1
+	c.Days[clickDay(t)] += 1
+
+	latest := ""
+	for day := range c.Days {
+		if day > latest {
+			latest = day
+		}
+	}
+	last, err := time.ParseInLocation("2006-01-02", latest, time.Local)
+	if err != nil {
+		return
+	}
+	first := clickDay(last.AddDate(0, 0, -(clickCountDays - 1)))
+	for day := range c.Days {
+		if day < first {
+			delete(c.Days, day)
+		}
+	}
+}
+
+// countClicks counts the clicks of every alias as part of txn.
+func countClicks(txn kvTxn) (map[string]*clickCount, error) {
+	res := map[string]*clickCount{}
+	err := txn.Iterate([]byte(clickPrefix), func(key []byte, value func() ([]byte, error)) error {
+		rest := string(key[len(clickPrefix):])
+		i := strings.IndexByte(rest, ':')
+		if i < 0 {
+			return nil
+		}
+		alias := rest[:i]
+
+		t, ok := clickKeyTime(key, clickAliasPrefix(alias))
+		if !ok {
+			return nil
+		}
+
+		count, ok := res[alias]
+		if !ok {
+			count = &clickCount{}
+			res[alias] = count
+		}
+		count.add(t)
+		return nil
+	})
+
+	return res, err
+}
+
+// recountClicks replaces the counts of all aliases with ones counted from
+// their clicks, in batches.
+func (s kvStore) recountClicks() error {
+	var counts map[string]*clickCount
+	var old [][]byte
+	err := s.db.View(func(txn kvTxn) error {
+		var err error
+		counts, err = countClicks(txn)
+		if err != nil {
+			return err
+		}
+
+		return txn.Iterate([]byte(clickCountPrefix), func(key []byte, value func() ([]byte, error)) error {
+			if _, ok := counts[string(key[len(clickCountPrefix):])]; !ok {
+				old = append(old, key)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	var aliases []string
+	for alias := range counts {
+		aliases = append(aliases, alias)
+	}
+
+	for len(aliases) > 0 || len(old) > 0 {
+		n := len(aliases)
+		if n > clickCleanupBatchSize {
+			n = clickCleanupBatchSize
+		}
+		batch := aliases[:n]
+		aliases = aliases[n:]
+
+		m := len(old)
+		if m > clickCleanupBatchSize-n {
+			m = clickCleanupBatchSize - n
+		}
+		stale := old[:m]
+		old = old[m:]
+
+		err := s.update(func(txn kvTxn, remove func(blob string)) error {
+			for _, alias := range batch {
+				if err := setJson(txn, prefix(clickCountPrefix, alias), counts[alias]); err != nil {
+					return err
+				}
+			}
+			for _, key := range stale {
+				if err := txn.Delete(key); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// moveClickCount moves the count of from to to as part of txn. When to is
+// empty, the count is removed.
+func moveClickCount(txn kvTxn, from string, to string) error {
+	val, err := txn.Get(prefix(clickCountPrefix, from))
+	if err == ErrNotFound {
+		val = nil
+	} else if err != nil {
+		return err
+	}
+
+	if err := txn.Delete(prefix(clickCountPrefix, from)); err != nil {
+		return err
+	}
+	if to == "" {
+		return nil
+	}
+
+	if val == nil {
+		// a count left behind by an alias that had the same name
+		return txn.Delete(prefix(clickCountPrefix, to))
+	}
+	return txn.Set(prefix(clickCountPrefix, to), val)
+}
+
+func startOfDay(t time.Time) time.Time {
+	year, month, day := t.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+}
+
+// RecordClicks stores a batch of clicks, and counts them. Clicks on aliases
+// that were removed or renamed since are left out, they would otherwise be
+// left behind, or end up with the next alias that gets the name.
+func (s kvStore) RecordClicks(clicks []Click, sequence uint64) error {
+	return s.update(func(txn kvTxn, remove func(blob string)) error {
+		counts := map[string]*clickCount{}
+		found := map[string]bool{}
+		for i, click := range clicks {
+			ok, checked := found[click.Alias]
+			if !checked {
+				var err error
+				ok, err = exists(txn, prefix(aliasPrefix, click.Alias))
+				if err != nil {
+					return err
+				}
+				found[click.Alias] = ok
+			}
+			if !ok {
+				continue
+			}
+
+			err := setJson(txn, clickKey(click, sequence+uint64(i)), &click)
+			if err != nil {
+				return err
+			}
+
+			count, ok := counts[click.Alias]
+			if !ok {
+				count = &clickCount{}
+				err := getJson(txn, prefix(clickCountPrefix, click.Alias), count)
+				if err != nil && err != ErrNotFound {
+					return err
+				}
+				counts[click.Alias] = count
+			}
+			count.add(click.Time)
+		}
+
+		for alias, count := range counts {
+			if err := setJson(txn, prefix(clickCountPrefix, alias), count); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (s kvStore) GetAliasClicks(alias string) ([]Click, error) {
+	var res []Click
+	return res, s.db.View(func(txn kvTxn) error {
+		return iterateValues(txn, clickAliasPrefix(alias), func(key []byte, val []byte) error {
+			var click Click
+			if err := decodeJson(val, &click); err != nil {
+				return err
+			}
+
+			res = append(res, click)
+			return nil
+		})
+	})
+}
+
+// GetAliasStats returns the number of clicks on an alias, in total and for each
+// of the last days days. Clicks are only counted per day for the last
+// clickCountDays days.
+func (s kvStore) GetAliasStats(alias string, days int, now time.Time) (AliasStats, error) {
+	res := AliasStats{
+		Daily: make([]DayCount, days),
+	}
+
+	var count clickCount
+	err := s.db.View(func(txn kvTxn) error {
+		err := getJson(txn, prefix(clickCountPrefix, alias), &count)
+		if err == ErrNotFound {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return AliasStats{}, err
+	}
+
+	res.Total = count.Total
+	first := startOfDay(now).AddDate(0, 0, -(days - 1))
+	for i := range res.Daily {
+		res.Daily[i].Day = first.AddDate(0, 0, i)
+		res.Daily[i].Count = count.Days[clickDay(res.Daily[i].Day)]
+	}
+
+	max := 0
+	for _, d := range res.Daily {
+		if d.Count > max {
+			max = d.Count
+		}
+	}
+	if max > 0 {
+		for i := range res.Daily {
+			res.Daily[i].Percent = res.Daily[i].Count * 100 / max
+		}
+	}
+
+	return res, nil
+}
+
+// rmAliasClicks removes all clicks on alias, in batches like moveAliasClicks.
+func (s kvStore) rmAliasClicks(alias string) error {
+	return s.moveAliasClicks(alias, "")
+}
+
+// moveAliasClicks moves all clicks on from to the alias to. An alias can have
+// more clicks than fit in a single transaction, so they are moved in batches,
+// after the alias itself has been renamed. When to is empty, the clicks are
+// removed.
+func (s kvStore) moveAliasClicks(from string, to string) error {
+	type entry struct {
+		key   []byte
+		value []byte
+	}
+
+	p := clickAliasPrefix(from)
+	for {
+		var entries []entry
+		err := s.update(func(txn kvTxn, remove func(blob string)) error {
+			entries = nil
+			err := txn.Iterate(p, func(key []byte, value func() ([]byte, error)) error {
+				if len(entries) >= clickCleanupBatchSize {
+					return errStopIteration
+				}
+
+				e := entry{key: key}
+				if to != "" {
+					var err error
+					e.value, err = value()
+					if err != nil {
+						return err
+					}
+				}
+				entries = append(entries, e)
+				return nil
+			})
+			if err != nil && err != errStopIteration {
+				return err
+			}
+
+			for _, e := range entries {
+				if err := txn.Delete(e.key); err != nil {
+					return err
+				}
+
+				if to == "" {
+					continue
+				}
+
+				var click Click
+				if err := decodeJson(e.value, &click); err != nil {
+					return err
+				}
+				click.Alias = to
+
+				newKey := append(clickAliasPrefix(to), e.key[len(p):]...)
+				if err := setJson(txn, newKey, &click); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if len(entries) < clickCleanupBatchSize {
+			return nil
+		}
+	}
+}
+
+// ClickRecorder collects clicks in the background and writes them to the store
+// in batches, so recording them doesn't slow down redirects.
+type ClickRecorder struct {
+	store    Store
+	clicks   chan Click
+	done     chan struct{}
+	sequence uint64
+}
+
+func NewClickRecorder(store Store) *ClickRecorder {
+	c := &ClickRecorder{
+		store:  store,
+		clicks: make(chan Click, 10*clickBatchSize),
+		done:   make(chan struct{}),
+	}
+
+	go c.run()
+
+	return c
+}
+
+// Record queues a click to be stored. When the recorder can't keep up, the
+// click is dropped rather than making the caller wait.
+func (c *ClickRecorder) Record(click Click) {
+	select {
+	case c.clicks <- click:
+	default:
+		log.Printf("dropped click on %s, recorder is falling behind", click.Alias)
+	}
+}
+
+// Close stores all clicks that were recorded so far and stops the recorder.
+func (c *ClickRecorder) Close() {
+	close(c.clicks)
+	<-c.done
+}
+
+func (c *ClickRecorder) run() {
+	defer close(c.done)
+
+	ticker := time.NewTicker(clickFlushInterval)
+	defer ticker.Stop()
+
+	var batch []Click
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		if err := c.store.RecordClicks(batch, c.sequence); err != nil {
+			log.Printf("failed to record %d clicks: %v", len(batch), err)
+		}
+		c.sequence += uint64(len(batch))
+		batch = nil
+	}
+
+	for {
+		select {
+		case click, ok := <-c.clicks:
+			if !ok {
+				flush()
+				return
+			}
+
+			batch = append(batch, click)
+			if len(batch) >= clickBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// referrerHost returns only the host of a referrer, so no paths or query
+// parameters of other sites are stored.
+func referrerHost(referrer string) string {
+	u, err := url2.Parse(referrer)
+	if err != nil {
+		return ""
+	}
+
+	return u.Host
+}
+
+// userAgentClass puts a user agent into one of a few coarse classes.
+func userAgentClass(agent string) string {
+	lower := strings.ToLower(agent)
+
+	switch {
+	case agent == "":
+		return "unknown"
+	case strings.Contains(lower, "bot"),
+		strings.Contains(lower, "crawler"),
+		strings.Contains(lower, "spider"),
+		strings.Contains(lower, "preview"),
+		strings.Contains(lower, "facebookexternalhit"):
+		return "bot"
+	case strings.HasPrefix(lower, "curl/"),
+		strings.HasPrefix(lower, "wget/"),
+		strings.HasPrefix(lower, "httpie/"),
+		strings.HasPrefix(lower, "python-requests/"),
+		strings.HasPrefix(lower, "go-http-client/"):
+		return "cli"
+	case strings.Contains(lower, "mobile"),
+		strings.Contains(lower, "android"),
+		strings.Contains(lower, "iphone"),
+		strings.Contains(lower, "ipad"):
+		return "mobile"
+	case strings.HasPrefix(lower, "mozilla/"):
+		return "desktop"
+	default:
+		return "other"
+	}
+}
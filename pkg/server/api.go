@@ -0,0 +1,1210 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"golang.org/x/crypto/bcrypt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The json api lives under /__API__/v1. It can do the same things as the
+// browser forms, but answers with json and a status code instead of a flash
+// message and a redirect, so it can be used from scripts.
+
+var errUnauthorized = errors.New("unauthorized")
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+type apiAlias struct {
+	Alias     string     `json:"alias"`
+	Owner     string     `json:"owner"`
+	Url       string     `json:"url,omitempty"`
+	File      string     `json:"file,omitempty"`
+	Protected bool       `json:"protected"`
+	Expires   *time.Time `json:"expires,omitempty"`
+	MaxUses   int        `json:"max_uses,omitempty"`
+	Uses      int        `json:"uses"`
+}
+
+func newApiAlias(alias Alias) apiAlias {
+	return apiAlias{
+		Alias:     alias.Alias,
+		Owner:     alias.Owner,
+		Url:       alias.Url,
+		File:      alias.File,
+		Protected: alias.Password != nil,
+		Expires:   alias.Expires,
+		MaxUses:   alias.MaxUses,
+		Uses:      alias.Uses,
+	}
+}
+
+type apiToken struct {
+	Id       string     `json:"id"`
+	Name     string     `json:"name"`
+	Prefix   string     `json:"prefix"`
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+	// Token is only set in the response to creating it.
+	Token string `json:"token,omitempty"`
+}
+
+func newApiToken(token Token) apiToken {
+	return apiToken{
+		Id:       token.Id,
+		Name:     token.Name,
+		Prefix:   token.Prefix(),
+		Created:  token.Created,
+		Expires:  token.Expires,
+		LastUsed: token.LastUsed,
+	}
+}
+
+type apiSession struct {
+	Id       string    `json:"id"`
+	Device   string    `json:"device"`
+	Agent    string    `json:"agent"`
+	IP       string    `json:"ip"`
+	Created  time.Time `json:"created"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+func newApiSession(session LoginSession) apiSession {
+	return apiSession{
+		Id:       session.Id,
+		Device:   session.Device(),
+		Agent:    session.Agent,
+		IP:       session.IP,
+		Created:  session.Created,
+		LastSeen: session.LastSeen,
+	}
+}
+
+type apiInvite struct {
+	Id        string     `json:"id"`
+	Prefix    string     `json:"prefix"`
+	CreatedBy string     `json:"created_by"`
+	Note      string     `json:"note,omitempty"`
+	Admin     bool       `json:"admin"`
+	Created   time.Time  `json:"created"`
+	Expires   time.Time  `json:"expires"`
+	Used      *time.Time `json:"used,omitempty"`
+	UsedBy    string     `json:"used_by,omitempty"`
+	// Link is only set in the response to creating it.
+	Link string `json:"link,omitempty"`
+}
+
+func newApiInvite(invite Invite) apiInvite {
+	return apiInvite{
+		Id:        invite.Id,
+		Prefix:    invite.Prefix(),
+		CreatedBy: invite.CreatedBy,
+		Note:      invite.Note,
+		Admin:     invite.Admin,
+		Created:   invite.Created,
+		Expires:   invite.Expires,
+		Used:      invite.Used,
+		UsedBy:    invite.UsedBy,
+	}
+}
+
+type apiUser struct {
+	Name    string `json:"name"`
+	Admin   bool   `json:"admin"`
+	Email   string `json:"email,omitempty"`
+	Pending bool   `json:"pending,omitempty"`
+	// TOTP is whether the user has two-factor authentication enabled.
+	TOTP    bool     `json:"totp"`
+	Aliases []string `json:"aliases"`
+}
+
+func (a *api) newApiUser(user User) (apiUser, error) {
+	aliases, err := a.store.GetUserAliasNames(user.Name)
+	if err != nil {
+		return apiUser{}, err
+	}
+	if aliases == nil {
+		aliases = []string{}
+	}
+
+	return apiUser{
+		Name:    user.Name,
+		Admin:   user.Admin,
+		Email:   user.Email,
+		Pending: user.Pending,
+		TOTP:    user.TOTPSecret != "",
+		Aliases: aliases,
+	}, nil
+}
+
+func (a *api) writeUser(w http.ResponseWriter, status int, user User) {
+	res, err := a.newApiUser(user)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJson(w, status, res)
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("%v", err)
+	}
+}
+
+func writeApiError(w http.ResponseWriter, status int, message string) {
+	writeJson(w, status, apiError{message})
+}
+
+func writeServerError(w http.ResponseWriter, err error) {
+	log.Printf("%v", err)
+	writeApiError(w, http.StatusInternalServerError, "server error")
+}
+
+type api struct {
+	store        Store
+	lm           *LoginManager
+	sessionStore *sessions.CookieStore
+	base         string
+	// maxUpload is the largest form a file can be uploaded with.
+	maxUpload int64
+}
+
+func registerApi(r *mux.Router, store Store, lm *LoginManager, sessionStore *sessions.CookieStore, base string, maxUpload int64) {
+	a := &api{
+		store,
+		lm,
+		sessionStore,
+		base,
+		maxUpload,
+	}
+
+	v1 := r.PathPrefix("/__API__/v1").Subrouter()
+
+	v1.HandleFunc("/me", a.authenticated(a.getMe)).Methods("GET")
+
+	v1.HandleFunc("/aliases", a.authenticated(a.listAliases)).Methods("GET")
+	v1.HandleFunc("/aliases", a.authenticated(a.createAlias)).Methods("POST")
+	v1.HandleFunc("/aliases/{alias}", a.authenticated(a.getAlias)).Methods("GET")
+	v1.HandleFunc("/aliases/{alias}", a.authenticated(a.updateAlias)).Methods("PATCH")
+	v1.HandleFunc("/aliases/{alias}", a.authenticated(a.deleteAlias)).Methods("DELETE")
+	v1.HandleFunc("/aliases/{alias}/file", a.authenticated(a.updateAliasFile)).Methods("PUT")
+	v1.HandleFunc("/aliases/{alias}/stats", a.authenticated(a.getAliasStats)).Methods("GET")
+
+	v1.HandleFunc("/files", a.authenticated(a.createFile)).Methods("POST")
+
+	v1.HandleFunc("/tokens", a.authenticated(a.listTokens)).Methods("GET")
+	v1.HandleFunc("/tokens", a.authenticated(a.createToken)).Methods("POST")
+	v1.HandleFunc("/tokens/{id}", a.authenticated(a.deleteToken)).Methods("DELETE")
+
+	v1.HandleFunc("/sessions", a.authenticated(a.listSessions)).Methods("GET")
+	v1.HandleFunc("/sessions/{id}", a.authenticated(a.deleteSession)).Methods("DELETE")
+
+	v1.HandleFunc("/users", a.authenticated(a.listUsers)).Methods("GET")
+	v1.HandleFunc("/users", a.authenticated(a.createUser)).Methods("POST")
+	v1.HandleFunc("/users/{name}", a.authenticated(a.getUser)).Methods("GET")
+	v1.HandleFunc("/users/{name}", a.authenticated(a.updateUser)).Methods("PATCH")
+	v1.HandleFunc("/users/{name}", a.authenticated(a.deleteUser)).Methods("DELETE")
+	v1.HandleFunc("/users/{name}/export", a.authenticated(a.exportUser)).Methods("GET")
+	v1.HandleFunc("/users/{name}/sessions", a.authenticated(a.deleteUserSessions)).Methods("DELETE")
+
+	v1.HandleFunc("/invites", a.authenticated(a.listInvites)).Methods("GET")
+	v1.HandleFunc("/invites", a.authenticated(a.createInvite)).Methods("POST")
+	v1.HandleFunc("/invites/{id}", a.authenticated(a.deleteInvite)).Methods("DELETE")
+
+	v1.HandleFunc("/backup", a.authenticated(a.getBackup)).Methods("GET")
+	v1.HandleFunc("/restore", a.authenticated(a.restoreBackup)).Methods("POST")
+	v1.HandleFunc("/import", a.authenticated(a.importLinks)).Methods("POST")
+}
+
+// user returns the logged in user that made the request, or errUnauthorized
+// when there is none. Scripts can authenticate using an api token in the
+// Authorization header instead of a session cookie.
+func (a *api) user(r *http.Request) (*User, error) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		if !strings.HasPrefix(header, "Bearer ") {
+			return nil, errUnauthorized
+		}
+
+		user, err := a.lm.TokenUser(strings.TrimPrefix(header, "Bearer "))
+		if err == ErrInvalidToken {
+			return nil, errUnauthorized
+		}
+
+		return user, err
+	}
+
+	session, err := a.sessionStore.Get(r, sessionName)
+	if err != nil {
+		return nil, errUnauthorized
+	}
+
+	su, ok := session.Values[sessionUserValue].(SessionUser)
+	if !ok {
+		return nil, errUnauthorized
+	}
+
+	user, err := a.lm.LoggedIn(su)
+	if err == ErrNotFound || err == ErrPendingApproval || err == ErrSessionRevoked {
+		return nil, errUnauthorized
+	}
+
+	return user, err
+}
+
+// authenticated only calls handler when the request was made by a logged in user.
+func (a *api) authenticated(handler func(w http.ResponseWriter, r *http.Request, user *User)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := a.user(r)
+		if err == errUnauthorized {
+			writeApiError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+
+		handler(w, r, user)
+	}
+}
+
+// ownedAlias looks up the alias named in the request path. It writes an error
+// response and returns nil when it doesn't exist or user may not access it.
+func (a *api) ownedAlias(w http.ResponseWriter, r *http.Request, user *User) *Alias {
+	alias, err := a.store.GetAlias(mux.Vars(r)["alias"])
+	if err != nil {
+		writeServerError(w, err)
+		return nil
+	}
+
+	if alias == nil {
+		writeApiError(w, http.StatusNotFound, "alias not found")
+		return nil
+	}
+
+	if alias.Owner != user.Name && !user.Admin {
+		writeApiError(w, http.StatusForbidden, "forbidden")
+		return nil
+	}
+
+	return alias
+}
+
+// namedUser looks up the user named in the request path. It writes an error
+// response and returns nil when it doesn't exist or user may not access it.
+func (a *api) namedUser(w http.ResponseWriter, r *http.Request, user *User) *User {
+	name := mux.Vars(r)["name"]
+	if name != user.Name && !user.Admin {
+		writeApiError(w, http.StatusForbidden, "forbidden")
+		return nil
+	}
+
+	res, err := a.store.GetUser(name)
+	if err == ErrNotFound {
+		writeApiError(w, http.StatusNotFound, "user not found")
+		return nil
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return nil
+	}
+
+	return &res
+}
+
+func hashAliasPassword(password string) ([]byte, error) {
+	if password == "" {
+		return nil, nil
+	}
+
+	return bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+}
+
+func (a *api) getMe(w http.ResponseWriter, r *http.Request, user *User) {
+	a.writeUser(w, http.StatusOK, *user)
+}
+
+func (a *api) listAliases(w http.ResponseWriter, r *http.Request, user *User) {
+	owner := user
+	if name := r.URL.Query().Get("owner"); name != "" && name != user.Name {
+		if !user.Admin {
+			writeApiError(w, http.StatusForbidden, "forbidden")
+			return
+		}
+
+		u, err := a.store.GetUser(name)
+		if err == ErrNotFound {
+			writeApiError(w, http.StatusNotFound, "user not found")
+			return
+		}
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		owner = &u
+	}
+
+	aliases, err := a.store.GetUserAliases(owner)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	res := make([]apiAlias, 0, len(aliases))
+	for _, alias := range aliases {
+		res = append(res, newApiAlias(alias))
+	}
+
+	writeJson(w, http.StatusOK, res)
+}
+
+func (a *api) createAlias(w http.ResponseWriter, r *http.Request, user *User) {
+	var body struct {
+		Alias    string     `json:"alias"`
+		Url      string     `json:"url"`
+		Password string     `json:"password"`
+		Expires  *time.Time `json:"expires"`
+		MaxUses  int        `json:"max_uses"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeApiError(w, http.StatusBadRequest, "bad request")
+		return
+	}
+
+	if body.Alias == "" {
+		var err error
+		body.Alias, err = NonExistentRandom(a.store)
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+	}
+
+	if !IsUrl(body.Url) {
+		writeApiError(w, http.StatusBadRequest, "not a valid url")
+		return
+	}
+
+	if body.Expires != nil && body.Expires.Before(time.Now()) {
+		writeApiError(w, http.StatusBadRequest, "expiry must be in the future")
+		return
+	}
+
+	if body.MaxUses < 0 {
+		writeApiError(w, http.StatusBadRequest, "maximum number of uses must be a positive number")
+		return
+	}
+
+	_ = a.finishCreateAlias(w, user, body.Alias, body.Password, func(alias *Alias) error {
+		alias.Url = body.Url
+		alias.Expires = body.Expires
+		alias.MaxUses = body.MaxUses
+		return nil
+	})
+}
+
+// finishCreateAlias validates the name of a new alias and stores it. Before it
+// is stored, target is called to fill in what the alias points to. It reports
+// whether the alias was created.
+func (a *api) finishCreateAlias(w http.ResponseWriter, user *User, name string, password string, target func(alias *Alias) error) bool {
+	err := validateNewAlias(a.store, name)
+	if err == ErrAliasTaken {
+		writeApiError(w, http.StatusConflict, err.Error())
+		return false
+	}
+	if isAliasError(err) {
+		writeApiError(w, http.StatusBadRequest, err.Error())
+		return false
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return false
+	}
+
+	hashedPassword, err := hashAliasPassword(password)
+	if err != nil {
+		writeServerError(w, err)
+		return false
+	}
+
+	alias := Alias{
+		Owner:    user.Name,
+		Alias:    name,
+		Password: hashedPassword,
+	}
+
+	if err := target(&alias); err != nil {
+		writeServerError(w, err)
+		return false
+	}
+
+	err = a.store.CreateAlias(alias)
+	if err == ErrAliasTaken {
+		writeApiError(w, http.StatusConflict, err.Error())
+		return false
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return false
+	}
+
+	writeJson(w, http.StatusCreated, newApiAlias(alias))
+	return true
+}
+
+func (a *api) createFile(w http.ResponseWriter, r *http.Request, user *User) {
+	form, err := parseUploadForm(a.store, w, r, a.maxUpload)
+	if err == ErrUploadTooLarge {
+		writeApiError(w, http.StatusRequestEntityTooLarge, uploadTooLarge(a.maxUpload))
+		return
+	}
+	if err != nil {
+		writeApiError(w, http.StatusBadRequest, "bad request")
+		return
+	}
+	created := false
+	defer func() {
+		if !created {
+			form.Discard()
+		}
+	}()
+
+	if form.File == "" {
+		writeApiError(w, http.StatusBadRequest, "missing file")
+		return
+	}
+
+	var expires *time.Time
+	if value := form.FormValue("expires"); value != "" {
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			writeApiError(w, http.StatusBadRequest, "not a valid expiry date")
+			return
+		}
+		if t.Before(time.Now()) {
+			writeApiError(w, http.StatusBadRequest, "expiry must be in the future")
+			return
+		}
+		expires = &t
+	}
+
+	maxUses, err := parseMaxUses(form.FormValue("max_uses"))
+	if err != nil {
+		writeApiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	name := form.FormValue("alias")
+	if name == "" {
+		name, err = NonExistentRandom(a.store)
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+	}
+
+	created = a.finishCreateAlias(w, user, name, form.FormValue("password"), func(alias *Alias) error {
+		alias.Expires = expires
+		alias.MaxUses = maxUses
+		alias.File = form.File
+		return nil
+	})
+}
+
+func (a *api) getAlias(w http.ResponseWriter, r *http.Request, user *User) {
+	alias := a.ownedAlias(w, r, user)
+	if alias == nil {
+		return
+	}
+
+	writeJson(w, http.StatusOK, newApiAlias(*alias))
+}
+
+func (a *api) updateAlias(w http.ResponseWriter, r *http.Request, user *User) {
+	alias := a.ownedAlias(w, r, user)
+	if alias == nil {
+		return
+	}
+	name := alias.Alias
+
+	var body struct {
+		Alias    *string `json:"alias"`
+		Url      *string `json:"url"`
+		Password *string `json:"password"`
+		// Expires is an RFC 3339 date, or an empty string to remove the expiry.
+		Expires *string `json:"expires"`
+		MaxUses *int    `json:"max_uses"`
+		// Owner hands the alias over to another user, only admins can do this.
+		Owner *string `json:"owner"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeApiError(w, http.StatusBadRequest, "bad request")
+		return
+	}
+
+	if body.Url != nil {
+		if !IsUrl(*body.Url) {
+			writeApiError(w, http.StatusBadRequest, "not a valid url")
+			return
+		}
+		alias.Url = *body.Url
+		alias.File = ""
+	}
+
+	if body.Password != nil {
+		var err error
+		alias.Password, err = hashAliasPassword(*body.Password)
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+	}
+
+	if body.Expires != nil {
+		alias.Expires = nil
+		if *body.Expires != "" {
+			t, err := time.Parse(time.RFC3339, *body.Expires)
+			if err != nil {
+				writeApiError(w, http.StatusBadRequest, "not a valid expiry date")
+				return
+			}
+			if t.Before(time.Now()) {
+				writeApiError(w, http.StatusBadRequest, "expiry must be in the future")
+				return
+			}
+			alias.Expires = &t
+		}
+	}
+
+	if body.MaxUses != nil {
+		if *body.MaxUses < 0 {
+			writeApiError(w, http.StatusBadRequest, "maximum number of uses must be a positive number")
+			return
+		}
+		alias.MaxUses = *body.MaxUses
+	}
+
+	if body.Owner != nil && *body.Owner != alias.Owner {
+		if !user.Admin {
+			writeApiError(w, http.StatusForbidden, "only admins can change the owner of an alias")
+			return
+		}
+
+		_, err := a.store.GetUser(*body.Owner)
+		if err == ErrNotFound {
+			writeApiError(w, http.StatusBadRequest, "owner does not exist")
+			return
+		}
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		alias.Owner = *body.Owner
+	}
+
+	if body.Alias != nil {
+		alias.Alias = *body.Alias
+	}
+
+	_ = a.finishUpdateAlias(w, name, *alias)
+}
+
+// updateAliasFile replaces the target of an alias with an uploaded file.
+func (a *api) updateAliasFile(w http.ResponseWriter, r *http.Request, user *User) {
+	alias := a.ownedAlias(w, r, user)
+	if alias == nil {
+		return
+	}
+
+	form, err := parseUploadForm(a.store, w, r, a.maxUpload)
+	if err == ErrUploadTooLarge {
+		writeApiError(w, http.StatusRequestEntityTooLarge, uploadTooLarge(a.maxUpload))
+		return
+	}
+	if err != nil {
+		writeApiError(w, http.StatusBadRequest, "bad request")
+		return
+	}
+	updated := false
+	defer func() {
+		if !updated {
+			form.Discard()
+		}
+	}()
+
+	if form.File == "" {
+		writeApiError(w, http.StatusBadRequest, "missing file")
+		return
+	}
+
+	alias.File = form.File
+	alias.Url = ""
+
+	updated = a.finishUpdateAlias(w, alias.Alias, *alias)
+}
+
+// finishUpdateAlias stores the changes made to the alias that used to be called
+// name. It reports whether the changes were stored.
+func (a *api) finishUpdateAlias(w http.ResponseWriter, name string, alias Alias) bool {
+	if alias.Alias != name {
+		err := validateNewAlias(a.store, alias.Alias)
+		if err == ErrAliasTaken {
+			writeApiError(w, http.StatusConflict, err.Error())
+			return false
+		}
+		if isAliasError(err) {
+			writeApiError(w, http.StatusBadRequest, err.Error())
+			return false
+		}
+		if err != nil {
+			writeServerError(w, err)
+			return false
+		}
+	}
+
+	err := a.store.UpdateAlias(name, alias)
+	if err == ErrAliasTaken {
+		writeApiError(w, http.StatusConflict, err.Error())
+		return false
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return false
+	}
+
+	writeJson(w, http.StatusOK, newApiAlias(alias))
+	return true
+}
+
+func (a *api) getAliasStats(w http.ResponseWriter, r *http.Request, user *User) {
+	alias := a.ownedAlias(w, r, user)
+	if alias == nil {
+		return
+	}
+
+	stats, err := a.store.GetAliasStats(alias.Alias, statsDays, time.Now())
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	type day struct {
+		Day   string `json:"day"`
+		Count int    `json:"count"`
+	}
+	res := struct {
+		Total int   `json:"total"`
+		Daily []day `json:"daily"`
+	}{
+		Total: stats.Total,
+		Daily: make([]day, 0, len(stats.Daily)),
+	}
+	for _, d := range stats.Daily {
+		res.Daily = append(res.Daily, day{d.Day.Format("2006-01-02"), d.Count})
+	}
+
+	writeJson(w, http.StatusOK, res)
+}
+
+func (a *api) deleteAlias(w http.ResponseWriter, r *http.Request, user *User) {
+	alias := a.ownedAlias(w, r, user)
+	if alias == nil {
+		return
+	}
+
+	if err := a.store.RmAlias(alias); err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *api) listTokens(w http.ResponseWriter, r *http.Request, user *User) {
+	tokens, err := a.store.GetUserTokens(user.Name)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	res := make([]apiToken, 0, len(tokens))
+	for _, token := range tokens {
+		res = append(res, newApiToken(token))
+	}
+
+	writeJson(w, http.StatusOK, res)
+}
+
+func (a *api) createToken(w http.ResponseWriter, r *http.Request, user *User) {
+	var body struct {
+		Name    string     `json:"name"`
+		Expires *time.Time `json:"expires"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeApiError(w, http.StatusBadRequest, "bad request")
+		return
+	}
+
+	if body.Name == "" {
+		writeApiError(w, http.StatusBadRequest, "token name cannot be empty")
+		return
+	}
+	if body.Expires != nil && body.Expires.Before(time.Now()) {
+		writeApiError(w, http.StatusBadRequest, "expiry must be in the future")
+		return
+	}
+
+	value, token, err := a.lm.CreateToken(user.Name, body.Name, body.Expires)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	res := newApiToken(token)
+	res.Token = value
+	writeJson(w, http.StatusCreated, res)
+}
+
+func (a *api) deleteToken(w http.ResponseWriter, r *http.Request, user *User) {
+	token, err := a.store.GetToken(mux.Vars(r)["id"])
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	if token == nil || token.Owner != user.Name {
+		writeApiError(w, http.StatusNotFound, "token not found")
+		return
+	}
+
+	if err := a.store.RmToken(token.Id); err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *api) listSessions(w http.ResponseWriter, r *http.Request, user *User) {
+	sessions, err := a.store.GetUserSessions(user.Name)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	res := make([]apiSession, 0, len(sessions))
+	for _, session := range sessions {
+		res = append(res, newApiSession(session))
+	}
+
+	writeJson(w, http.StatusOK, res)
+}
+
+func (a *api) deleteSession(w http.ResponseWriter, r *http.Request, user *User) {
+	err := a.lm.RevokeSession(user.Name, mux.Vars(r)["id"])
+	if err == ErrNotFound {
+		writeApiError(w, http.StatusNotFound, "session not found")
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *api) listUsers(w http.ResponseWriter, r *http.Request, user *User) {
+	if !user.Admin {
+		writeApiError(w, http.StatusForbidden, "forbidden")
+		return
+	}
+
+	users, err := a.store.GetUsers()
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	res := make([]apiUser, 0, len(users))
+	for _, u := range users {
+		entry, err := a.newApiUser(u)
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		res = append(res, entry)
+	}
+
+	writeJson(w, http.StatusOK, res)
+}
+
+func (a *api) createUser(w http.ResponseWriter, r *http.Request, user *User) {
+	if !user.Admin {
+		writeApiError(w, http.StatusForbidden, "forbidden")
+		return
+	}
+
+	var body struct {
+		Name     string `json:"name"`
+		Password string `json:"password"`
+		Admin    bool   `json:"admin"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeApiError(w, http.StatusBadRequest, "bad request")
+		return
+	}
+
+	if body.Name == "" {
+		writeApiError(w, http.StatusBadRequest, "username cannot be empty")
+		return
+	}
+	if body.Password == "" {
+		writeApiError(w, http.StatusBadRequest, "password cannot be empty")
+		return
+	}
+
+	newUser := User{
+		Name:     body.Name,
+		Password: []byte(body.Password),
+		Admin:    body.Admin,
+	}
+
+	exists, err := a.lm.CreateUser(newUser)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	if exists {
+		writeApiError(w, http.StatusConflict, "user exists")
+		return
+	}
+
+	a.writeUser(w, http.StatusCreated, newUser)
+}
+
+func (a *api) getUser(w http.ResponseWriter, r *http.Request, user *User) {
+	res := a.namedUser(w, r, user)
+	if res == nil {
+		return
+	}
+
+	a.writeUser(w, http.StatusOK, *res)
+}
+
+func (a *api) updateUser(w http.ResponseWriter, r *http.Request, user *User) {
+	res := a.namedUser(w, r, user)
+	if res == nil {
+		return
+	}
+
+	var body struct {
+		Password *string `json:"password"`
+		Admin    *bool   `json:"admin"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeApiError(w, http.StatusBadRequest, "bad request")
+		return
+	}
+
+	if body.Admin != nil {
+		if !user.Admin {
+			writeApiError(w, http.StatusForbidden, "forbidden")
+			return
+		}
+		if res.Name == user.Name {
+			writeApiError(w, http.StatusBadRequest, "can't change your own admin status")
+			return
+		}
+	}
+
+	if body.Password != nil {
+		if *body.Password == "" {
+			writeApiError(w, http.StatusBadRequest, "password cannot be empty")
+			return
+		}
+
+		err := a.lm.ChangePassword(*res, *body.Password)
+		if err == ErrExternalUser {
+			writeApiError(w, http.StatusConflict, err.Error())
+			return
+		}
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+	}
+
+	if body.Admin != nil {
+		if err := a.lm.SetAdmin(res.Name, *body.Admin); err != nil {
+			writeServerError(w, err)
+			return
+		}
+		res.Admin = *body.Admin
+	}
+
+	a.writeUser(w, http.StatusOK, *res)
+}
+
+func (a *api) deleteUser(w http.ResponseWriter, r *http.Request, user *User) {
+	res := a.namedUser(w, r, user)
+	if res == nil {
+		return
+	}
+
+	if err := a.store.RmUser(res.Name); err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteUserSessions logs a user out everywhere.
+func (a *api) deleteUserSessions(w http.ResponseWriter, r *http.Request, user *User) {
+	res := a.namedUser(w, r, user)
+	if res == nil {
+		return
+	}
+
+	if err := a.lm.RevokeSessions(res.Name); err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *api) listInvites(w http.ResponseWriter, r *http.Request, user *User) {
+	if !user.Admin {
+		writeApiError(w, http.StatusForbidden, "forbidden")
+		return
+	}
+
+	invites, err := a.store.GetInvites()
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	res := make([]apiInvite, 0, len(invites))
+	for _, invite := range invites {
+		res = append(res, newApiInvite(invite))
+	}
+
+	writeJson(w, http.StatusOK, res)
+}
+
+func (a *api) createInvite(w http.ResponseWriter, r *http.Request, user *User) {
+	if !user.Admin {
+		writeApiError(w, http.StatusForbidden, "forbidden")
+		return
+	}
+
+	var body struct {
+		Note    string     `json:"note"`
+		Admin   bool       `json:"admin"`
+		Expires *time.Time `json:"expires"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeApiError(w, http.StatusBadRequest, "bad request")
+		return
+	}
+
+	expires := time.Now().Add(DefaultInviteExpiry)
+	if body.Expires != nil {
+		if body.Expires.Before(time.Now()) {
+			writeApiError(w, http.StatusBadRequest, "expiry must be in the future")
+			return
+		}
+		expires = *body.Expires
+	}
+
+	code, invite, err := a.lm.CreateInvite(user.Name, body.Note, body.Admin, expires)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	res := newApiInvite(invite)
+	res.Link = fmt.Sprintf("%s/__API__/invite/%s", a.base, code)
+	writeJson(w, http.StatusCreated, res)
+}
+
+func (a *api) deleteInvite(w http.ResponseWriter, r *http.Request, user *User) {
+	if !user.Admin {
+		writeApiError(w, http.StatusForbidden, "forbidden")
+		return
+	}
+
+	invite, err := a.store.GetInvite(mux.Vars(r)["id"])
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	if invite == nil {
+		writeApiError(w, http.StatusNotFound, "invite not found")
+		return
+	}
+
+	if err := a.store.RmInvite(invite.Id); err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *api) exportUser(w http.ResponseWriter, r *http.Request, user *User) {
+	res := a.namedUser(w, r, user)
+	if res == nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", ExportFilename(res.Name, time.Now())))
+
+	if err := ExportUser(a.store, res.Name, w); err != nil {
+		log.Printf("export of %s failed: %v", res.Name, err)
+	}
+}
+
+type apiRestoreReport struct {
+	Restored map[string]int `json:"restored"`
+	Skipped  map[string]int `json:"skipped"`
+}
+
+func backupFilename(now time.Time) string {
+	return fmt.Sprintf("short-backup-%s.tar.gz", now.Format("20060102-150405"))
+}
+
+func (a *api) getBackup(w http.ResponseWriter, r *http.Request, user *User) {
+	if !user.Admin {
+		writeApiError(w, http.StatusForbidden, "forbidden")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", backupFilename(time.Now())))
+
+	// the status has been sent by the time anything goes wrong, a truncated
+	// archive is all the client gets
+	if err := a.store.Backup(w); err != nil {
+		log.Printf("backup failed: %v", err)
+	}
+}
+
+func (a *api) restoreBackup(w http.ResponseWriter, r *http.Request, user *User) {
+	if !user.Admin {
+		writeApiError(w, http.StatusForbidden, "forbidden")
+		return
+	}
+
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = RestoreMerge
+	}
+	if mode != RestoreMerge && mode != RestoreReplace {
+		writeApiError(w, http.StatusBadRequest, "mode must be merge or replace")
+		return
+	}
+
+	report, err := a.store.Restore(r.Body, mode)
+	if errors.Is(err, ErrInvalidBackup) || errors.Is(err, ErrSchemaTooNew) {
+		writeApiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, apiRestoreReport(report))
+}
+
+type apiImportEntry struct {
+	Row      int    `json:"row"`
+	Original string `json:"original"`
+	Alias    string `json:"alias"`
+	Url      string `json:"url"`
+	Owner    string `json:"owner"`
+	Action   string `json:"action"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+type apiImportReport struct {
+	DryRun  bool             `json:"dry_run"`
+	Counts  map[string]int   `json:"counts"`
+	Entries []apiImportEntry `json:"entries"`
+}
+
+// importLinks imports the export in the body. The format, conflict policy,
+// default owner and owner mappings (old=new, can be repeated) are given as
+// query parameters, as is dry_run.
+func (a *api) importLinks(w http.ResponseWriter, r *http.Request, user *User) {
+	if !user.Admin {
+		writeApiError(w, http.StatusForbidden, "forbidden")
+		return
+	}
+
+	query := r.URL.Query()
+
+	owners, err := ParseOwnerMapping(query["owner"])
+	if err != nil {
+		writeApiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	conflict := query.Get("conflict")
+	if conflict == "" {
+		conflict = ConflictSkip
+	}
+
+	report, err := Import(a.store, r.Body, ImportOptions{
+		Format:       query.Get("format"),
+		Conflict:     conflict,
+		DryRun:       query.Get("dry_run") == "true",
+		Owners:       owners,
+		DefaultOwner: query.Get("default_owner"),
+	})
+	if errors.Is(err, ErrInvalidImport) {
+		writeApiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	res := apiImportReport{
+		DryRun:  report.DryRun,
+		Counts:  map[string]int{},
+		Entries: make([]apiImportEntry, 0, len(report.Entries)),
+	}
+	for _, entry := range report.Entries {
+		res.Counts[entry.Action] += 1
+		res.Entries = append(res.Entries, apiImportEntry(entry))
+	}
+
+	writeJson(w, http.StatusOK, res)
+}
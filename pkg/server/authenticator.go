@@ -0,0 +1,129 @@
+package server
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrInvalidPassword = errors.New("invalid password")
+	ErrExternalUser    = errors.New("the password of this user is managed elsewhere")
+)
+
+// Identity is who an Authenticator says someone is.
+type Identity struct {
+	Name  string
+	Email string
+	// Admin is nil when the authenticator doesn't decide who is an admin.
+	Admin *bool
+	// Source is set by authenticators that check passwords somewhere else
+	// than in the store. Users that don't exist yet are created with it on
+	// their first login.
+	Source string
+	// Link lets an identity from another source take over a local user with
+	// the same name.
+	Link bool
+}
+
+// An Authenticator checks the password someone logs in with.
+type Authenticator interface {
+	// Authenticate returns who name is when password is theirs. It returns
+	// ErrNotFound when it doesn't know name, so the next authenticator can be
+	// tried.
+	Authenticate(name string, password string) (Identity, error)
+}
+
+// LocalAuthenticator checks passwords against the bcrypt hashes in the store.
+type LocalAuthenticator struct {
+	store Store
+}
+
+func NewLocalAuthenticator(store Store) LocalAuthenticator {
+	return LocalAuthenticator{store}
+}
+
+func (a LocalAuthenticator) Authenticate(name string, password string) (Identity, error) {
+	user, err := a.store.GetUser(name)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	// users from other sources have no password, so they can't log in here
+	if err := bcrypt.CompareHashAndPassword(user.Password, []byte(password)); err != nil {
+		return Identity{}, ErrInvalidPassword
+	}
+
+	return Identity{
+		Name: user.Name,
+	}, nil
+}
+
+// authenticate asks the authenticators in order until one accepts the
+// password, and returns the user they logged in as. Trying the next one when a
+// source turns someone down, or knows a local user by the same name, lets
+// local users log in with their own password, even when ldap is down.
+//
+// When a source turned the password down, that is the answer, even if
+// another one couldn't be asked: otherwise guesses wouldn't count as failures
+// while ldap is down. Errors of sources are only returned when none of them
+// gave an answer.
+func (lm LoginManager) authenticate(name string, password string) (User, error) {
+	rejected := false
+	res := ErrNotFound
+	for _, authenticator := range lm.authenticators {
+		identity, err := authenticator.Authenticate(name, password)
+		if err == nil {
+			var user User
+			user, err = lm.syncUser(identity)
+			if err == nil {
+				return user, nil
+			}
+		}
+
+		if err == ErrInvalidPassword {
+			rejected = true
+		} else if err != ErrNotFound && res == ErrNotFound {
+			res = err
+		}
+	}
+
+	if rejected {
+		return User{}, ErrInvalidPassword
+	}
+
+	return User{}, res
+}
+
+// syncUser returns the user of identity. Users from other sources are created
+// when they don't exist yet, and get the email address and admin rights their
+// source says they have.
+func (lm LoginManager) syncUser(identity Identity) (User, error) {
+	user, err := lm.store.GetUser(identity.Name)
+	if identity.Source == "" || (err != nil && err != ErrNotFound) {
+		return user, err
+	}
+
+	if err == ErrNotFound {
+		user = User{
+			Name:   identity.Name,
+			Source: identity.Source,
+		}
+	} else if user.Source != identity.Source {
+		if !identity.Link {
+			return User{}, ErrUserExists
+		}
+		// the password of the local user can't be used anymore
+		user.Source = identity.Source
+		user.Password = nil
+	}
+
+	if identity.Email != "" {
+		user.Email = identity.Email
+	}
+	if identity.Admin != nil {
+		user.Admin = *identity.Admin
+	}
+
+	return user, lm.store.UpdateUser(&user)
+}
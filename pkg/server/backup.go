@@ -0,0 +1,985 @@
+package server
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A backup is a gzipped tar archive with these entries, in this order:
+//
+//	manifest.json  a backupManifest
+//	blobs/<id>     the contents of a file, one entry for every file record
+//	records.jsonl  every record, one {"key": ..., "value": ...} per line,
+//	               ordered by key, where value is the JSON of the record
+//
+// Blobs come before the records so a restore can store them while reading
+// and check them against the file records that follow. The owner and expiry
+// indexes, the click counts and the schema version aren't part of the
+// records, the first three are rebuilt from the aliases and clicks and the
+// last is in the manifest.
+const backupFormat = "short-backup"
+const backupVersion = 1
+
+const backupManifestName = "manifest.json"
+const backupRecordsName = "records.jsonl"
+const backupBlobDir = "blobs/"
+
+// Records are written in batches of this size when restoring.
+const restoreBatchSize = 1000
+
+// The ways a backup can be restored.
+const (
+	// RestoreMerge adds the records in the backup to the ones already there.
+	// Users, aliases, tokens, files, invites and settings that already exist
+	// are kept, an alias that is skipped takes its file and clicks with it,
+	// and a user that is skipped their tokens. Sessions aren't backed up, so
+	// none are restored either.
+	RestoreMerge = "merge"
+	// RestoreReplace removes the users, aliases, tokens, files, clicks,
+	// invites and settings that are there first. Sessions of users that are
+	// in the backup are kept, so whoever restores it stays logged in.
+	RestoreReplace = "replace"
+)
+
+var ErrInvalidBackup = errors.New("invalid backup")
+
+type backupManifest struct {
+	Format        string    `json:"format"`
+	Version       int       `json:"version"`
+	SchemaVersion int       `json:"schema_version"`
+	Created       time.Time `json:"created"`
+}
+
+type backupRecord struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+// The records in a backup, by the prefix of their key.
+var backupKinds = map[string]string{
+	userPrefix:   "users",
+	aliasPrefix:  "aliases",
+	filePrefix:   "files",
+	tokenPrefix:  "tokens",
+	clickPrefix:  "clicks",
+	settingsKey:  "settings",
+	invitePrefix: "invites",
+}
+
+func backupKind(key string) (string, string, bool) {
+	for p, kind := range backupKinds {
+		if strings.HasPrefix(key, p) {
+			return p, kind, true
+		}
+	}
+
+	return "", "", false
+}
+
+// RestoreReport counts the records that were restored and skipped, by kind.
+type RestoreReport struct {
+	Restored map[string]int
+	Skipped  map[string]int
+}
+
+func invalidBackup(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidBackup, fmt.Sprintf(format, args...))
+}
+
+func writeTarEntry(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    size,
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.CopyN(tw, r, size)
+	return err
+}
+
+// Backup writes a backup of everything in the store to w. The records are read
+// in a single read transaction, so they are consistent while the server keeps
+// running. They are kept in a temporary file until the contents of the files
+// have been written, which happens after the transaction, so a slow reader
+// can't keep it open.
+func (s kvStore) Backup(w io.Writer) error {
+	records, err := ioutil.TempFile("", "short-backup")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(records.Name())
+	defer records.Close()
+
+	var version int
+	var identifiers []string
+	files := map[string]File{}
+	err = s.db.View(func(txn kvTxn) error {
+		var err error
+		version, err = getSchemaVersion(txn)
+		if err != nil {
+			return err
+		}
+
+		enc := json.NewEncoder(records)
+		return txn.Iterate(nil, func(key []byte, value func() ([]byte, error)) error {
+			if _, _, ok := backupKind(string(key)); !ok {
+				return nil
+			}
+
+			val, err := value()
+			if err != nil {
+				return err
+			}
+
+			if strings.HasPrefix(string(key), filePrefix) {
+				var file File
+				if err := decodeJson(val, &file); err != nil {
+					return err
+				}
+
+				identifier := string(key[len(filePrefix):])
+				identifiers = append(identifiers, identifier)
+				files[identifier] = file
+			}
+
+			return enc.Encode(backupRecord{
+				Key:   string(key),
+				Value: val,
+			})
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	manifest, err := json.Marshal(backupManifest{
+		Format:        backupFormat,
+		Version:       backupVersion,
+		SchemaVersion: version,
+		Created:       time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	err = writeTarEntry(tw, backupManifestName, int64(len(manifest)), strings.NewReader(string(manifest)))
+	if err != nil {
+		return err
+	}
+
+	// files removed since the records were read have had their blob removed
+	// as well, those are left out
+	missing := map[string]bool{}
+	for _, identifier := range identifiers {
+		file := files[identifier]
+		data, err := s.blobs.Open(file.Blob)
+		if os.IsNotExist(err) {
+			log.Printf("leaving file %s out of the backup, its contents are gone", identifier)
+			missing[identifier] = true
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		err = writeTarEntry(tw, backupBlobDir+file.Blob, file.Size, data)
+		_ = data.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(missing) > 0 {
+		left, err := leaveOutFiles(records, missing)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(left.Name())
+		defer left.Close()
+		records = left
+	}
+
+	size, err := records.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := records.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := writeTarEntry(tw, backupRecordsName, size, records); err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// leaveOutFiles copies the records written by Backup to a new temporary file,
+// without the files that are missing. The aliases with those files were
+// removed or changed since as well, they are left out together with their
+// clicks, so the backup still refers to everything it needs.
+func leaveOutFiles(records *os.File, missing map[string]bool) (*os.File, error) {
+	res, err := ioutil.TempFile("", "short-backup")
+	if err != nil {
+		return nil, err
+	}
+
+	err = func() error {
+		if _, err := records.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+
+		dec := json.NewDecoder(records)
+		enc := json.NewEncoder(res)
+		aliases := map[string]bool{}
+		for {
+			var record backupRecord
+			err := dec.Decode(&record)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			p, _, _ := backupKind(record.Key)
+			name := strings.TrimPrefix(record.Key, p)
+			switch p {
+			case aliasPrefix:
+				var alias Alias
+				if err := decodeJson(record.Value, &alias); err != nil {
+					return err
+				}
+				if alias.File != "" && missing[alias.File] {
+					log.Printf("leaving alias %s out of the backup, its file is gone", alias.Alias)
+					aliases[alias.Alias] = true
+					continue
+				}
+			case clickPrefix:
+				if i := strings.IndexByte(name, ':'); i >= 0 && aliases[name[:i]] {
+					continue
+				}
+			case filePrefix:
+				if missing[name] {
+					continue
+				}
+			}
+
+			if err := enc.Encode(record); err != nil {
+				return err
+			}
+		}
+	}()
+	if err != nil {
+		_ = res.Close()
+		_ = os.Remove(res.Name())
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// archiveReader marks errors reading an archive, such as one that was cut
+// short, as ErrInvalidBackup.
+type archiveReader struct {
+	r io.Reader
+}
+
+func (a archiveReader) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = invalidBackup("%v", err)
+	}
+
+	return n, err
+}
+
+type restoredBlob struct {
+	id   string
+	size int64
+	hash []byte
+}
+
+// restore keeps track of a restore while the archive is read.
+type restore struct {
+	s        kvStore
+	mode     string
+	manifest backupManifest
+	// blobs in the archive by the id they had there
+	blobs map[string]restoredBlob
+	// records that were read, in a temporary file
+	records *os.File
+	count   int
+
+	users   map[string]bool
+	files   map[string]File
+	aliases []Alias
+	// users that are skipped while merging, because there already is a
+	// user with the same name
+	skippedUsers map[string]bool
+}
+
+// Restore reads a backup made by Backup and restores it in the given mode. The
+// whole archive is read and checked before anything is changed. Records are
+// then written in batches, so a merge that fails halfway, for example because
+// the disk is full, can leave part of the backup restored. A replace that fails
+// puts back what was there before. Other writes wait until the restore is
+// done, so they can't get mixed up with it, but reads made meanwhile can see
+// it halfway.
+func (s kvStore) Restore(r io.Reader, mode string) (RestoreReport, error) {
+	if mode != RestoreMerge && mode != RestoreReplace {
+		return RestoreReport{}, fmt.Errorf("unknown restore mode %q", mode)
+	}
+
+	res := &restore{
+		s:            s,
+		mode:         mode,
+		blobs:        map[string]restoredBlob{},
+		users:        map[string]bool{},
+		files:        map[string]File{},
+		skippedUsers: map[string]bool{},
+	}
+
+	records, err := ioutil.TempFile("", "short-restore")
+	if err != nil {
+		return RestoreReport{}, err
+	}
+	defer os.Remove(records.Name())
+	defer records.Close()
+	res.records = records
+
+	// blobs that end up not being used are removed again, which is all of
+	// them when the restore fails
+	used := map[string]bool{}
+	defer func() {
+		for _, blob := range res.blobs {
+			if !used[blob.id] {
+				_ = s.blobs.Remove(blob.id)
+			}
+		}
+	}()
+
+	// reading the archive can take as long as the upload does, writes only
+	// have to wait for what comes after
+	if err := res.read(r); err != nil {
+		return RestoreReport{}, err
+	}
+
+	var report RestoreReport
+	err = s.exclusive(func(s kvStore) error {
+		res.s = s
+		if err := res.validate(); err != nil {
+			return err
+		}
+
+		var err error
+		if mode == RestoreReplace {
+			report, err = res.replace(used)
+		} else {
+			report, err = res.apply(used)
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := s.recountClicks(); err != nil {
+			return err
+		}
+
+		if mode == RestoreReplace {
+			err := s.db.Update(func(txn kvTxn) error {
+				return setJson(txn, []byte(schemaVersionKey), res.manifest.SchemaVersion)
+			})
+			if err != nil {
+				return err
+			}
+
+			if _, err := s.migrate(false); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return RestoreReport{}, err
+	}
+
+	return report, nil
+}
+
+// read reads the archive, storing the blobs in it and checking the records
+// one by one.
+func (res *restore) read(r io.Reader) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return invalidBackup("not a gzipped archive: %v", err)
+	}
+	tr := tar.NewReader(gz)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return invalidBackup("%v", err)
+	}
+	if hdr.Name != backupManifestName {
+		return invalidBackup("archive doesn't start with %s", backupManifestName)
+	}
+	if err := json.NewDecoder(tr).Decode(&res.manifest); err != nil {
+		return invalidBackup("manifest: %v", err)
+	}
+	if res.manifest.Format != backupFormat {
+		return invalidBackup("not a backup of short")
+	}
+	if res.manifest.Version != backupVersion {
+		return invalidBackup("unsupported backup version %d", res.manifest.Version)
+	}
+	if res.manifest.SchemaVersion > SchemaVersion {
+		return fmt.Errorf("%w: the backup has schema version %d, this version only knows up to %d", ErrSchemaTooNew, res.manifest.SchemaVersion, SchemaVersion)
+	}
+	if res.mode == RestoreMerge && res.manifest.SchemaVersion != SchemaVersion {
+		return invalidBackup("can only merge backups with schema version %d, this one has %d, restore it in a new instance and back that up instead", SchemaVersion, res.manifest.SchemaVersion)
+	}
+
+	sawRecords := false
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return invalidBackup("%v", err)
+		}
+
+		switch {
+		case strings.HasPrefix(hdr.Name, backupBlobDir) && !sawRecords:
+			name := strings.TrimPrefix(hdr.Name, backupBlobDir)
+			if _, ok := res.blobs[name]; ok || name == "" {
+				return invalidBackup("duplicate blob %s", name)
+			}
+
+			id, size, hash, err := res.s.blobs.Write(archiveReader{tr})
+			if err != nil {
+				return err
+			}
+			res.blobs[name] = restoredBlob{id, size, hash}
+		case hdr.Name == backupRecordsName && !sawRecords:
+			sawRecords = true
+			if err := res.readRecords(tr); err != nil {
+				return err
+			}
+		default:
+			return invalidBackup("unexpected entry %s", hdr.Name)
+		}
+	}
+
+	if !sawRecords {
+		return invalidBackup("archive has no %s", backupRecordsName)
+	}
+
+	// the checksum of the archive is only checked at its very end
+	if _, err := io.Copy(ioutil.Discard, gz); err != nil {
+		return invalidBackup("%v", err)
+	}
+
+	_, err = res.records.Seek(0, io.SeekStart)
+	return err
+}
+
+func (res *restore) readRecords(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	enc := json.NewEncoder(res.records)
+
+	last := ""
+	for {
+		var record backupRecord
+		err := dec.Decode(&record)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return invalidBackup("record %d: %v", res.count+1, err)
+		}
+
+		if record.Key <= last {
+			return invalidBackup("record %s is out of order", record.Key)
+		}
+		last = record.Key
+
+		if err := res.checkRecord(record); err != nil {
+			return err
+		}
+
+		if err := enc.Encode(record); err != nil {
+			return err
+		}
+		res.count += 1
+	}
+}
+
+// checkRecord checks a single record, and remembers what validate needs.
+func (res *restore) checkRecord(record backupRecord) error {
+	p, _, ok := backupKind(record.Key)
+	if !ok {
+		return invalidBackup("unknown record %s", record.Key)
+	}
+	name := strings.TrimPrefix(record.Key, p)
+
+	switch p {
+	case userPrefix:
+		var user User
+		if err := decodeJson(record.Value, &user); err != nil {
+			return invalidBackup("user %s: %v", name, err)
+		}
+		if user.Name != name {
+			return invalidBackup("user %s has name %s", name, user.Name)
+		}
+		res.users[name] = true
+	case aliasPrefix:
+		var alias Alias
+		if err := decodeJson(record.Value, &alias); err != nil {
+			return invalidBackup("alias %s: %v", name, err)
+		}
+		if alias.Alias != name || !IsValidAlias(name) {
+			return invalidBackup("alias %s has name %s", name, alias.Alias)
+		}
+		res.aliases = append(res.aliases, alias)
+	case filePrefix:
+		var file File
+		if err := decodeJson(record.Value, &file); err != nil {
+			return invalidBackup("file %s: %v", name, err)
+		}
+		blob, ok := res.blobs[file.Blob]
+		if !ok {
+			return invalidBackup("contents of file %s are missing", name)
+		}
+		if blob.size != file.Size || string(blob.hash) != string(file.Hash) {
+			return invalidBackup("contents of file %s are damaged", name)
+		}
+		res.files[name] = file
+	case tokenPrefix:
+		var token Token
+		if err := decodeJson(record.Value, &token); err != nil {
+			return invalidBackup("token %s: %v", name, err)
+		}
+		if token.Id != name {
+			return invalidBackup("token %s has id %s", name, token.Id)
+		}
+	case clickPrefix:
+		var click Click
+		if err := decodeJson(record.Value, &click); err != nil {
+			return invalidBackup("click %s: %v", name, err)
+		}
+	case invitePrefix:
+		var invite Invite
+		if err := decodeJson(record.Value, &invite); err != nil {
+			return invalidBackup("invite %s: %v", name, err)
+		}
+		if invite.Id != name {
+			return invalidBackup("invite %s has id %s", name, invite.Id)
+		}
+	case settingsKey:
+		var settings Settings
+		if name != "" {
+			return invalidBackup("unknown record %s", record.Key)
+		}
+		if err := decodeJson(record.Value, &settings); err != nil {
+			return invalidBackup("settings: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// validate checks that the records refer to each other correctly. When
+// merging, it also finds the users that are skipped.
+func (res *restore) validate() error {
+	return res.s.db.View(func(txn kvTxn) error {
+		if res.mode == RestoreMerge {
+			for name := range res.users {
+				skip, err := exists(txn, prefix(userPrefix, name))
+				if err != nil {
+					return err
+				}
+				if skip {
+					res.skippedUsers[name] = true
+				}
+			}
+		}
+
+		for _, alias := range res.aliases {
+			if !res.users[alias.Owner] {
+				// when merging, an alias can belong to a user that is
+				// already there
+				ownerExists := false
+				if res.mode == RestoreMerge {
+					var err error
+					ownerExists, err = exists(txn, prefix(userPrefix, alias.Owner))
+					if err != nil {
+						return err
+					}
+				}
+
+				if !ownerExists {
+					return invalidBackup("alias %s belongs to %s, who isn't in the backup", alias.Alias, alias.Owner)
+				}
+			}
+
+			if alias.File != "" {
+				if _, ok := res.files[alias.File]; !ok {
+					return invalidBackup("file %s of alias %s isn't in the backup", alias.File, alias.Alias)
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+// replaceable reports whether a restore in replace mode removes the record
+// with key: the records that are backed up, and the owner and expiry indexes
+// and click counts that are rebuilt from them. Sessions, session keys and the
+// schema version are kept.
+func replaceable(key string) bool {
+	if _, _, ok := backupKind(key); ok {
+		return true
+	}
+
+	return strings.HasPrefix(key, ownerPrefix) || strings.HasPrefix(key, expiresPrefix) || strings.HasPrefix(key, clickCountPrefix)
+}
+
+// savedRecord is a record that a restore in replace mode removed. Unlike a
+// backupRecord its value doesn't have to be JSON, like that of the owner index.
+type savedRecord struct {
+	Key   []byte
+	Value []byte
+}
+
+// clear removes the records that a restore in replace mode replaces, in
+// batches. They are written to saved first, so they can be put back when the
+// restore fails. It returns the blobs of the files that were removed, which are
+// left for the caller to remove once they are no longer needed.
+func (s kvStore) clear(saved io.Writer) ([]string, error) {
+	var keys [][]byte
+	var blobs []string
+	enc := json.NewEncoder(saved)
+	err := s.db.View(func(txn kvTxn) error {
+		return txn.Iterate(nil, func(key []byte, value func() ([]byte, error)) error {
+			if !replaceable(string(key)) {
+				return nil
+			}
+
+			val, err := value()
+			if err != nil {
+				return err
+			}
+
+			if strings.HasPrefix(string(key), filePrefix) {
+				var file File
+				if err := decodeJson(val, &file); err != nil {
+					return err
+				}
+				if file.Blob != "" {
+					blobs = append(blobs, file.Blob)
+				}
+			}
+
+			keys = append(keys, key)
+			return enc.Encode(savedRecord{key, val})
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > restoreBatchSize {
+			batch = batch[:restoreBatchSize]
+		}
+		keys = keys[len(batch):]
+
+		err := s.db.Update(func(txn kvTxn) error {
+			for _, key := range batch {
+				if err := txn.Delete(key); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return blobs, nil
+}
+
+// putBack undoes a restore in replace mode that failed halfway. It removes
+// what was restored, and writes the records that clear saved back in batches.
+func (s kvStore) putBack(saved io.ReadSeeker) error {
+	if _, err := s.clear(ioutil.Discard); err != nil {
+		return err
+	}
+
+	if _, err := saved.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(saved)
+	for {
+		var batch []savedRecord
+		for len(batch) < restoreBatchSize {
+			var record savedRecord
+			err := dec.Decode(&record)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			batch = append(batch, record)
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+
+		err := s.db.Update(func(txn kvTxn) error {
+			for _, record := range batch {
+				if err := txn.Set(record.Key, record.Value); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// replace replaces what is in the store with the records that were read. Since
+// that takes more than one transaction, the records it replaces are kept in a
+// temporary file until it is done, and put back when it fails. The contents of
+// the files that were replaced are only removed once it has succeeded, as are
+// the sessions of users that aren't in the backup. Blobs that end up being
+// used are added to used.
+func (res *restore) replace(used map[string]bool) (RestoreReport, error) {
+	saved, err := ioutil.TempFile("", "short-replaced")
+	if err != nil {
+		return RestoreReport{}, err
+	}
+	defer os.Remove(saved.Name())
+	defer saved.Close()
+
+	replaced, err := res.s.clear(saved)
+	var report RestoreReport
+	if err == nil {
+		report, err = res.apply(used)
+	}
+	if err != nil {
+		// none of the restored blobs are used anymore
+		for blob := range used {
+			delete(used, blob)
+		}
+
+		if putBackErr := res.s.putBack(saved); putBackErr != nil {
+			return RestoreReport{}, fmt.Errorf("%v, and putting back what was there before failed as well, restore a backup that was made before: %v", err, putBackErr)
+		}
+		return RestoreReport{}, err
+	}
+
+	for _, blob := range replaced {
+		_ = res.s.blobs.Remove(blob)
+	}
+
+	err = res.s.db.Update(func(txn kvTxn) error {
+		return res.s.rmSessions(txn, func(session LoginSession) bool {
+			return !res.users[session.Owner]
+		})
+	})
+	return report, err
+}
+
+// apply writes the records that were read to the store. Blobs that end up
+// being used are added to used.
+func (res *restore) apply(used map[string]bool) (RestoreReport, error) {
+	report := RestoreReport{
+		Restored: map[string]int{},
+		Skipped:  map[string]int{},
+	}
+
+	// aliases that were skipped while merging, with their files
+	skippedAliases := map[string]bool{}
+	skippedFiles := map[string]bool{}
+
+	dec := json.NewDecoder(res.records)
+	for {
+		var batch []backupRecord
+		for len(batch) < restoreBatchSize {
+			var record backupRecord
+			err := dec.Decode(&record)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return RestoreReport{}, err
+			}
+			batch = append(batch, record)
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		var restored []string
+		var skipped []string
+		var blobs []string
+		err := res.s.db.Update(func(txn kvTxn) error {
+			restored, skipped, blobs = nil, nil, nil
+
+			for _, record := range batch {
+				p, kind, _ := backupKind(record.Key)
+				name := strings.TrimPrefix(record.Key, p)
+				value := []byte(record.Value)
+
+				skip := false
+				if res.mode == RestoreMerge {
+					var err error
+					skip, err = exists(txn, []byte(record.Key))
+					if err != nil {
+						return err
+					}
+				}
+
+				switch p {
+				case aliasPrefix:
+					var alias Alias
+					if err := decodeJson(value, &alias); err != nil {
+						return err
+					}
+					if skip {
+						skippedAliases[alias.Alias] = true
+						skippedFiles[alias.File] = true
+						break
+					}
+
+					err := txn.Set(ownerKey(alias.Owner, alias.Alias), []byte{})
+					if err != nil {
+						return err
+					}
+					if err := addAliasExpiry(txn, alias); err != nil {
+						return err
+					}
+				case filePrefix:
+					skip = skip || skippedFiles[name]
+					if skip {
+						break
+					}
+
+					var file File
+					if err := decodeJson(value, &file); err != nil {
+						return err
+					}
+					file.Blob = res.blobs[file.Blob].id
+					blobs = append(blobs, file.Blob)
+
+					var err error
+					value, err = json.Marshal(&file)
+					if err != nil {
+						return err
+					}
+				case clickPrefix:
+					alias := name
+					if i := strings.IndexByte(alias, ':'); i >= 0 {
+						alias = alias[:i]
+					}
+					skip = skip || skippedAliases[alias]
+				case tokenPrefix:
+					// the user that is already there may be someone
+					// else, who shouldn't get the tokens of the user
+					// in the backup
+					var token Token
+					if err := decodeJson(value, &token); err != nil {
+						return err
+					}
+					skip = skip || res.skippedUsers[token.Owner]
+				}
+
+				if skip {
+					skipped = append(skipped, kind)
+					continue
+				}
+
+				if err := txn.Set([]byte(record.Key), value); err != nil {
+					return err
+				}
+				restored = append(restored, kind)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return RestoreReport{}, err
+		}
+
+		for _, kind := range restored {
+			report.Restored[kind] += 1
+		}
+		for _, kind := range skipped {
+			report.Skipped[kind] += 1
+		}
+		for _, blob := range blobs {
+			used[blob] = true
+		}
+	}
+
+	return report, nil
+}
+
+// String describes the report in a single line, like "restored 3 aliases and
+// 2 users, skipped 1 alias".
+func (r RestoreReport) String() string {
+	describe := func(counts map[string]int) string {
+		var kinds []string
+		for kind := range counts {
+			kinds = append(kinds, kind)
+		}
+		sort.Strings(kinds)
+
+		var parts []string
+		for _, kind := range kinds {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[kind], kind))
+		}
+		if len(parts) == 0 {
+			return "nothing"
+		}
+
+		return strings.Join(parts, ", ")
+	}
+
+	res := "restored " + describe(r.Restored)
+	if len(r.Skipped) > 0 {
+		res += ", skipped " + describe(r.Skipped)
+	}
+
+	return res
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// BlobStore keeps the contents of uploaded files.
+type BlobStore interface {
+	// Write copies r into a new blob. It returns the id of the blob, its size
+	// and the sha256 hash of its contents. The blob only becomes visible once
+	// it has been written completely.
+	Write(r io.Reader) (string, int64, []byte, error)
+	Open(id string) (io.ReadSeekCloser, error)
+	// Remove removes a blob. Removing a blob that doesn't exist is not an
+	// error.
+	Remove(id string) error
+}
+
+// DiskBlobStore keeps blobs on disk, one file per blob, so they can be
+// streamed in and out without holding them in memory.
+type DiskBlobStore struct {
+	dir string
+}
+
+func NewDiskBlobStore(dir string) (*DiskBlobStore, error) {
+	// anything left in tmp is from an upload that never finished
+	if err := os.RemoveAll(filepath.Join(dir, "tmp")); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "tmp"), 0700); err != nil {
+		return nil, err
+	}
+
+	return &DiskBlobStore{
+		dir,
+	}, nil
+}
+
+// String returns the directory the blobs are kept in, so logs can say where
+// files went.
+func (b *DiskBlobStore) String() string {
+	return b.dir
+}
+
+func (b *DiskBlobStore) path(id string) string {
+	return filepath.Join(b.dir, id)
+}
+
+func (b *DiskBlobStore) Write(r io.Reader) (string, int64, []byte, error) {
+	id, err := SecureRandSeq(32)
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Join(b.dir, "tmp"), id)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), r)
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		return "", 0, nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", 0, nil, err
+	}
+
+	if err := os.Rename(tmp.Name(), b.path(id)); err != nil {
+		return "", 0, nil, err
+	}
+
+	return id, size, hash.Sum(nil), nil
+}
+
+func (b *DiskBlobStore) Open(id string) (io.ReadSeekCloser, error) {
+	return os.Open(b.path(id))
+}
+
+func (b *DiskBlobStore) Remove(id string) error {
+	err := os.Remove(b.path(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// MemoryBlobStore keeps blobs in memory. It is meant to go with the memory
+// backend, for tests.
+type MemoryBlobStore struct {
+	lock  sync.RWMutex
+	blobs map[string][]byte
+}
+
+func NewMemoryBlobStore() *MemoryBlobStore {
+	return &MemoryBlobStore{
+		blobs: map[string][]byte{},
+	}
+}
+
+func (b *MemoryBlobStore) String() string {
+	return "memory"
+}
+
+func (b *MemoryBlobStore) Write(r io.Reader) (string, int64, []byte, error) {
+	id, err := SecureRandSeq(32)
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	hash := sha256.Sum256(data)
+
+	b.lock.Lock()
+	b.blobs[id] = data
+	b.lock.Unlock()
+
+	return id, int64(len(data)), hash[:], nil
+}
+
+type memoryBlob struct {
+	*bytes.Reader
+}
+
+func (memoryBlob) Close() error {
+	return nil
+}
+
+func (b *MemoryBlobStore) Open(id string) (io.ReadSeekCloser, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	data, ok := b.blobs[id]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	return memoryBlob{bytes.NewReader(data)}, nil
+}
+
+func (b *MemoryBlobStore) Remove(id string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	delete(b.blobs, id)
+	return nil
+}
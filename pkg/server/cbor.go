@@ -0,0 +1,176 @@
+package server
+
+import (
+	"errors"
+	"math"
+)
+
+// WebAuthn encodes attestation objects and public keys as CBOR (RFC 8949). Only
+// the parts of it authenticators use are decoded: integers, byte and text
+// strings, arrays, maps, tags, simple values and floats, all of definite
+// length. Values decode to int64, []byte, string, []interface{},
+// map[interface{}]interface{}, bool, float64 or nil.
+
+const cborMaxDepth = 16
+
+var ErrInvalidCbor = errors.New("invalid cbor")
+
+// decodeCbor decodes the first value in data, and returns what comes after it.
+func decodeCbor(data []byte) (interface{}, []byte, error) {
+	return decodeCborValue(data, 0)
+}
+
+// cborHead reads the major type and argument a value starts with.
+func cborHead(data []byte) (byte, uint64, []byte, error) {
+	if len(data) < 1 {
+		return 0, 0, nil, ErrInvalidCbor
+	}
+
+	major := data[0] >> 5
+	info := data[0] & 0x1f
+	data = data[1:]
+
+	var size int
+	switch {
+	case info < 24:
+		return major, uint64(info), data, nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		// indefinite lengths aren't used by authenticators
+		return 0, 0, nil, ErrInvalidCbor
+	}
+
+	if len(data) < size {
+		return 0, 0, nil, ErrInvalidCbor
+	}
+
+	var arg uint64
+	for _, b := range data[:size] {
+		arg = arg<<8 | uint64(b)
+	}
+
+	return major, arg, data[size:], nil
+}
+
+func decodeCborValue(data []byte, depth int) (interface{}, []byte, error) {
+	if depth > cborMaxDepth {
+		return nil, nil, ErrInvalidCbor
+	}
+
+	initial := byte(0)
+	if len(data) > 0 {
+		initial = data[0]
+	}
+
+	major, arg, rest, err := cborHead(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, nil, ErrInvalidCbor
+		}
+		return int64(arg), rest, nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, nil, ErrInvalidCbor
+		}
+		return -1 - int64(arg), rest, nil
+	case 2, 3:
+		if arg > uint64(len(rest)) {
+			return nil, nil, ErrInvalidCbor
+		}
+		value := rest[:arg]
+		if major == 3 {
+			return string(value), rest[arg:], nil
+		}
+		return append([]byte(nil), value...), rest[arg:], nil
+	case 4:
+		// every item takes at least a byte
+		if arg > uint64(len(rest)) {
+			return nil, nil, ErrInvalidCbor
+		}
+		res := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			var item interface{}
+			item, rest, err = decodeCborValue(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			res = append(res, item)
+		}
+		return res, rest, nil
+	case 5:
+		if arg > uint64(len(rest)) {
+			return nil, nil, ErrInvalidCbor
+		}
+		res := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			var key, value interface{}
+			key, rest, err = decodeCborValue(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, ErrInvalidCbor
+			}
+			value, rest, err = decodeCborValue(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			res[key] = value
+		}
+		return res, rest, nil
+	case 6:
+		// tags don't change how anything webauthn uses is read
+		return decodeCborValue(rest, depth+1)
+	default:
+		switch initial & 0x1f {
+		case 20:
+			return false, rest, nil
+		case 21:
+			return true, rest, nil
+		case 22, 23:
+			return nil, rest, nil
+		case 25:
+			return float64(halfFloat(uint16(arg))), rest, nil
+		case 26:
+			return float64(math.Float32frombits(uint32(arg))), rest, nil
+		case 27:
+			return math.Float64frombits(arg), rest, nil
+		}
+		return nil, nil, ErrInvalidCbor
+	}
+}
+
+// halfFloat converts an IEEE 754 half precision float.
+func halfFloat(bits uint16) float32 {
+	sign := uint32(bits>>15) << 31
+	exp := uint32(bits>>10) & 0x1f
+	frac := uint32(bits) & 0x3ff
+
+	switch exp {
+	case 0:
+		// subnormal, or zero
+		f := float32(frac) / (1 << 24)
+		if sign != 0 {
+			f = -f
+		}
+		return f
+	case 0x1f:
+		return math.Float32frombits(sign | 0xff<<23 | frac<<13)
+	default:
+		return math.Float32frombits(sign | (exp+127-15)<<23 | frac<<13)
+	}
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	url2 "net/url"
+	"strings"
+
+	"github.com/gorilla/sessions"
+)
+
+// Every request that changes something has to prove it was made by a page of
+// short itself, so other sites can't make a logged in user do things. Pages
+// get a token that is kept in the session, which forms send back in a hidden
+// field and scripts in a header. Requests from browsers also have to come from
+// the base url, according to their Origin or Referer.
+
+const csrfField = "csrf"
+const csrfHeader = "X-CSRF-Token"
+const csrfTokenLength = 43
+
+var ErrCSRF = errors.New("couldn't verify that the request came from this site, reload the page and try again")
+
+// csrfToken returns the token of session, and makes one when it doesn't have
+// one yet. The session has to be saved afterwards.
+func csrfToken(session *sessions.Session) (string, error) {
+	if token, ok := session.Values[sessionCSRFValue].(string); ok && token != "" {
+		return token, nil
+	}
+
+	token, err := SecureRandSeq(csrfTokenLength)
+	if err != nil {
+		return "", err
+	}
+	session.Values[sessionCSRFValue] = token
+
+	return token, nil
+}
+
+// CSRFProtection checks the requests that change something.
+type CSRFProtection struct {
+	sessionStore *sessions.CookieStore
+	scheme       string
+	host         string
+}
+
+// NewCSRFProtection protects requests to base. When base has no scheme, only
+// the host requests come from is checked.
+func NewCSRFProtection(sessionStore *sessions.CookieStore, base string) (*CSRFProtection, error) {
+	c := &CSRFProtection{
+		sessionStore: sessionStore,
+	}
+
+	if !strings.Contains(base, "://") {
+		c.host = strings.TrimSuffix(base, "/")
+		return c, nil
+	}
+
+	u, err := url2.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	c.scheme = u.Scheme
+	c.host = u.Host
+
+	return c, nil
+}
+
+func (c *CSRFProtection) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		api := strings.HasPrefix(r.URL.Path, "/__API__/v1/")
+		if api && r.Header.Get("Authorization") != "" {
+			// api tokens can't be sent along by another site, there
+			// is no cookie to trust
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		err := c.check(r)
+		if err == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err != ErrCSRF {
+			log.Printf("%v", err)
+		}
+		log.Printf("rejected %s %s: invalid csrf token or origin %q", r.Method, r.URL.Path, r.Header.Get("Origin"))
+
+		if api {
+			writeApiError(w, http.StatusForbidden, ErrCSRF.Error())
+			return
+		}
+
+		session, err := c.sessionStore.Get(r, sessionName)
+		if err != nil {
+			log.Printf("%v", err)
+			// continue, we may not be able to get it, but we can set it
+		}
+		session.AddFlash(ErrCSRF.Error(), sessionMessageValue)
+		_ = c.sessionStore.Save(r, w, session)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	})
+}
+
+func (c *CSRFProtection) check(r *http.Request) error {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if !c.sameOrigin(origin) {
+			return ErrCSRF
+		}
+	} else if referer := r.Header.Get("Referer"); referer != "" {
+		if !c.sameOrigin(referer) {
+			return ErrCSRF
+		}
+	}
+
+	session, err := c.sessionStore.Get(r, sessionName)
+	if err != nil {
+		return ErrCSRF
+	}
+	expected, ok := session.Values[sessionCSRFValue].(string)
+	if !ok || expected == "" {
+		return ErrCSRF
+	}
+
+	token, err := requestCSRFToken(r)
+	if err != nil {
+		return err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+		return ErrCSRF
+	}
+
+	return nil
+}
+
+func (c *CSRFProtection) sameOrigin(value string) bool {
+	u, err := url2.Parse(value)
+	if err != nil {
+		return false
+	}
+
+	return u.Host == c.host && (c.scheme == "" || u.Scheme == c.scheme)
+}
+
+// requestCSRFToken returns the token sent with r, in the header or in the form.
+func requestCSRFToken(r *http.Request) (string, error) {
+	if token := r.Header.Get(csrfHeader); token != "" {
+		return token, nil
+	}
+
+	contentType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch contentType {
+	case "application/x-www-form-urlencoded":
+		return r.PostFormValue(csrfField), nil
+	case "multipart/form-data":
+		return multipartCSRFToken(r, params["boundary"])
+	default:
+		return "", nil
+	}
+}
+
+// multipartCSRFToken reads the token from the first part of a multipart form,
+// where forms with files have to put it. What is read is put back in front of
+// the body, so the handler can still stream the files in the form.
+func multipartCSRFToken(r *http.Request, boundary string) (string, error) {
+	if boundary == "" {
+		return "", nil
+	}
+
+	// the multipart reader reads ahead, everything it gets has to be kept
+	var read bytes.Buffer
+	body := r.Body
+	defer func() {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(&read, body), body}
+	}()
+
+	part, err := multipart.NewReader(io.TeeReader(body, &read), boundary).NextPart()
+	if err != nil || part.FormName() != csrfField {
+		return "", nil
+	}
+
+	token, err := ioutil.ReadAll(io.LimitReader(part, csrfTokenLength+1))
+	if err != nil {
+		return "", err
+	}
+
+	return string(token), nil
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+const sweepInterval = time.Minute
+
+// Aliases that expire are kept in an index with a key for every one of them,
+// expires_<unix time>:<alias>. The time is padded, so the keys are in the
+// order the aliases expire, and the sweeper only has to look at the ones up to
+// now instead of at every alias.
+const expiresPrefix = "expires_"
+
+func expiresKey(expires time.Time, alias string) []byte {
+	unix := expires.Unix()
+	if unix < 0 {
+		unix = 0
+	}
+
+	return prefix(expiresPrefix, fmt.Sprintf("%020d:%s", unix, alias))
+}
+
+// addAliasExpiry adds alias to the expiry index as part of txn, when it
+// expires.
+func addAliasExpiry(txn kvTxn, alias Alias) error {
+	if alias.Expires == nil {
+		return nil
+	}
+
+	return txn.Set(expiresKey(*alias.Expires, alias.Alias), []byte{})
+}
+
+// rmAliasExpiry removes alias from the expiry index as part of txn.
+func rmAliasExpiry(txn kvTxn, alias Alias) error {
+	if alias.Expires == nil {
+		return nil
+	}
+
+	return txn.Delete(expiresKey(*alias.Expires, alias.Alias))
+}
+
+// GetExpiredAliases returns the aliases that expired before now, in the order
+// they expired.
+func (s kvStore) GetExpiredAliases(now time.Time) ([]Alias, error) {
+	var res []Alias
+	return res, s.db.View(func(txn kvTxn) error {
+		// the keys of aliases that expire within the second of now come
+		// before this one as well, Expired sorts those out
+		end := string(expiresKey(now.Add(time.Second), ""))
+
+		var names []string
+		err := txn.Iterate([]byte(expiresPrefix), func(key []byte, value func() ([]byte, error)) error {
+			if string(key) >= end {
+				return errStopIteration
+			}
+
+			rest := string(key[len(expiresPrefix):])
+			if i := strings.IndexByte(rest, ':'); i >= 0 {
+				names = append(names, rest[i+1:])
+			}
+			return nil
+		})
+		if err != nil && err != errStopIteration {
+			return err
+		}
+
+		for _, name := range names {
+			var alias Alias
+			err := getJson(txn, prefix(aliasPrefix, name), &alias)
+			if err == ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			if alias.Expired(now) {
+				res = append(res, alias)
+			}
+		}
+
+		return nil
+	})
+}
+
+// The format used by datetime-local inputs.
+const datetimeLocalFormat = "2006-01-02T15:04"
+
+// parseExpiry parses the value of a datetime-local input. An empty value means
+// the alias doesn't expire.
+func parseExpiry(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	t, err := time.ParseInLocation(datetimeLocalFormat, value, time.Local)
+	if err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+// SweepExpiredAliases removes all aliases that expired before now, together
+// with their files, and returns how many were removed. An alias that can't be
+// removed doesn't stop the others from being removed, the errors are logged
+// and returned together at the end.
+//
+// Badger can expire entries by itself, but then only the alias key would be
+// gone, leaving its file and the entry in the owner's alias list behind. So
+// aliases are removed through RmAlias instead.
+func SweepExpiredAliases(store Store, now time.Time) (int, error) {
+	aliases, err := store.GetExpiredAliases(now)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	var failed []string
+	for i := range aliases {
+		if err := store.RmAlias(&aliases[i]); err != nil {
+			log.Printf("failed to remove expired alias %s: %v", aliases[i].Alias, err)
+			failed = append(failed, fmt.Sprintf("%s: %v", aliases[i].Alias, err))
+			continue
+		}
+		removed += 1
+	}
+
+	if len(failed) > 0 {
+		return removed, fmt.Errorf("couldn't remove %d expired aliases (%s)", len(failed), strings.Join(failed, "; "))
+	}
+
+	return removed, nil
+}
+
+// StartSweeper periodically removes expired aliases and sessions until the
+// returned function is called.
+func StartSweeper(store Store, interval time.Duration) func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				removed, err := SweepExpiredAliases(store, now)
+				if err != nil {
+					log.Printf("failed to remove expired aliases: %v", err)
+				}
+				if removed > 0 {
+					log.Printf("removed %d expired aliases", removed)
+				}
+
+				removed, err = store.RmExpiredSessions(now)
+				if err != nil {
+					log.Printf("failed to remove expired sessions: %v", err)
+				}
+				if removed > 0 {
+					log.Printf("removed %d expired sessions", removed)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+	}
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An export of a user is a zip archive, which unlike a backup is meant to be
+// opened by people, with these entries:
+//
+//	README.txt             what is in the export
+//	user.json              the account and its api tokens
+//	aliases.json           the aliases of the user with their metadata
+//	files/<alias>/<name>   the uploaded files, under their original names
+//	clicks/<alias>.csv     the clicks on every alias that has any
+//
+// Password hashes, of both the user and protected aliases, and token hashes
+// are left out.
+
+const exportReadme = `This archive holds everything %s owned, as it was on %s.
+
+user.json             the account and its api tokens
+aliases.json          the aliases with their metadata, file_path is where the
+                      uploaded file of an alias is in this archive
+files/<alias>/<name>  the uploaded files, under their original names
+clicks/<alias>.csv    every time an alias was used
+`
+
+type exportUser struct {
+	Name    string     `json:"name"`
+	Admin   bool       `json:"admin"`
+	Tokens  []apiToken `json:"tokens"`
+	Aliases []string   `json:"aliases"`
+}
+
+type exportAlias struct {
+	apiAlias
+	// FilePath is where the file of the alias is in the export.
+	FilePath string `json:"file_path,omitempty"`
+	Clicks   int    `json:"clicks"`
+}
+
+// ExportFilename is the name an export of user is downloaded as.
+func ExportFilename(user string, now time.Time) string {
+	return fmt.Sprintf("short-export-%s-%s.zip", exportName(user), now.Format("20060102-150405"))
+}
+
+// exportName makes name safe to use as the name of a file in an archive.
+func exportName(name string) string {
+	name = strings.Map(func(c rune) rune {
+		switch c {
+		case '/', '\\', ':', 0:
+			return '_'
+		}
+		return c
+	}, name)
+
+	if name == "" || name == "." || name == ".." {
+		return "_"
+	}
+
+	return name
+}
+
+func createExportEntry(zw *zip.Writer, name string, modified time.Time) (io.Writer, error) {
+	return zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: modified,
+	})
+}
+
+func writeExportJson(zw *zip.Writer, name string, now time.Time, v interface{}) error {
+	w, err := createExportEntry(zw, name, now)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// ExportUser writes an export of everything user owns to w.
+func ExportUser(store Store, name string, w io.Writer) error {
+	user, err := store.GetUser(name)
+	if err != nil {
+		return fmt.Errorf("user %s: %w", name, err)
+	}
+
+	aliases, err := store.GetUserAliases(&user)
+	if err != nil {
+		return err
+	}
+
+	tokens, err := store.GetUserTokens(name)
+	if err != nil {
+		return err
+	}
+
+	zw := zip.NewWriter(w)
+	now := time.Now()
+
+	readme, err := createExportEntry(zw, "README.txt", now)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(readme, exportReadme, user.Name, now.Format("2006-01-02 15:04"))
+	if err != nil {
+		return err
+	}
+
+	u := exportUser{
+		Name:    user.Name,
+		Admin:   user.Admin,
+		Tokens:  make([]apiToken, 0, len(tokens)),
+		Aliases: make([]string, 0, len(aliases)),
+	}
+	for _, token := range tokens {
+		u.Tokens = append(u.Tokens, newApiToken(token))
+	}
+	for _, alias := range aliases {
+		u.Aliases = append(u.Aliases, alias.Alias)
+	}
+	if err := writeExportJson(zw, "user.json", now, u); err != nil {
+		return err
+	}
+
+	res := make([]exportAlias, 0, len(aliases))
+	for _, alias := range aliases {
+		entry := exportAlias{apiAlias: newApiAlias(alias)}
+
+		if alias.File != "" {
+			entry.FilePath, err = exportFile(store, zw, alias)
+			if err != nil {
+				return err
+			}
+		}
+
+		entry.Clicks, err = exportClicks(store, zw, alias.Alias, now)
+		if err != nil {
+			return err
+		}
+
+		res = append(res, entry)
+	}
+	if err := writeExportJson(zw, "aliases.json", now, res); err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+// exportFile adds the file of alias to the export and returns where it was put,
+// or nothing when the file is gone, for example because the alias was used up.
+func exportFile(store Store, zw *zip.Writer, alias Alias) (string, error) {
+	file, data, err := store.OpenFile(alias.File)
+	if err == ErrNotFound || os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer data.Close()
+
+	path := fmt.Sprintf("files/%s/%s", alias.Alias, exportName(filename(alias.File)))
+	w, err := createExportEntry(zw, path, file.Created)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(w, data)
+	return path, err
+}
+
+// exportClicks adds the clicks on alias to the export and returns how many
+// there were.
+func exportClicks(store Store, zw *zip.Writer, alias string, now time.Time) (int, error) {
+	clicks, err := store.GetAliasClicks(alias)
+	if err != nil || len(clicks) == 0 {
+		return 0, err
+	}
+
+	w, err := createExportEntry(zw, fmt.Sprintf("clicks/%s.csv", alias), now)
+	if err != nil {
+		return 0, err
+	}
+
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"time", "referrer", "agent", "authorized"})
+	for _, click := range clicks {
+		_ = cw.Write([]string{
+			click.Time.Format(time.RFC3339),
+			click.Referrer,
+			click.Agent,
+			strconv.FormatBool(click.Authorized),
+		})
+	}
+	cw.Flush()
+
+	return len(clicks), cw.Error()
+}
@@ -0,0 +1,699 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// The formats links can be imported from.
+const (
+	// ImportYourlsSql is a dump of the url table of YOURLS, as made by
+	// mysqldump or phpMyAdmin.
+	ImportYourlsSql = "yourls-sql"
+	// ImportYourlsCsv is a csv export of YOURLS, with at least a keyword and
+	// a url column.
+	ImportYourlsCsv = "yourls-csv"
+	// ImportBitly is the csv export of the links of a Bitly account.
+	ImportBitly = "bitly"
+	// ImportKutt is the json of the links endpoint of the Kutt api, either
+	// the whole response or just the list of links in it.
+	ImportKutt = "kutt"
+	// ImportCsv is a csv file with the columns alias, url and owner, where
+	// the owner can be left out. A first line with those names is skipped.
+	ImportCsv = "csv"
+)
+
+// What happens when an imported alias is already taken.
+const (
+	ConflictSkip      = "skip"
+	ConflictOverwrite = "overwrite"
+	// ConflictRename imports the link under the first free name made by
+	// adding -2, -3 and so on to its alias.
+	ConflictRename = "rename"
+)
+
+// What happened to an imported link. A dry run reports what would have
+// happened.
+const (
+	ImportCreated     = "created"
+	ImportOverwritten = "overwritten"
+	ImportRenamed     = "renamed"
+	ImportSkipped     = "skipped"
+	ImportFailed      = "failed"
+)
+
+// A rename gives up after trying this many names.
+const maxImportRenames = 1000
+
+var ErrInvalidImport = errors.New("invalid import")
+
+// importedLink is a link as it was read from an export.
+type importedLink struct {
+	Alias string
+	Url   string
+	// Owner is the name of the owner in the shortener the link came from,
+	// when the export has one.
+	Owner string
+}
+
+var importFormats = map[string]func(r io.Reader) ([]importedLink, error){
+	ImportYourlsSql: parseYourlsSql,
+	ImportYourlsCsv: parseYourlsCsv,
+	ImportBitly:     parseBitly,
+	ImportKutt:      parseKutt,
+	ImportCsv:       parsePlainCsv,
+}
+
+type ImportOptions struct {
+	// Format is one of ImportYourlsSql, ImportYourlsCsv, ImportBitly,
+	// ImportKutt or ImportCsv.
+	Format string
+	// Conflict is one of ConflictSkip, ConflictOverwrite or ConflictRename.
+	Conflict string
+	// DryRun reports what would be imported without changing anything.
+	DryRun bool
+	// Owners maps owners in the export to users here. Owners that aren't in
+	// it are kept as they are.
+	Owners map[string]string
+	// DefaultOwner owns the links that have no owner in the export.
+	DefaultOwner string
+}
+
+// ImportEntry describes what happened to a single link.
+type ImportEntry struct {
+	// Row is the position of the link in the export, starting at 1.
+	Row int
+	// Original is the alias in the export, Alias the one it was imported
+	// as. They only differ when it was renamed.
+	Original string
+	Alias    string
+	Url      string
+	Owner    string
+	// Action is one of ImportCreated, ImportOverwritten, ImportRenamed,
+	// ImportSkipped or ImportFailed.
+	Action string
+	// Reason says why a link was skipped or failed.
+	Reason string
+}
+
+type ImportReport struct {
+	DryRun  bool
+	Entries []ImportEntry
+}
+
+// Count returns the number of links action happened to.
+func (r ImportReport) Count(action string) int {
+	res := 0
+	for _, entry := range r.Entries {
+		if entry.Action == action {
+			res += 1
+		}
+	}
+
+	return res
+}
+
+// String summarizes the report in a single line.
+func (r ImportReport) String() string {
+	var parts []string
+	for _, action := range []string{ImportCreated, ImportOverwritten, ImportRenamed, ImportSkipped, ImportFailed} {
+		parts = append(parts, fmt.Sprintf("%d %s", r.Count(action), action))
+	}
+
+	res := fmt.Sprintf("%d links: %s", len(r.Entries), strings.Join(parts, ", "))
+	if r.DryRun {
+		res += " (dry run, nothing was changed)"
+	}
+
+	return res
+}
+
+// Import creates aliases for the links in an export of another shortener. The
+// aliases are created through store with the same checks as aliases made in
+// the ui. Links that can't be imported, like ones with an invalid alias or url
+// or an owner that doesn't exist, are reported and skipped, only errors of the
+// store itself stop the import.
+func Import(store Store, r io.Reader, options ImportOptions) (ImportReport, error) {
+	report := ImportReport{DryRun: options.DryRun}
+
+	parse, ok := importFormats[options.Format]
+	if !ok {
+		return report, fmt.Errorf("%w: unknown format %q", ErrInvalidImport, options.Format)
+	}
+
+	switch options.Conflict {
+	case ConflictSkip, ConflictOverwrite, ConflictRename:
+	default:
+		return report, fmt.Errorf("%w: unknown conflict policy %q", ErrInvalidImport, options.Conflict)
+	}
+
+	links, err := parse(r)
+	if err != nil {
+		return report, fmt.Errorf("%w: %v", ErrInvalidImport, err)
+	}
+
+	// aliases used by earlier links in the import, which haven't been
+	// created in a dry run
+	taken := map[string]bool{}
+
+	for i, link := range links {
+		entry, err := importLink(store, link, options, taken)
+		if err != nil {
+			return report, err
+		}
+
+		entry.Row = i + 1
+		report.Entries = append(report.Entries, entry)
+	}
+
+	return report, nil
+}
+
+func importLink(store Store, link importedLink, options ImportOptions, taken map[string]bool) (ImportEntry, error) {
+	entry := ImportEntry{
+		Original: link.Alias,
+		Alias:    link.Alias,
+		Url:      link.Url,
+	}
+
+	fail := func(action string, reason string) (ImportEntry, error) {
+		entry.Action = action
+		entry.Reason = reason
+		return entry, nil
+	}
+
+	owner, mapped := options.Owners[link.Owner]
+	if !mapped {
+		owner = link.Owner
+	}
+	if owner == "" {
+		owner = options.DefaultOwner
+	}
+	entry.Owner = owner
+
+	if owner == "" {
+		return fail(ImportFailed, "link has no owner and there is no default owner")
+	}
+	if _, err := store.GetUser(owner); err == ErrNotFound {
+		return fail(ImportFailed, fmt.Sprintf("owner %s doesn't exist", owner))
+	} else if err != nil {
+		return entry, err
+	}
+
+	if !IsUrl(link.Url) {
+		return fail(ImportFailed, "not a valid url")
+	}
+
+	action := ImportCreated
+	err := validateNewAlias(store, link.Alias)
+	if err == nil && taken[link.Alias] {
+		err = ErrAliasTaken
+	}
+
+	if err == ErrAliasTaken {
+		switch {
+		case taken[link.Alias]:
+			return fail(ImportSkipped, "alias appears earlier in the import")
+		case options.Conflict == ConflictSkip:
+			return fail(ImportSkipped, err.Error())
+		case options.Conflict == ConflictOverwrite:
+			action = ImportOverwritten
+			err = nil
+		case options.Conflict == ConflictRename:
+			entry.Alias, err = freeAliasName(store, link.Alias, taken)
+			if err != nil {
+				return entry, err
+			}
+			if entry.Alias == "" {
+				return fail(ImportFailed, "no free name found to rename alias to")
+			}
+			action = ImportRenamed
+		}
+	}
+	if isAliasError(err) {
+		return fail(ImportFailed, err.Error())
+	}
+	if err != nil {
+		return entry, err
+	}
+
+	taken[entry.Alias] = true
+	entry.Action = action
+	if options.DryRun {
+		return entry, nil
+	}
+
+	alias := Alias{
+		Owner: owner,
+		Url:   link.Url,
+		Alias: entry.Alias,
+	}
+
+	if action == ImportOverwritten {
+		err = store.UpdateAlias(entry.Alias, alias)
+	} else {
+		err = store.CreateAlias(alias)
+	}
+	// someone else took the alias since it was checked
+	if err == ErrAliasTaken {
+		return fail(ImportFailed, err.Error())
+	}
+
+	return entry, err
+}
+
+// freeAliasName returns the first free name of the form alias-2, alias-3 and
+// so on, or an empty string when none was found.
+func freeAliasName(store Store, alias string, taken map[string]bool) (string, error) {
+	for i := 2; i < maxImportRenames+2; i++ {
+		name := fmt.Sprintf("%s-%d", alias, i)
+		if taken[name] {
+			continue
+		}
+
+		err := validateNewAlias(store, name)
+		if err == nil {
+			return name, nil
+		}
+		if err != ErrAliasTaken {
+			return "", err
+		}
+	}
+
+	return "", nil
+}
+
+// csvColumns reads a csv file with a header. For every column that is looked
+// for, the first of the given names that is in the header is used. Names are
+// compared case-insensitively, with spaces and underscores the same. When the
+// header has none of the names, the file has no header and defaults gives the
+// positions of the columns instead, or nil when a header is required.
+func csvColumns(r io.Reader, columns [][]string, defaults []int) ([][]string, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+
+	rows, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	normalize := func(name string) string {
+		name = strings.TrimPrefix(name, "\ufeff")
+		name = strings.ToLower(strings.TrimSpace(name))
+		return strings.ReplaceAll(name, " ", "_")
+	}
+
+	header := map[string]int{}
+	for i, name := range rows[0] {
+		header[normalize(name)] = i
+	}
+
+	positions := make([]int, len(columns))
+	found := false
+	for i, names := range columns {
+		positions[i] = -1
+		for _, name := range names {
+			if p, ok := header[name]; ok {
+				positions[i] = p
+				found = true
+				break
+			}
+		}
+	}
+
+	if found {
+		rows = rows[1:]
+	} else if defaults != nil {
+		positions = defaults
+	} else {
+		return nil, fmt.Errorf("no %s column", columns[0][0])
+	}
+
+	var res [][]string
+	for _, row := range rows {
+		values := make([]string, len(positions))
+		for i, p := range positions {
+			if p >= 0 && p < len(row) {
+				values[i] = strings.TrimSpace(row[p])
+			}
+		}
+		res = append(res, values)
+	}
+
+	return res, nil
+}
+
+func parseYourlsCsv(r io.Reader) ([]importedLink, error) {
+	rows, err := csvColumns(r, [][]string{{"keyword"}, {"url"}}, []int{0, 1})
+	if err != nil {
+		return nil, err
+	}
+
+	var res []importedLink
+	for _, row := range rows {
+		res = append(res, importedLink{Alias: row[0], Url: row[1]})
+	}
+
+	return res, nil
+}
+
+func parsePlainCsv(r io.Reader) ([]importedLink, error) {
+	rows, err := csvColumns(r, [][]string{{"alias"}, {"url"}, {"owner"}}, []int{0, 1, 2})
+	if err != nil {
+		return nil, err
+	}
+
+	var res []importedLink
+	for _, row := range rows {
+		res = append(res, importedLink{Alias: row[0], Url: row[1], Owner: row[2]})
+	}
+
+	return res, nil
+}
+
+// parseBitly reads a Bitly export. Links are imported under their custom back
+// half when they have one, and under the one Bitly made up otherwise.
+func parseBitly(r io.Reader) ([]importedLink, error) {
+	rows, err := csvColumns(r, [][]string{
+		{"long_url", "long_link", "destination", "url"},
+		{"custom_bitlinks", "custom_bitlink", "custom_links", "custom_link"},
+		{"bitlink", "link", "short_link", "short_url"},
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// the last part of a link like bit.ly/abc
+	backHalf := func(link string) string {
+		link = strings.TrimRight(link, "/")
+		return link[strings.LastIndexByte(link, '/')+1:]
+	}
+
+	var res []importedLink
+	for _, row := range rows {
+		// there can be more than one custom link, the first one is used
+		custom := strings.FieldsFunc(row[1], func(c rune) bool {
+			return c == ',' || c == ';' || c == '|' || unicode.IsSpace(c)
+		})
+
+		alias := backHalf(row[2])
+		if len(custom) > 0 {
+			alias = backHalf(custom[0])
+		}
+
+		res = append(res, importedLink{Alias: alias, Url: row[0]})
+	}
+
+	return res, nil
+}
+
+type kuttLink struct {
+	Address string `json:"address"`
+	Target  string `json:"target"`
+}
+
+func parseKutt(r io.Reader) ([]importedLink, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var links []kuttLink
+	if strings.HasPrefix(strings.TrimSpace(string(data)), "[") {
+		err = json.Unmarshal(data, &links)
+	} else {
+		var response struct {
+			Data []kuttLink `json:"data"`
+		}
+		err = json.Unmarshal(data, &response)
+		links = response.Data
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var res []importedLink
+	for _, link := range links {
+		res = append(res, importedLink{Alias: link.Address, Url: link.Target})
+	}
+
+	return res, nil
+}
+
+// The columns of the url table of YOURLS, in the order of a dump without a
+// list of columns.
+var yourlsColumns = []string{"keyword", "url", "title", "timestamp", "ip", "clicks"}
+
+var sqlInsert = regexp.MustCompile(`(?i)\b(insert|replace)\s+(ignore\s+)?into\s+`)
+
+// parseYourlsSql reads the rows of the insert statements into the url table
+// (yourls_url, or whatever its prefix is) in a sql dump. Everything else in
+// the dump is ignored.
+func parseYourlsSql(r io.Reader) ([]importedLink, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []importedLink
+	s := &sqlScanner{src: string(data)}
+	for {
+		loc := sqlInsert.FindStringIndex(s.src[s.pos:])
+		if loc == nil {
+			break
+		}
+		s.pos += loc[1]
+
+		table := s.identifier()
+		columns := yourlsColumns
+		s.space()
+		if s.peek() == '(' {
+			columns = nil
+			s.pos += 1
+			for {
+				columns = append(columns, strings.ToLower(s.identifier()))
+				s.space()
+				if s.peek() != ',' {
+					break
+				}
+				s.pos += 1
+			}
+			if err := s.expect(')'); err != nil {
+				return nil, err
+			}
+		}
+
+		if !strings.HasSuffix(strings.ToLower(table), "url") {
+			continue
+		}
+
+		keyword, url := -1, -1
+		for i, column := range columns {
+			switch column {
+			case "keyword":
+				keyword = i
+			case "url":
+				url = i
+			}
+		}
+		if keyword < 0 || url < 0 {
+			return nil, fmt.Errorf("table %s has no keyword and url columns", table)
+		}
+
+		s.space()
+		if !strings.EqualFold(s.word(), "values") {
+			return nil, fmt.Errorf("expected VALUES after INSERT INTO %s", table)
+		}
+
+		for {
+			values, err := s.tuple()
+			if err != nil {
+				return nil, err
+			}
+			if len(values) != len(columns) {
+				return nil, fmt.Errorf("row with %d values in a table with %d columns", len(values), len(columns))
+			}
+			res = append(res, importedLink{Alias: values[keyword], Url: values[url]})
+
+			s.space()
+			if s.peek() != ',' {
+				break
+			}
+			s.pos += 1
+		}
+	}
+
+	return res, nil
+}
+
+// sqlScanner reads just enough sql to get the values out of insert statements.
+type sqlScanner struct {
+	src string
+	pos int
+}
+
+func (s *sqlScanner) peek() byte {
+	if s.pos >= len(s.src) {
+		return 0
+	}
+
+	return s.src[s.pos]
+}
+
+func (s *sqlScanner) space() {
+	for s.pos < len(s.src) && unicode.IsSpace(rune(s.src[s.pos])) {
+		s.pos += 1
+	}
+}
+
+func (s *sqlScanner) expect(c byte) error {
+	s.space()
+	if s.peek() != c {
+		return fmt.Errorf("expected %q at offset %d", c, s.pos)
+	}
+
+	s.pos += 1
+	return nil
+}
+
+// word reads everything up to the next space, comma or parenthesis.
+func (s *sqlScanner) word() string {
+	start := s.pos
+	for s.pos < len(s.src) && !strings.ContainsRune(" \t\r\n,();", rune(s.src[s.pos])) {
+		s.pos += 1
+	}
+
+	return s.src[start:s.pos]
+}
+
+// identifier reads a name, which can be quoted with backticks, like a table
+// name in a dump.
+func (s *sqlScanner) identifier() string {
+	s.space()
+	if s.peek() != '`' && s.peek() != '"' {
+		return s.word()
+	}
+
+	quote := s.src[s.pos]
+	end := strings.IndexByte(s.src[s.pos+1:], quote)
+	if end < 0 {
+		res := s.src[s.pos+1:]
+		s.pos = len(s.src)
+		return res
+	}
+
+	res := s.src[s.pos+1 : s.pos+1+end]
+	s.pos += end + 2
+	return res
+}
+
+// tuple reads a list of values in parentheses.
+func (s *sqlScanner) tuple() ([]string, error) {
+	if err := s.expect('('); err != nil {
+		return nil, err
+	}
+
+	var res []string
+	for {
+		value, err := s.value()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, value)
+
+		s.space()
+		switch s.peek() {
+		case ',':
+			s.pos += 1
+		case ')':
+			s.pos += 1
+			return res, nil
+		default:
+			return nil, fmt.Errorf("expected ',' or ')' at offset %d", s.pos)
+		}
+	}
+}
+
+var sqlEscapes = map[byte]string{
+	'0': "\x00",
+	'b': "\b",
+	'n': "\n",
+	'r': "\r",
+	't': "\t",
+	'Z': "\x1a",
+}
+
+// value reads a single value. Strings are unquoted, anything else, like
+// numbers and NULL, is returned as it is.
+func (s *sqlScanner) value() (string, error) {
+	s.space()
+	if s.peek() != '\'' {
+		return s.word(), nil
+	}
+	s.pos += 1
+
+	var res strings.Builder
+	for s.pos < len(s.src) {
+		c := s.src[s.pos]
+		s.pos += 1
+
+		switch {
+		case c == '\\' && s.pos < len(s.src):
+			e := s.src[s.pos]
+			s.pos += 1
+			if replacement, ok := sqlEscapes[e]; ok {
+				res.WriteString(replacement)
+			} else {
+				res.WriteByte(e)
+			}
+		case c == '\'' && s.peek() == '\'':
+			s.pos += 1
+			res.WriteByte('\'')
+		case c == '\'':
+			return res.String(), nil
+		default:
+			res.WriteByte(c)
+		}
+	}
+
+	return "", errors.New("unterminated string")
+}
+
+// ParseOwnerMapping parses mappings of owners in an export to users here, which
+// have the form old=new.
+func ParseOwnerMapping(mappings []string) (map[string]string, error) {
+	res := map[string]string{}
+	for _, mapping := range mappings {
+		i := strings.IndexByte(mapping, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("owner mapping %q isn't of the form old=new", mapping)
+		}
+
+		res[mapping[:i]] = mapping[i+1:]
+	}
+
+	return res, nil
+}
+
+// ImportFormats returns the names of the formats links can be imported from.
+func ImportFormats() []string {
+	var res []string
+	for format := range importFormats {
+		res = append(res, format)
+	}
+	sort.Strings(res)
+
+	return res
+}
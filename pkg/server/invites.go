@@ -0,0 +1,210 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const invitePrefix = "invite_"
+
+// Invite codes look like si_<id><secret>, like api tokens. Only the id is ever
+// shown again after an invite is created, the code is only stored as a hash.
+const inviteMarker = "si_"
+const inviteIdLength = 8
+const inviteSecretLength = 32
+
+// Invites expire after this long, unless they are given another expiry.
+const DefaultInviteExpiry = 7 * 24 * time.Hour
+
+var ErrInvalidInvite = errors.New("invite is invalid, expired or has already been used")
+
+// Invite lets someone create a user of their own, once. Used invites are kept,
+// so admins can see who joined with which one.
+type Invite struct {
+	Id        string
+	Hash      []byte
+	CreatedBy string
+	// Note says who the invite is for.
+	Note string
+	// Admin makes the user created with the invite an admin.
+	Admin   bool
+	Created time.Time
+	Expires time.Time
+	Used    *time.Time
+	UsedBy  string
+}
+
+// Prefix is the part of the code that can be shown to identify the invite.
+func (i Invite) Prefix() string {
+	return inviteMarker + i.Id
+}
+
+func (i Invite) Expired(now time.Time) bool {
+	return now.After(i.Expires)
+}
+
+// Usable reports whether a user can still be created with the invite.
+func (i Invite) Usable(now time.Time) bool {
+	return i.Used == nil && !i.Expired(now)
+}
+
+// parseInviteId returns the id part of an invite code, without checking
+// whether the code is valid.
+func parseInviteId(code string) (string, error) {
+	if !strings.HasPrefix(code, inviteMarker) {
+		return "", ErrInvalidInvite
+	}
+	code = strings.TrimPrefix(code, inviteMarker)
+	if len(code) != inviteIdLength+inviteSecretLength {
+		return "", ErrInvalidInvite
+	}
+
+	return code[:inviteIdLength], nil
+}
+
+func (s kvStore) CreateInvite(invite Invite) error {
+	return s.db.Update(func(txn kvTxn) error {
+		return setJson(txn, prefix(invitePrefix, invite.Id), &invite)
+	})
+}
+
+func (s kvStore) GetInvite(id string) (*Invite, error) {
+	var res *Invite
+	return res, s.db.View(func(txn kvTxn) error {
+		err := getJson(txn, prefix(invitePrefix, id), &res)
+		if err == ErrNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+func (s kvStore) GetInvites() ([]Invite, error) {
+	var res []Invite
+	return res, s.db.View(func(txn kvTxn) error {
+		return iterateValues(txn, []byte(invitePrefix), func(key []byte, val []byte) error {
+			var invite Invite
+			if err := decodeJson(val, &invite); err != nil {
+				return err
+			}
+
+			res = append(res, invite)
+			return nil
+		})
+	})
+}
+
+func (s kvStore) RmInvite(id string) error {
+	return s.db.Update(func(txn kvTxn) error {
+		return txn.Delete(prefix(invitePrefix, id))
+	})
+}
+
+// AcceptInvite creates user with invite id and marks the invite as used, in a
+// single transaction, so an invite can't be used twice.
+func (s kvStore) AcceptInvite(id string, user User, now time.Time) error {
+	return s.db.Update(func(txn kvTxn) error {
+		var invite Invite
+		err := getJson(txn, prefix(invitePrefix, id), &invite)
+		if err == ErrNotFound {
+			return ErrInvalidInvite
+		}
+		if err != nil {
+			return err
+		}
+		if !invite.Usable(now) {
+			return ErrInvalidInvite
+		}
+
+		taken, err := exists(txn, prefix(userPrefix, user.Name))
+		if err != nil {
+			return err
+		}
+		if taken {
+			return ErrUserExists
+		}
+
+		invite.Used = &now
+		invite.UsedBy = user.Name
+		if err := setJson(txn, prefix(invitePrefix, invite.Id), &invite); err != nil {
+			return err
+		}
+
+		return setJson(txn, prefix(userPrefix, user.Name), &user)
+	})
+}
+
+// CreateInvite creates a new invite. The returned string is the code of the
+// invite, which can't be recovered later.
+func (lm LoginManager) CreateInvite(createdBy string, note string, admin bool, expires time.Time) (string, Invite, error) {
+	id, err := SecureRandSeq(inviteIdLength)
+	if err != nil {
+		return "", Invite{}, err
+	}
+	secret, err := SecureRandSeq(inviteSecretLength)
+	if err != nil {
+		return "", Invite{}, err
+	}
+
+	code := inviteMarker + id + secret
+	invite := Invite{
+		Id:        id,
+		Hash:      hashToken(code),
+		CreatedBy: createdBy,
+		Note:      note,
+		Admin:     admin,
+		Created:   time.Now(),
+		Expires:   expires,
+	}
+
+	return code, invite, lm.store.CreateInvite(invite)
+}
+
+// CheckInvite returns the invite with the given code, or ErrInvalidInvite when
+// no user can be created with it.
+func (lm LoginManager) CheckInvite(code string) (*Invite, error) {
+	id, err := parseInviteId(code)
+	if err != nil {
+		return nil, err
+	}
+
+	invite, err := lm.store.GetInvite(id)
+	if err != nil {
+		return nil, err
+	}
+	if invite == nil || subtle.ConstantTimeCompare(invite.Hash, hashToken(code)) != 1 {
+		return nil, ErrInvalidInvite
+	}
+	if !invite.Usable(time.Now()) {
+		return nil, ErrInvalidInvite
+	}
+
+	return invite, nil
+}
+
+// AcceptInvite creates a user with the name and password they chose using the
+// invite with the given code. Invited users don't have to be approved, even
+// when registration needs approval.
+func (lm LoginManager) AcceptInvite(code string, name string, password string) (User, error) {
+	invite, err := lm.CheckInvite(code)
+	if err != nil {
+		return User{}, err
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return User{}, err
+	}
+
+	user := User{
+		Name:     name,
+		Password: hash,
+		Admin:    invite.Admin,
+	}
+
+	return user, lm.store.AcceptInvite(invite.Id, user, time.Now())
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sync"
+)
+
+// ErrNotFound is returned when a key, or the record stored under it, doesn't
+// exist.
+var ErrNotFound = errors.New("not found")
+
+// errConflict is returned by kv.Update when the transaction conflicted with
+// another one and was not committed. Running it again may succeed.
+var errConflict = errors.New("transaction conflict")
+
+// kv is an ordered key value database with transactions. The store keeps all
+// of its records in one, so a new backend only has to implement these few
+// operations.
+type kv interface {
+	// View runs fn in a read-only transaction.
+	View(fn func(txn kvTxn) error) error
+	// Update runs fn in a read-write transaction, which is committed when fn
+	// returns nil and discarded otherwise.
+	Update(fn func(txn kvTxn) error) error
+	Close() error
+}
+
+type kvTxn interface {
+	// Get returns a copy of the value stored under key, or ErrNotFound.
+	Get(key []byte) ([]byte, error)
+	Set(key []byte, value []byte) error
+	Delete(key []byte) error
+	// Iterate calls fn in order for every key that starts with prefix. The
+	// value is only read when fn asks for it. fn must not modify the
+	// transaction, collect the keys first instead.
+	Iterate(prefix []byte, fn func(key []byte, value func() ([]byte, error)) error) error
+}
+
+// lockedKV lets something that takes more than one transaction, like a
+// restore, keep everything else from writing while it runs. Writes wait for it
+// to finish, reads don't.
+type lockedKV struct {
+	kv
+	lock *sync.RWMutex
+}
+
+func newLockedKV(db kv) lockedKV {
+	return lockedKV{
+		db,
+		&sync.RWMutex{},
+	}
+}
+
+func (l lockedKV) Update(fn func(txn kvTxn) error) error {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	return l.kv.Update(fn)
+}
+
+func getJson(txn kvTxn, key []byte, v interface{}) error {
+	val, err := txn.Get(key)
+	if err != nil {
+		return err
+	}
+
+	return json.NewDecoder(bytes.NewBuffer(val)).Decode(v)
+}
+
+func setJson(txn kvTxn, key []byte, v interface{}) error {
+	var b bytes.Buffer
+	err := json.NewEncoder(&b).Encode(v)
+	if err != nil {
+		return err
+	}
+
+	return txn.Set(key, b.Bytes())
+}
+
+// iterateValues calls fn with the key and value of every record with a key
+// that starts with prefix.
+func iterateValues(txn kvTxn, prefix []byte, fn func(key []byte, val []byte) error) error {
+	return txn.Iterate(prefix, func(key []byte, value func() ([]byte, error)) error {
+		val, err := value()
+		if err != nil {
+			return err
+		}
+
+		return fn(key, val)
+	})
+}
+
+func decodeJson(val []byte, v interface{}) error {
+	return json.NewDecoder(bytes.NewBuffer(val)).Decode(v)
+}
+
+// exists reports whether there is a value stored under key.
+func exists(txn kvTxn, key []byte) (bool, error) {
+	_, err := txn.Get(key)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
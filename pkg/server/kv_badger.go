@@ -0,0 +1,87 @@
+package server
+
+import (
+	"github.com/dgraph-io/badger"
+)
+
+type badgerKV struct {
+	db *badger.DB
+}
+
+func openBadger(location string) (*badgerKV, error) {
+	db, err := badger.Open(badger.DefaultOptions(location))
+	if err != nil {
+		return nil, err
+	}
+
+	return &badgerKV{
+		db,
+	}, nil
+}
+
+func (b *badgerKV) View(fn func(txn kvTxn) error) error {
+	return b.db.View(func(txn *badger.Txn) error {
+		return fn(badgerTxn{txn})
+	})
+}
+
+func (b *badgerKV) Update(fn func(txn kvTxn) error) error {
+	err := b.db.Update(func(txn *badger.Txn) error {
+		return fn(badgerTxn{txn})
+	})
+	if err == badger.ErrConflict {
+		return errConflict
+	}
+
+	return err
+}
+
+func (b *badgerKV) Close() error {
+	return b.db.Close()
+}
+
+type badgerTxn struct {
+	txn *badger.Txn
+}
+
+func (t badgerTxn) Get(key []byte) ([]byte, error) {
+	item, err := t.txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return item.ValueCopy(nil)
+}
+
+func (t badgerTxn) Set(key []byte, value []byte) error {
+	return t.txn.Set(key, value)
+}
+
+func (t badgerTxn) Delete(key []byte) error {
+	return t.txn.Delete(key)
+}
+
+func (t badgerTxn) Iterate(prefix []byte, fn func(key []byte, value func() ([]byte, error)) error) error {
+	opts := badger.DefaultIteratorOptions
+	// values are only read when they are asked for, so iterating over keys
+	// alone stays cheap
+	opts.PrefetchValues = false
+	opts.Prefix = prefix
+	it := t.txn.NewIterator(opts)
+	defer it.Close()
+
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		item := it.Item()
+		err := fn(item.KeyCopy(nil), func() ([]byte, error) {
+			return item.ValueCopy(nil)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"bytes"
+	bolt "go.etcd.io/bbolt"
+	"time"
+)
+
+// All records are kept in a single bucket, so keys are ordered the same way as
+// in the other backends.
+var boltBucket = []byte("short")
+
+type boltKV struct {
+	db *bolt.DB
+}
+
+func openBolt(location string) (*boltKV, error) {
+	db, err := bolt.Open(location, 0600, &bolt.Options{
+		// don't wait forever when another process has the database open
+		Timeout: time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return &boltKV{
+		db,
+	}, nil
+}
+
+func (b *boltKV) View(fn func(txn kvTxn) error) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		return fn(boltTxn{tx.Bucket(boltBucket)})
+	})
+}
+
+// Update runs fn in a read-write transaction. Bolt only allows one of those at
+// a time, so they never conflict.
+func (b *boltKV) Update(fn func(txn kvTxn) error) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return fn(boltTxn{tx.Bucket(boltBucket)})
+	})
+}
+
+func (b *boltKV) Close() error {
+	return b.db.Close()
+}
+
+type boltTxn struct {
+	bucket *bolt.Bucket
+}
+
+func copyBytes(b []byte) []byte {
+	return append([]byte{}, b...)
+}
+
+func (t boltTxn) Get(key []byte) ([]byte, error) {
+	val := t.bucket.Get(key)
+	if val == nil {
+		return nil, ErrNotFound
+	}
+
+	// values are only valid for the duration of the transaction
+	return copyBytes(val), nil
+}
+
+func (t boltTxn) Set(key []byte, value []byte) error {
+	return t.bucket.Put(key, value)
+}
+
+func (t boltTxn) Delete(key []byte) error {
+	return t.bucket.Delete(key)
+}
+
+func (t boltTxn) Iterate(prefix []byte, fn func(key []byte, value func() ([]byte, error)) error) error {
+	c := t.bucket.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		val := v
+		err := fn(copyBytes(k), func() ([]byte, error) {
+			return copyBytes(val), nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var errReadOnly = errors.New("read-only transaction")
+
+// memoryKV keeps all records in a map. Nothing is persisted, which makes it
+// useful for tests and for trying things out.
+type memoryKV struct {
+	lock sync.RWMutex
+	data map[string][]byte
+}
+
+func newMemoryKV() *memoryKV {
+	return &memoryKV{
+		data: map[string][]byte{},
+	}
+}
+
+func (m *memoryKV) View(fn func(txn kvTxn) error) error {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return fn(&memoryTxn{kv: m})
+}
+
+// Update runs fn while holding the write lock, so transactions never conflict.
+// Changes are collected in the transaction and only applied when fn succeeds.
+func (m *memoryKV) Update(fn func(txn kvTxn) error) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	txn := &memoryTxn{
+		kv:     m,
+		writes: map[string]memoryWrite{},
+	}
+	if err := fn(txn); err != nil {
+		return err
+	}
+
+	for key, w := range txn.writes {
+		if w.deleted {
+			delete(m.data, key)
+		} else {
+			m.data[key] = w.value
+		}
+	}
+
+	return nil
+}
+
+func (m *memoryKV) Close() error {
+	return nil
+}
+
+type memoryWrite struct {
+	value   []byte
+	deleted bool
+}
+
+type memoryTxn struct {
+	kv *memoryKV
+	// writes is nil in read-only transactions
+	writes map[string]memoryWrite
+}
+
+func (t *memoryTxn) get(key string) ([]byte, bool) {
+	if w, ok := t.writes[key]; ok {
+		return w.value, !w.deleted
+	}
+
+	val, ok := t.kv.data[key]
+	return val, ok
+}
+
+func (t *memoryTxn) Get(key []byte) ([]byte, error) {
+	val, ok := t.get(string(key))
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return copyBytes(val), nil
+}
+
+func (t *memoryTxn) Set(key []byte, value []byte) error {
+	if t.writes == nil {
+		return errReadOnly
+	}
+
+	t.writes[string(key)] = memoryWrite{value: copyBytes(value)}
+	return nil
+}
+
+func (t *memoryTxn) Delete(key []byte) error {
+	if t.writes == nil {
+		return errReadOnly
+	}
+
+	t.writes[string(key)] = memoryWrite{deleted: true}
+	return nil
+}
+
+func (t *memoryTxn) Iterate(prefix []byte, fn func(key []byte, value func() ([]byte, error)) error) error {
+	p := string(prefix)
+
+	var keys []string
+	for key := range t.kv.data {
+		if _, ok := t.writes[key]; !ok && strings.HasPrefix(key, p) {
+			keys = append(keys, key)
+		}
+	}
+	for key, w := range t.writes {
+		if !w.deleted && strings.HasPrefix(key, p) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		key := key
+		err := fn([]byte(key), func() ([]byte, error) {
+			return t.Get([]byte(key))
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
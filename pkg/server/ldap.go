@@ -0,0 +1,213 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// Users can log in with their LDAP or Active Directory password when a server
+// is configured. Local user records are created for them on their first login,
+// so they can own aliases like everyone else.
+
+const ldapSource = "ldap"
+const ldapTimeout = 10 * time.Second
+
+var ErrLDAPMultipleUsers = errors.New("ldap search found more than one user")
+
+type LDAPConfig struct {
+	// Url is like ldap://host:389 or ldaps://host:636.
+	Url string
+	// StartTLS upgrades ldap:// connections to tls.
+	StartTLS bool
+	// BindDN and BindPassword are the account users are searched with.
+	// Without them, the search is anonymous.
+	BindDN       string
+	BindPassword string
+	// BaseDN is where users are searched.
+	BaseDN string
+	// UserFilter finds a user by the name they log in with, which replaces
+	// %s. The default is (uid=%s), use (sAMAccountName=%s) for Active
+	// Directory.
+	UserFilter string
+	// UsernameAttribute is what users are called in short. The default is
+	// uid.
+	UsernameAttribute string
+	// EmailAttribute is the email address of users. The default is mail.
+	EmailAttribute string
+	// AdminGroup is the dn of the group of admins. When it's empty, admins
+	// are only made in short itself.
+	AdminGroup string
+	// LinkUsers lets ldap users take over local users with the same name.
+	LinkUsers bool
+}
+
+// LDAPConfigFromEnv reads the LDAP_* environment variables. It returns nil when
+// LDAP_URL isn't set.
+func LDAPConfigFromEnv() *LDAPConfig {
+	url := os.Getenv("LDAP_URL")
+	if url == "" {
+		return nil
+	}
+
+	config := &LDAPConfig{
+		Url:               url,
+		StartTLS:          os.Getenv("LDAP_START_TLS") == "true",
+		BindDN:            os.Getenv("LDAP_BIND_DN"),
+		BindPassword:      os.Getenv("LDAP_BIND_PASSWORD"),
+		BaseDN:            os.Getenv("LDAP_BASE_DN"),
+		UserFilter:        os.Getenv("LDAP_USER_FILTER"),
+		UsernameAttribute: os.Getenv("LDAP_USERNAME_ATTRIBUTE"),
+		EmailAttribute:    os.Getenv("LDAP_EMAIL_ATTRIBUTE"),
+		AdminGroup:        os.Getenv("LDAP_ADMIN_GROUP"),
+		LinkUsers:         os.Getenv("LDAP_LINK_USERS") == "true",
+	}
+	if config.UserFilter == "" {
+		config.UserFilter = "(uid=%s)"
+	}
+	if config.UsernameAttribute == "" {
+		config.UsernameAttribute = "uid"
+	}
+	if config.EmailAttribute == "" {
+		config.EmailAttribute = "mail"
+	}
+
+	return config
+}
+
+// LDAPAuthenticator checks passwords by binding as the user.
+type LDAPAuthenticator struct {
+	config LDAPConfig
+}
+
+func NewLDAPAuthenticator(config LDAPConfig) LDAPAuthenticator {
+	return LDAPAuthenticator{config}
+}
+
+func (a LDAPAuthenticator) connect() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(a.config.Url, ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}))
+	if err != nil {
+		return nil, fmt.Errorf("ldap: %w", err)
+	}
+	conn.SetTimeout(ldapTimeout)
+
+	if a.config.StartTLS {
+		host := strings.TrimPrefix(strings.TrimPrefix(a.config.Url, "ldap://"), "ldaps://")
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if err := conn.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("ldap: %w", err)
+		}
+	}
+
+	if err := a.bindSearcher(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (a LDAPAuthenticator) bindSearcher(conn *ldap.Conn) error {
+	var err error
+	if a.config.BindDN == "" {
+		err = conn.UnauthenticatedBind("")
+	} else {
+		err = conn.Bind(a.config.BindDN, a.config.BindPassword)
+	}
+	if err != nil {
+		return fmt.Errorf("ldap bind as %s: %w", a.config.BindDN, err)
+	}
+
+	return nil
+}
+
+func (a LDAPAuthenticator) Authenticate(name string, password string) (Identity, error) {
+	// binding without a password always succeeds on some servers
+	if password == "" {
+		return Identity{}, ErrInvalidPassword
+	}
+
+	conn, err := a.connect()
+	if err != nil {
+		return Identity{}, err
+	}
+	defer conn.Close()
+
+	attributes := []string{"dn", a.config.UsernameAttribute, a.config.EmailAttribute}
+	res, err := conn.Search(ldap.NewSearchRequest(
+		a.config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(ldapTimeout.Seconds()), false,
+		strings.Replace(a.config.UserFilter, "%s", ldap.EscapeFilter(name), -1),
+		attributes, nil,
+	))
+	if err != nil {
+		return Identity{}, fmt.Errorf("ldap search: %w", err)
+	}
+	if len(res.Entries) == 0 {
+		return Identity{}, ErrNotFound
+	}
+	if len(res.Entries) > 1 {
+		return Identity{}, ErrLDAPMultipleUsers
+	}
+	entry := res.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return Identity{}, ErrInvalidPassword
+		}
+		return Identity{}, fmt.Errorf("ldap bind as %s: %w", entry.DN, err)
+	}
+
+	identity := Identity{
+		Name:   entry.GetAttributeValue(a.config.UsernameAttribute),
+		Email:  entry.GetAttributeValue(a.config.EmailAttribute),
+		Source: ldapSource,
+		Link:   a.config.LinkUsers,
+	}
+	if identity.Name == "" {
+		identity.Name = name
+	}
+
+	if a.config.AdminGroup != "" {
+		// the user may not be allowed to read groups
+		if err := a.bindSearcher(conn); err != nil {
+			return Identity{}, err
+		}
+
+		admin, err := a.inGroup(conn, a.config.AdminGroup, entry.DN, identity.Name)
+		if err != nil {
+			return Identity{}, err
+		}
+		identity.Admin = &admin
+	}
+
+	return identity, nil
+}
+
+// inGroup reports whether the user with dn is a member of group, which can be a
+// groupOfNames, groupOfUniqueNames, posixGroup or Active Directory group.
+func (a LDAPAuthenticator) inGroup(conn *ldap.Conn, group string, dn string, name string) (bool, error) {
+	filter := fmt.Sprintf("(|(member=%s)(uniqueMember=%s)(memberUid=%s))",
+		ldap.EscapeFilter(dn), ldap.EscapeFilter(dn), ldap.EscapeFilter(name))
+
+	res, err := conn.Search(ldap.NewSearchRequest(
+		group, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, int(ldapTimeout.Seconds()), false,
+		filter, []string{"dn"}, nil,
+	))
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("ldap group search: %w", err)
+	}
+
+	return len(res.Entries) > 0, nil
+}
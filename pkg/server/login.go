@@ -1,35 +1,58 @@
 package server
 
 import (
-	"github.com/dgraph-io/badger"
 	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
 	"log"
 )
 
 type LoginManager struct {
-	store *Store
+	store Store
+	// authenticators check passwords, in order.
+	authenticators []Authenticator
 }
 
-func NewLoginManager(store *Store) (*LoginManager, error) {
+// NewLoginManager makes a LoginManager that checks passwords with
+// authenticators, or against the store when there are none. When the store has
+// no users yet, an admin is made, whose password is written to passwordFile.
+// It should be removed after logging in.
+func NewLoginManager(store Store, passwordFile string, authenticators ...Authenticator) (*LoginManager, error) {
 	count, err := store.CountUsers()
 	if err != nil {
 		return nil, err
 	}
+	if len(authenticators) == 0 {
+		authenticators = []Authenticator{NewLocalAuthenticator(store)}
+	}
 	res := &LoginManager{
 		store,
+		authenticators,
 	}
 
 	if count == 0 {
+		password, err := SecureRandSeq(20)
+		if err != nil {
+			return nil, err
+		}
+
+		// logs are often kept and read by others, the password isn't put
+		// in them. It is written before the user is made, so it can't get
+		// lost.
+		err = ioutil.WriteFile(passwordFile, []byte(password+"\n"), 0600)
+		if err != nil {
+			return nil, err
+		}
+
 		u := User{
 			Name: "admin",
-			Password: []byte(RandSeq(20)),
+			Password: []byte(password),
 			Admin: true,
 		}
-		_, err := res.CreateUser(u)
+		_, err = res.CreateUser(u)
 		if err != nil {
 			return nil, err
 		}
-		log.Printf("created new user with name %s and password %s", u.Name, string(u.Password))
+		log.Printf("created new user with name %s, its password is in %s", u.Name, passwordFile)
 	}
 
 	return res, nil
@@ -37,16 +60,23 @@ func NewLoginManager(store *Store) (*LoginManager, error) {
 
 type SessionUser struct {
 	Name string
+	// Session is the id of the session record of the login.
+	Session string
 }
 
 func (lm LoginManager) LogIn(lu User) (SessionUser, error) {
-	user, err := lm.store.GetUser(lu.Name)
+	user, err := lm.authenticate(lu.Name, string(lu.Password))
 	if err != nil {
 		return SessionUser{}, err
 	}
 
-	if err := bcrypt.CompareHashAndPassword(user.Password, lu.Password); err != nil {
-		return SessionUser{}, err
+	if user.Pending {
+		return SessionUser{}, ErrPendingApproval
+	}
+
+	// the user only gets a session after SecondFactor
+	if user.TOTPSecret != "" {
+		return SessionUser{Name: user.Name}, ErrSecondFactorRequired
 	}
 
 	return SessionUser{
@@ -55,37 +85,63 @@ func (lm LoginManager) LogIn(lu User) (SessionUser, error) {
 }
 
 func (lm LoginManager) LoggedIn(su SessionUser) (*User, error) {
+	if err := lm.checkSession(su); err != nil {
+		return nil, err
+	}
+
 	user, err := lm.store.GetUser(su.Name)
 	if err != nil {
 		return nil, err
 	}
 
+	if user.Pending {
+		return nil, ErrPendingApproval
+	}
+
+	if err := lm.restrictAdmin(&user); err != nil {
+		return nil, err
+	}
+
 	return &user, nil
 }
 
+// CreateUser creates user with its password hashed, and reports whether the
+// name was taken instead. Checking the name and creating the user happen at
+// once, so only one of two users signing up with the same name is created.
 func (lm LoginManager) CreateUser(user User) (bool, error) {
-	_, err := lm.store.GetUser(user.Name)
-	if err != nil && err != badger.ErrKeyNotFound {
-		return false, err
-	} else if err == nil {
-		return true, nil
-	}
-
+	var err error
 	user.Password, err = bcrypt.GenerateFromPassword(user.Password, bcrypt.DefaultCost)
 	if err != nil {
 		return false, err
 	}
 
-	return false, lm.store.CreateUser(user)
+	err = lm.store.AddUser(user)
+	if err == ErrUserExists {
+		return true, nil
+	}
+
+	return false, err
 }
 
 func (lm LoginManager) ChangePassword(user User, password string) error {
-	var err error
+	// user may have been changed by LoggedIn, so only its name is used
+	user, err := lm.store.GetUser(user.Name)
+	if err != nil {
+		return err
+	}
+	if user.Source != "" {
+		return ErrExternalUser
+	}
 	user.Password, err = bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		return err
 	}
-	return lm.store.CreateUser(user)
+	if err := lm.store.CreateUser(user); err != nil {
+		return err
+	}
+
+	// whoever knew the old password is logged out
+	return lm.RevokeSessions(user.Name)
 }
 
 func (lm LoginManager) SetAdmin(name string, value bool) error {
@@ -0,0 +1,345 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// The schema version of a database is the number of migrations that have been
+// run on it. Databases from before there was a version have none, which is the
+// same as version 0.
+const schemaVersionKey = "meta_schema_version"
+
+// ErrSchemaTooNew is returned when a database was made by a newer version of
+// short, which may have changed records in ways this version doesn't know
+// about.
+var ErrSchemaTooNew = errors.New("database was made by a newer version of short")
+
+var errDryRun = errors.New("dry run")
+var errStopIteration = errors.New("stop iteration")
+
+// migration brings the records of a database from the schema version before it
+// to the next one.
+type migration struct {
+	description string
+	migrate     func(s kvStore, run *migrationRun) error
+}
+
+// Migrations in the order they are run. Only ever add to the end of this list,
+// the position of a migration is the schema version it leads to.
+var migrations = []migration{
+	{"move the contents of files into the blob store", migrateFileData},
+	{"move the aliases of users into the owner index", migrateOwnerIndex},
+	{"count the clicks of every alias", migrateClickCounts},
+	{"add the aliases that expire to the expiry index", migrateExpiryIndex},
+}
+
+// SchemaVersion is the schema version of databases made by this version.
+var SchemaVersion = len(migrations)
+
+// migrationRun is what a migration works with while it runs.
+type migrationRun struct {
+	txn    kvTxn
+	dryRun bool
+	// changes describes what the migration changed, or would have changed
+	changes []string
+	// blobs written by the migration, which are removed again when it isn't
+	// committed
+	blobs []string
+}
+
+func (r *migrationRun) change(format string, args ...interface{}) {
+	r.changes = append(r.changes, fmt.Sprintf(format, args...))
+}
+
+// MigrationReport describes a migration that was run, or would be run.
+type MigrationReport struct {
+	Version     int
+	Description string
+	Changes     []string
+}
+
+// Migrate brings the database configured in config up to date, like NewStore
+// does when a store is opened. With dryRun set, nothing is changed and the
+// report describes what would have been done.
+func Migrate(config StoreConfig, dryRun bool) ([]MigrationReport, error) {
+	s, err := openStore(config)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	return s.migrate(dryRun)
+}
+
+func getSchemaVersion(txn kvTxn) (int, error) {
+	var version int
+	err := getJson(txn, []byte(schemaVersionKey), &version)
+	if err == ErrNotFound {
+		return 0, nil
+	}
+
+	return version, err
+}
+
+// isEmpty reports whether there are no records at all.
+func isEmpty(txn kvTxn) (bool, error) {
+	empty := true
+	err := txn.Iterate(nil, func(key []byte, value func() ([]byte, error)) error {
+		empty = false
+		return errStopIteration
+	})
+	if err == errStopIteration {
+		err = nil
+	}
+
+	return empty, err
+}
+
+// migrate runs the migrations the database hasn't had yet, each in its own
+// transaction together with the update of the schema version. A dry run runs
+// all of them in a single transaction that is thrown away at the end, so later
+// migrations see what earlier ones would have done.
+func (s kvStore) migrate(dryRun bool) ([]MigrationReport, error) {
+	var version int
+	var empty bool
+	err := s.db.View(func(txn kvTxn) error {
+		var err error
+		version, err = getSchemaVersion(txn)
+		if err != nil {
+			return err
+		}
+
+		empty, err = isEmpty(txn)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if version > SchemaVersion {
+		return nil, fmt.Errorf("%w: it has schema version %d, this version only knows up to %d", ErrSchemaTooNew, version, SchemaVersion)
+	}
+
+	// a new database has nothing to migrate
+	if empty {
+		if dryRun {
+			return nil, nil
+		}
+
+		return nil, s.db.Update(func(txn kvTxn) error {
+			return setJson(txn, []byte(schemaVersionKey), SchemaVersion)
+		})
+	}
+
+	run := func(txn kvTxn, v int) (MigrationReport, []string, error) {
+		m := migrations[v]
+		r := &migrationRun{
+			txn:    txn,
+			dryRun: dryRun,
+		}
+
+		if err := m.migrate(s, r); err != nil {
+			return MigrationReport{}, r.blobs, fmt.Errorf("migration to schema version %d (%s): %w", v+1, m.description, err)
+		}
+
+		return MigrationReport{
+			Version:     v + 1,
+			Description: m.description,
+			Changes:     r.changes,
+		}, r.blobs, nil
+	}
+
+	var reports []MigrationReport
+
+	if dryRun {
+		err := s.db.Update(func(txn kvTxn) error {
+			reports = nil
+			for v := version; v < SchemaVersion; v++ {
+				report, _, err := run(txn, v)
+				if err != nil {
+					return err
+				}
+				reports = append(reports, report)
+			}
+
+			return errDryRun
+		})
+		if err != errDryRun {
+			return nil, err
+		}
+
+		return reports, nil
+	}
+
+	for v := version; v < SchemaVersion; v++ {
+		var report MigrationReport
+		var blobs []string
+		err := s.db.Update(func(txn kvTxn) error {
+			var err error
+			report, blobs, err = run(txn, v)
+			if err != nil {
+				return err
+			}
+
+			return setJson(txn, []byte(schemaVersionKey), v+1)
+		})
+		if err != nil {
+			for _, blob := range blobs {
+				_ = s.blobs.Remove(blob)
+			}
+			return nil, err
+		}
+
+		for _, change := range report.Changes {
+			log.Printf("%s", change)
+		}
+		log.Printf("migrated database to schema version %d: %s", report.Version, report.Description)
+
+		reports = append(reports, report)
+	}
+
+	return reports, nil
+}
+
+// migrateFileData moves the contents of files that were stored inside their
+// record into the blob store.
+func migrateFileData(s kvStore, run *migrationRun) error {
+	var identifiers []string
+	err := run.txn.Iterate([]byte(filePrefix), func(key []byte, value func() ([]byte, error)) error {
+		identifiers = append(identifiers, string(key[len(filePrefix):]))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, identifier := range identifiers {
+		var file File
+		err := getJson(run.txn, prefix(filePrefix, identifier), &file)
+		if err != nil {
+			return err
+		}
+		if file.Blob != "" {
+			continue
+		}
+
+		run.change("moving %d bytes of file %s to the blob store in %s", len(file.Data), identifier, s.blobs)
+		if run.dryRun {
+			continue
+		}
+
+		file.Blob, file.Size, file.Hash, err = s.blobs.Write(bytes.NewReader(file.Data))
+		if err != nil {
+			return err
+		}
+		run.blobs = append(run.blobs, file.Blob)
+		file.Data = nil
+		file.Created = time.Now()
+
+		err = setJson(run.txn, prefix(filePrefix, identifier), &file)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateOwnerIndex moves the aliases of users out of the list in their record,
+// where they used to be kept, into the owner index.
+func migrateOwnerIndex(s kvStore, run *migrationRun) error {
+	var users []User
+	err := iterateValues(run.txn, []byte(userPrefix), func(key []byte, val []byte) error {
+		var user User
+		if err := decodeJson(val, &user); err != nil {
+			return err
+		}
+
+		if user.Aliases != nil {
+			users = append(users, user)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		run.change("moving %d aliases of %s into the owner index", len(user.Aliases), user.Name)
+
+		for _, name := range user.Aliases {
+			var alias Alias
+			err := getJson(run.txn, prefix(aliasPrefix, name), &alias)
+			if err == ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			// the owner in the alias wins when the two disagree
+			err = run.txn.Set(ownerKey(alias.Owner, alias.Alias), []byte{})
+			if err != nil {
+				return err
+			}
+		}
+
+		user.Aliases = nil
+		if err := setJson(run.txn, prefix(userPrefix, user.Name), &user); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateClickCounts counts the clicks that were made before they were counted
+// when they are recorded.
+func migrateClickCounts(s kvStore, run *migrationRun) error {
+	counts, err := countClicks(run.txn)
+	if err != nil {
+		return err
+	}
+
+	for alias, count := range counts {
+		run.change("counting %d clicks on %s", count.Total, alias)
+		if err := setJson(run.txn, prefix(clickCountPrefix, alias), count); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateExpiryIndex adds the aliases that expire to the index the sweeper
+// goes through.
+func migrateExpiryIndex(s kvStore, run *migrationRun) error {
+	var aliases []Alias
+	err := iterateValues(run.txn, []byte(aliasPrefix), func(key []byte, val []byte) error {
+		var alias Alias
+		if err := decodeJson(val, &alias); err != nil {
+			return err
+		}
+
+		if alias.Expires != nil {
+			aliases = append(aliases, alias)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, alias := range aliases {
+		run.change("adding %s, which expires at %s, to the expiry index", alias.Alias, alias.Expires.Format(time.RFC3339))
+		if err := addAliasExpiry(run.txn, alias); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
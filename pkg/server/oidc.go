@@ -0,0 +1,368 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// Users can log in with an OpenID Connect provider when one is configured.
+// Users logging in for the first time are created on the spot, linked to the
+// subject the provider knows them by. Password login keeps working next to
+// it, for local users and for when the provider is down.
+
+const oidcCallbackPath = "/__API__/oidc/callback"
+
+// Someone who went to the provider to log in has this long to come back.
+const oidcTimeout = 10 * time.Minute
+
+// Looking up the endpoints of the provider is given up on after this long.
+const oidcDiscoveryTimeout = 10 * time.Second
+
+var (
+	ErrOIDCState       = errors.New("single sign-on took too long or was started elsewhere, try again")
+	ErrOIDCNoUsername  = errors.New("the identity provider didn't give a username")
+	ErrOIDCUserExists  = errors.New("a user with your name already exists")
+	ErrOIDCUnavailable = errors.New("single sign-on is unavailable right now, try again later or log in with your password")
+)
+
+type OIDCConfig struct {
+	// Issuer is the url of the provider, where
+	// .well-known/openid-configuration is found.
+	Issuer       string
+	ClientId     string
+	ClientSecret string
+	// Name is shown on the login button.
+	Name string
+	// Scopes are asked for besides openid. The default is profile and
+	// email.
+	Scopes []string
+	// UsernameClaim is the claim that users are named after. The default is
+	// preferred_username, falling back to the email address.
+	UsernameClaim string
+	// GroupsClaim holds the groups of a user. The default is groups.
+	GroupsClaim string
+	// AdminGroup makes users admins when they are in it, and takes admin
+	// away when they aren't. When it's empty, admins are only made in short
+	// itself.
+	AdminGroup string
+	// LinkUsers links local users to the provider when someone logs in with
+	// the same name for the first time. Only enable this when the provider
+	// doesn't let people pick their own name.
+	LinkUsers bool
+}
+
+// OIDCConfigFromEnv reads the OIDC_* environment variables. It returns nil when
+// OIDC_ISSUER isn't set.
+func OIDCConfigFromEnv() *OIDCConfig {
+	issuer := os.Getenv("OIDC_ISSUER")
+	if issuer == "" {
+		return nil
+	}
+
+	config := &OIDCConfig{
+		Issuer:        issuer,
+		ClientId:      os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret:  os.Getenv("OIDC_CLIENT_SECRET"),
+		Name:          os.Getenv("OIDC_NAME"),
+		Scopes:        strings.Fields(os.Getenv("OIDC_SCOPES")),
+		UsernameClaim: os.Getenv("OIDC_USERNAME_CLAIM"),
+		GroupsClaim:   os.Getenv("OIDC_GROUPS_CLAIM"),
+		AdminGroup:    os.Getenv("OIDC_ADMIN_GROUP"),
+		LinkUsers:     os.Getenv("OIDC_LINK_USERS") == "true",
+	}
+	if config.Name == "" {
+		config.Name = "single sign-on"
+	}
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"profile", "email"}
+	}
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = "groups"
+	}
+
+	return config
+}
+
+// OIDCState is kept in the session while someone logs in at the provider.
+type OIDCState struct {
+	State    string
+	Nonce    string
+	Verifier string
+	Expires  time.Time
+}
+
+// OIDC logs users in with an OpenID Connect provider.
+type OIDC struct {
+	lm     *LoginManager
+	config OIDCConfig
+	base   string
+
+	// the endpoints of the provider, once they have been looked up
+	lock     sync.Mutex
+	oauth    *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// NewOIDC sets up logging in with the provider of config. base is the base url,
+// which the provider redirects back to. The endpoints of the provider are
+// looked up in the background, and again when someone logs in as long as that
+// fails, so the server starts while the provider is down.
+func NewOIDC(lm *LoginManager, config OIDCConfig, base string) *OIDC {
+	res := &OIDC{
+		lm:     lm,
+		config: config,
+		base:   base,
+	}
+
+	go func() {
+		_, _, _ = res.discover(context.Background())
+	}()
+
+	return res
+}
+
+// discover returns the endpoints of the provider, and looks them up when that
+// hasn't been done yet. It returns ErrOIDCUnavailable when the provider can't
+// be reached.
+func (o *OIDC) discover(ctx context.Context) (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if o.oauth != nil {
+		return o.oauth, o.verifier, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, oidcDiscoveryTimeout)
+	defer cancel()
+
+	provider, err := oidc.NewProvider(ctx, o.config.Issuer)
+	if err != nil {
+		log.Printf("looking up oidc provider %s: %v", o.config.Issuer, err)
+		return nil, nil, ErrOIDCUnavailable
+	}
+
+	o.oauth = &oauth2.Config{
+		ClientID:     o.config.ClientId,
+		ClientSecret: o.config.ClientSecret,
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  strings.TrimSuffix(o.base, "/") + oidcCallbackPath,
+		Scopes:       append([]string{oidc.ScopeOpenID}, o.config.Scopes...),
+	}
+	o.verifier = provider.Verifier(&oidc.Config{ClientID: o.config.ClientId})
+
+	return o.oauth, o.verifier, nil
+}
+
+// Name is what the provider is called on the login page.
+func (o *OIDC) Name() string {
+	return o.config.Name
+}
+
+// Begin returns where to send someone to log in, and what to keep in their
+// session until they come back.
+func (o *OIDC) Begin(ctx context.Context, now time.Time) (string, OIDCState, error) {
+	oauth, _, err := o.discover(ctx)
+	if err != nil {
+		return "", OIDCState{}, err
+	}
+
+	var state OIDCState
+	for _, value := range []*string{&state.State, &state.Nonce, &state.Verifier} {
+		var err error
+		*value, err = SecureRandSeq(43)
+		if err != nil {
+			return "", OIDCState{}, err
+		}
+	}
+	state.Expires = now.Add(oidcTimeout)
+
+	// pkce, so a code that leaks can't be used by anyone else
+	challenge := sha256.Sum256([]byte(state.Verifier))
+
+	return oauth.AuthCodeURL(state.State,
+		oidc.Nonce(state.Nonce),
+		oauth2.SetAuthURLParam("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:])),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	), state, nil
+}
+
+// Finish exchanges the code the provider redirected back with for the identity
+// of the user, and logs them in like OIDCLogIn. Users that don't exist yet are
+// created.
+func (o *OIDC) Finish(ctx context.Context, state OIDCState, gotState string, code string) (SessionUser, error) {
+	if state.State == "" || state.State != gotState || time.Now().After(state.Expires) {
+		return SessionUser{}, ErrOIDCState
+	}
+
+	oauth, verifier, err := o.discover(ctx)
+	if err != nil {
+		return SessionUser{}, err
+	}
+
+	token, err := oauth.Exchange(ctx, code, oauth2.SetAuthURLParam("code_verifier", state.Verifier))
+	if err != nil {
+		return SessionUser{}, fmt.Errorf("exchanging code: %w", err)
+	}
+
+	rawIdToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return SessionUser{}, errors.New("no id token in token response")
+	}
+
+	idToken, err := verifier.Verify(ctx, rawIdToken)
+	if err != nil {
+		return SessionUser{}, fmt.Errorf("verifying id token: %w", err)
+	}
+	if idToken.Nonce != state.Nonce {
+		return SessionUser{}, ErrOIDCState
+	}
+
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return SessionUser{}, err
+	}
+
+	identity := OIDCIdentity{
+		Issuer:  idToken.Issuer,
+		Subject: idToken.Subject,
+		Name:    o.username(claims),
+		Email:   stringClaim(claims, "email"),
+	}
+	if o.config.AdminGroup != "" {
+		admin := false
+		for _, group := range groupsClaim(claims, o.config.GroupsClaim) {
+			if group == o.config.AdminGroup {
+				admin = true
+			}
+		}
+		identity.Admin = &admin
+	}
+
+	return o.lm.OIDCLogIn(identity, o.config.LinkUsers)
+}
+
+func (o *OIDC) username(claims map[string]interface{}) string {
+	if o.config.UsernameClaim != "" {
+		return stringClaim(claims, o.config.UsernameClaim)
+	}
+
+	if name := stringClaim(claims, "preferred_username"); name != "" {
+		return name
+	}
+	return stringClaim(claims, "email")
+}
+
+func stringClaim(claims map[string]interface{}, name string) string {
+	value, _ := claims[name].(string)
+	return value
+}
+
+// groupsClaim reads a claim that is a list of groups, or a single one.
+func groupsClaim(claims map[string]interface{}, name string) []string {
+	switch value := claims[name].(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		var res []string
+		for _, group := range value {
+			if group, ok := group.(string); ok {
+				res = append(res, group)
+			}
+		}
+		return res
+	default:
+		return nil
+	}
+}
+
+// OIDCIdentity is who the provider says someone is.
+type OIDCIdentity struct {
+	Issuer  string
+	Subject string
+	Name    string
+	Email   string
+	// Admin is nil when the provider doesn't decide who is an admin.
+	Admin *bool
+}
+
+// OIDCLogIn logs in the user linked to identity, and creates them when there
+// is none. Users with the same name are linked when link is set. Like LogIn, it
+// returns ErrSecondFactorRequired for users with two-factor authentication, who
+// still have to enter a code: a linked user may have set it up before, and the
+// provider doesn't tell whether it asked for a second factor itself.
+func (lm LoginManager) OIDCLogIn(identity OIDCIdentity, link bool) (SessionUser, error) {
+	users, err := lm.store.GetUsers()
+	if err != nil {
+		return SessionUser{}, err
+	}
+
+	var user *User
+	for i := range users {
+		if users[i].OIDCIssuer == identity.Issuer && users[i].OIDCSubject == identity.Subject {
+			user = &users[i]
+			break
+		}
+	}
+
+	if user == nil {
+		if identity.Name == "" {
+			return SessionUser{}, ErrOIDCNoUsername
+		}
+
+		existing, err := lm.store.GetUser(identity.Name)
+		if err == nil {
+			if !link || existing.OIDCSubject != "" {
+				return SessionUser{}, ErrOIDCUserExists
+			}
+			user = &existing
+		} else if err == ErrNotFound {
+			// users from the provider have no password, they can set
+			// one later to also log in without it
+			user = &User{
+				Name:  identity.Name,
+				Email: identity.Email,
+			}
+			if err := lm.store.CreateUser(*user); err != nil {
+				return SessionUser{}, err
+			}
+		} else {
+			return SessionUser{}, err
+		}
+
+		user.OIDCIssuer = identity.Issuer
+		user.OIDCSubject = identity.Subject
+	}
+
+	if identity.Admin != nil {
+		user.Admin = *identity.Admin
+	}
+	if identity.Email != "" {
+		user.Email = identity.Email
+	}
+	// the provider decided they can log in
+	user.Pending = false
+
+	if err := lm.store.UpdateUser(user); err != nil {
+		return SessionUser{}, err
+	}
+
+	// the user only gets a session after SecondFactor
+	if user.TOTPSecret != "" {
+		return SessionUser{Name: user.Name}, ErrSecondFactorRequired
+	}
+
+	return SessionUser{
+		Name: user.Name,
+	}, nil
+}
@@ -0,0 +1,444 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testClientId = "short"
+
+// testProvider is an OpenID Connect provider that serves discovery, its keys
+// and a token endpoint. Codes are handed out by the test instead of by an
+// authorization endpoint.
+type testProvider struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	lock sync.Mutex
+	// down makes discovery fail.
+	down bool
+	// codes that can be exchanged once, for an id token with these claims
+	codes map[string]testCode
+}
+
+type testCode struct {
+	claims    map[string]interface{}
+	challenge string
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	check(t, err)
+
+	p := &testProvider{
+		key:   key,
+		codes: map[string]testCode{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/jwks", p.jwks)
+	mux.HandleFunc("/token", p.token)
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+
+	return p
+}
+
+func (p *testProvider) discovery(w http.ResponseWriter, r *http.Request) {
+	p.lock.Lock()
+	down := p.down
+	p.lock.Unlock()
+	if down {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	writeJson(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                p.server.URL,
+		"authorization_endpoint":                p.server.URL + "/auth",
+		"token_endpoint":                        p.server.URL + "/token",
+		"jwks_uri":                              p.server.URL + "/jwks",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (p *testProvider) jwks(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+		}},
+	})
+}
+
+func (p *testProvider) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	p.lock.Lock()
+	code, ok := p.codes[r.PostForm.Get("code")]
+	delete(p.codes, r.PostForm.Get("code"))
+	p.lock.Unlock()
+
+	verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(verifier[:]) != code.challenge {
+		writeJson(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	idToken, err := p.sign(code.claims)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJson(w, http.StatusOK, map[string]interface{}{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+func (p *testProvider) sign(claims map[string]interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// authorize does what the authorization endpoint would: it hands out a code for
+// an id token with claims, after someone was sent there with authURL.
+func (p *testProvider) authorize(t *testing.T, authURL string, claims map[string]interface{}) (string, string) {
+	u, err := url.Parse(authURL)
+	check(t, err)
+	query := u.Query()
+
+	now := time.Now()
+	idClaims := map[string]interface{}{
+		"iss":   p.server.URL,
+		"aud":   testClientId,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+		"nonce": query.Get("nonce"),
+	}
+	for name, value := range claims {
+		idClaims[name] = value
+	}
+
+	code, err := SecureRandSeq(20)
+	check(t, err)
+	p.lock.Lock()
+	p.codes[code] = testCode{idClaims, query.Get("code_challenge")}
+	p.lock.Unlock()
+
+	return code, query.Get("state")
+}
+
+func newTestOIDC(p *testProvider, lm *LoginManager, adminGroup string, link bool) *OIDC {
+	return NewOIDC(lm, OIDCConfig{
+		Issuer:       p.server.URL,
+		ClientId:     testClientId,
+		ClientSecret: "secret",
+		Name:         "test",
+		Scopes:       []string{"profile", "email"},
+		GroupsClaim:  "groups",
+		AdminGroup:   adminGroup,
+		LinkUsers:    link,
+	}, testBase)
+}
+
+// oidcLogIn logs in at p as the user with claims.
+func oidcLogIn(t *testing.T, o *OIDC, p *testProvider, claims map[string]interface{}) (SessionUser, error) {
+	authURL, state, err := o.Begin(context.Background(), time.Now())
+	if err != nil {
+		return SessionUser{}, err
+	}
+
+	code, gotState := p.authorize(t, authURL, claims)
+	return o.Finish(context.Background(), state, gotState, code)
+}
+
+func TestOIDCProvisioning(t *testing.T) {
+	p := newTestProvider(t)
+	lm := newTestLoginManager(t)
+	o := newTestOIDC(p, lm, "", false)
+
+	su, err := oidcLogIn(t, o, p, map[string]interface{}{
+		"sub":                "1",
+		"preferred_username": "carol",
+		"email":              "carol@example.com",
+	})
+	check(t, err)
+	if su.Name != "carol" {
+		t.Fatalf("logged in as %s, expected carol", su.Name)
+	}
+
+	carol, err := lm.store.GetUser("carol")
+	check(t, err)
+	if carol.OIDCIssuer != p.server.URL || carol.OIDCSubject != "1" || carol.Email != "carol@example.com" || carol.Password != nil || carol.Admin {
+		t.Errorf("created user %+v", carol)
+	}
+
+	// users are found by their subject, changing their name at the provider
+	// doesn't make a new user
+	su, err = oidcLogIn(t, o, p, map[string]interface{}{
+		"sub":                "1",
+		"preferred_username": "caroline",
+	})
+	check(t, err)
+	if su.Name != "carol" {
+		t.Errorf("logged in as %s after changing names, expected carol", su.Name)
+	}
+
+	// the email address is used when there is no username
+	su, err = oidcLogIn(t, o, p, map[string]interface{}{
+		"sub":   "2",
+		"email": "dave@example.com",
+	})
+	check(t, err)
+	if su.Name != "dave@example.com" {
+		t.Errorf("logged in as %s, expected the email address", su.Name)
+	}
+
+	if _, err := oidcLogIn(t, o, p, map[string]interface{}{"sub": "3"}); err != ErrOIDCNoUsername {
+		t.Errorf("logging in without a name returned %v, expected ErrOIDCNoUsername", err)
+	}
+}
+
+func TestOIDCAdminGroup(t *testing.T) {
+	p := newTestProvider(t)
+	lm := newTestLoginManager(t)
+	o := newTestOIDC(p, lm, "admins", false)
+
+	for _, c := range []struct {
+		groups interface{}
+		admin  bool
+	}{
+		{[]string{"users", "admins"}, true},
+		{[]string{"users"}, false},
+		{"admins", true},
+		{nil, false},
+	} {
+		_, err := oidcLogIn(t, o, p, map[string]interface{}{
+			"sub":                "1",
+			"preferred_username": "carol",
+			"groups":             c.groups,
+		})
+		check(t, err)
+
+		carol, err := lm.store.GetUser("carol")
+		check(t, err)
+		if carol.Admin != c.admin {
+			t.Errorf("with groups %v carol is admin: %v, expected %v", c.groups, carol.Admin, c.admin)
+		}
+	}
+
+	// without an admin group, admins are only made in short itself
+	o = newTestOIDC(p, lm, "", false)
+	check(t, lm.SetAdmin("carol", true))
+	_, err := oidcLogIn(t, o, p, map[string]interface{}{
+		"sub":                "1",
+		"preferred_username": "carol",
+	})
+	check(t, err)
+	carol, err := lm.store.GetUser("carol")
+	check(t, err)
+	if !carol.Admin {
+		t.Errorf("logging in took admin away without an admin group")
+	}
+}
+
+func TestOIDCStateMismatch(t *testing.T) {
+	p := newTestProvider(t)
+	lm := newTestLoginManager(t)
+	o := newTestOIDC(p, lm, "", false)
+	claims := map[string]interface{}{
+		"sub":                "1",
+		"preferred_username": "carol",
+	}
+
+	// the state the provider sent back has to be the one in the session
+	authURL, state, err := o.Begin(context.Background(), time.Now())
+	check(t, err)
+	code, _ := p.authorize(t, authURL, claims)
+	if _, err := o.Finish(context.Background(), state, "other", code); err != ErrOIDCState {
+		t.Errorf("finishing with another state returned %v, expected ErrOIDCState", err)
+	}
+	if _, err := o.Finish(context.Background(), OIDCState{}, "", code); err != ErrOIDCState {
+		t.Errorf("finishing without a state returned %v, expected ErrOIDCState", err)
+	}
+
+	authURL, state, err = o.Begin(context.Background(), time.Now().Add(-oidcTimeout-time.Minute))
+	check(t, err)
+	code, gotState := p.authorize(t, authURL, claims)
+	if _, err := o.Finish(context.Background(), state, gotState, code); err != ErrOIDCState {
+		t.Errorf("finishing too late returned %v, expected ErrOIDCState", err)
+	}
+
+	// and the id token has to be for the nonce in the session
+	authURL, state, err = o.Begin(context.Background(), time.Now())
+	check(t, err)
+	code, gotState = p.authorize(t, authURL, map[string]interface{}{
+		"sub":                "1",
+		"preferred_username": "carol",
+		"nonce":              "other",
+	})
+	if _, err := o.Finish(context.Background(), state, gotState, code); err != ErrOIDCState {
+		t.Errorf("finishing with another nonce returned %v, expected ErrOIDCState", err)
+	}
+
+	if _, err := lm.store.GetUser("carol"); err != ErrNotFound {
+		t.Errorf("a user was created by a failed login: %v", err)
+	}
+}
+
+func TestOIDCNameCollision(t *testing.T) {
+	p := newTestProvider(t)
+	lm := newTestLoginManager(t)
+	o := newTestOIDC(p, lm, "", false)
+
+	// alice is a local user, someone else called alice at the provider
+	// doesn't get to be her
+	_, err := oidcLogIn(t, o, p, map[string]interface{}{
+		"sub":                "1",
+		"preferred_username": "alice",
+	})
+	if err != ErrOIDCUserExists {
+		t.Errorf("logging in with the name of a local user returned %v, expected ErrOIDCUserExists", err)
+	}
+
+	alice, err := lm.store.GetUser("alice")
+	check(t, err)
+	if alice.OIDCSubject != "" {
+		t.Errorf("alice was linked to subject %s", alice.OIDCSubject)
+	}
+
+	// neither does a second alice when she is linked
+	o = newTestOIDC(p, lm, "", true)
+	_, err = oidcLogIn(t, o, p, map[string]interface{}{
+		"sub":                "1",
+		"preferred_username": "alice",
+	})
+	check(t, err)
+	_, err = oidcLogIn(t, o, p, map[string]interface{}{
+		"sub":                "2",
+		"preferred_username": "alice",
+	})
+	if err != ErrOIDCUserExists {
+		t.Errorf("logging in with the name of a linked user returned %v, expected ErrOIDCUserExists", err)
+	}
+}
+
+func TestOIDCLink(t *testing.T) {
+	p := newTestProvider(t)
+	lm := newTestLoginManager(t)
+	o := newTestOIDC(p, lm, "", true)
+
+	alice, err := lm.store.GetUser("alice")
+	check(t, err)
+	alice.Password = []byte("hash")
+	alice.Pending = true
+	check(t, lm.store.UpdateUser(&alice))
+
+	su, err := oidcLogIn(t, o, p, map[string]interface{}{
+		"sub":                "1",
+		"preferred_username": "alice",
+		"email":              "alice@example.com",
+	})
+	check(t, err)
+	if su.Name != "alice" {
+		t.Fatalf("logged in as %s, expected alice", su.Name)
+	}
+
+	alice, err = lm.store.GetUser("alice")
+	check(t, err)
+	if alice.OIDCSubject != "1" || alice.Email != "alice@example.com" || alice.Pending || string(alice.Password) != "hash" {
+		t.Errorf("linked user is %+v", alice)
+	}
+}
+
+func TestOIDCSecondFactor(t *testing.T) {
+	p := newTestProvider(t)
+	lm := newTestLoginManager(t)
+	o := newTestOIDC(p, lm, "", true)
+
+	secret, err := lm.BeginTOTP("alice")
+	check(t, err)
+	key, err := totpEncoding.DecodeString(secret)
+	check(t, err)
+	step := time.Now().Unix() / totpPeriod
+	_, err = lm.EnableTOTP("alice", totpCode(key, step-1))
+	check(t, err)
+
+	// a linked user with two-factor authentication still has to enter a
+	// code, like after their password
+	su, err := oidcLogIn(t, o, p, map[string]interface{}{
+		"sub":                "1",
+		"preferred_username": "alice",
+	})
+	if err != ErrSecondFactorRequired || su.Name != "alice" {
+		t.Fatalf("logging in returned %v for %s, expected ErrSecondFactorRequired for alice", err, su.Name)
+	}
+
+	su, err = lm.SecondFactor(su.Name, totpCode(key, step))
+	check(t, err)
+	if su.Name != "alice" {
+		t.Errorf("logged in as %s, expected alice", su.Name)
+	}
+}
+
+func TestOIDCUnavailable(t *testing.T) {
+	p := newTestProvider(t)
+	p.down = true
+	lm := newTestLoginManager(t)
+	o := newTestOIDC(p, lm, "", false)
+	claims := map[string]interface{}{
+		"sub":                "1",
+		"preferred_username": "carol",
+	}
+
+	if _, err := oidcLogIn(t, o, p, claims); err != ErrOIDCUnavailable {
+		t.Errorf("logging in while the provider is down returned %v, expected ErrOIDCUnavailable", err)
+	}
+
+	// the provider is looked up again once it is back
+	p.lock.Lock()
+	p.down = false
+	p.lock.Unlock()
+
+	_, err := oidcLogIn(t, o, p, claims)
+	check(t, err)
+}
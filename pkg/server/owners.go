@@ -0,0 +1,334 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Which aliases a user owns is kept in an index with a key for every alias,
+// owner_<user>:<alias>, so listing them is a prefix scan and changing them
+// doesn't rewrite the user. Aliases can't contain a ':', so everything after
+// the last ':' is the alias, and the aliases of one user never share a prefix
+// with those of another.
+const ownerPrefix = "owner_"
+
+func ownerUserPrefix(owner string) []byte {
+	return prefix(ownerPrefix, owner+":")
+}
+
+func ownerKey(owner string, alias string) []byte {
+	return prefix(ownerPrefix, owner+":"+alias)
+}
+
+// parseOwnerKey returns the owner and alias an owner key is made of.
+func parseOwnerKey(key []byte) (string, string, bool) {
+	rest := string(key[len(ownerPrefix):])
+	i := strings.LastIndexByte(rest, ':')
+	if i < 0 {
+		return "", "", false
+	}
+
+	return rest[:i], rest[i+1:], true
+}
+
+// addUserAlias adds alias to the aliases of owner as part of txn. The owner has
+// to exist.
+func (s kvStore) addUserAlias(txn kvTxn, owner string, alias string) error {
+	_, err := txn.Get(prefix(userPrefix, owner))
+	if err != nil {
+		return err
+	}
+
+	return txn.Set(ownerKey(owner, alias), []byte{})
+}
+
+// rmUserAlias removes alias from the aliases of owner as part of txn.
+func (s kvStore) rmUserAlias(txn kvTxn, owner string, alias string) error {
+	return txn.Delete(ownerKey(owner, alias))
+}
+
+// renameUserAlias replaces from with to in the aliases of owner as part of txn.
+func (s kvStore) renameUserAlias(txn kvTxn, owner string, from string, to string) error {
+	err := txn.Delete(ownerKey(owner, from))
+	if err != nil {
+		return err
+	}
+
+	return txn.Set(ownerKey(owner, to), []byte{})
+}
+
+// userAliasNames returns the names of the aliases of owner, in order.
+func userAliasNames(txn kvTxn, owner string) ([]string, error) {
+	var res []string
+
+	p := ownerUserPrefix(owner)
+	err := txn.Iterate(p, func(key []byte, value func() ([]byte, error)) error {
+		alias := string(key[len(p):])
+		// a key of a user whose name starts with owner followed by a ':'
+		if strings.IndexByte(alias, ':') < 0 {
+			res = append(res, alias)
+		}
+		return nil
+	})
+
+	return res, err
+}
+
+func (s kvStore) GetUserAliasNames(owner string) ([]string, error) {
+	var res []string
+	return res, s.db.View(func(txn kvTxn) error {
+		var err error
+		res, err = userAliasNames(txn, owner)
+		return err
+	})
+}
+
+// GetUserAliases returns the aliases of user. Index entries of aliases that
+// don't exist are skipped, CheckOwners reports and removes them.
+func (s kvStore) GetUserAliases(user *User) ([]Alias, error) {
+	var res []Alias
+	return res, s.db.View(func(txn kvTxn) error {
+		names, err := userAliasNames(txn, user.Name)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			var alias Alias
+			err := getJson(txn, prefix(aliasPrefix, name), &alias)
+			if err == ErrNotFound {
+				log.Printf("owner index of %s has alias %s, which doesn't exist", user.Name, name)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			res = append(res, alias)
+		}
+
+		return nil
+	})
+}
+
+// Problems found by CheckOwners are repaired in batches of this size.
+const ownerRepairBatchSize = 1000
+
+// ownerProblem is a mismatch found by CheckOwners, with what repairs it.
+type ownerProblem struct {
+	description string
+	// repair repairs the problem as part of txn, when it is still there.
+	repair func(txn kvTxn) error
+}
+
+// CheckOwners compares the owner index with the owners stored in the aliases,
+// which are taken to be right. It returns a description of every mismatch. When
+// repair is set, the mismatches are repaired as well, in batches:
+//
+//   - index entries of aliases that don't exist or belong to someone else are
+//     removed
+//   - aliases missing from the index of their owner are added to it
+//   - aliases of users that don't exist anymore are given to the first admin,
+//     so nothing is lost and an admin can decide what to do with them
+//
+// Only the index and the owners of aliases are changed, nothing is removed
+// but index entries.
+func (s kvStore) CheckOwners(repair bool) ([]string, error) {
+	var problems []ownerProblem
+	err := s.db.View(func(txn kvTxn) error {
+		var err error
+		problems, err = s.findOwnerProblems(txn)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var res []string
+	for _, problem := range problems {
+		res = append(res, problem.description)
+	}
+
+	if !repair {
+		return res, nil
+	}
+
+	for len(problems) > 0 {
+		batch := problems
+		if len(batch) > ownerRepairBatchSize {
+			batch = batch[:ownerRepairBatchSize]
+		}
+		problems = problems[len(batch):]
+
+		err := s.update(func(txn kvTxn, remove func(blob string)) error {
+			for _, problem := range batch {
+				if err := problem.repair(txn); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
+
+// findOwnerProblems looks for the problems CheckOwners reports as part of txn.
+func (s kvStore) findOwnerProblems(txn kvTxn) ([]ownerProblem, error) {
+	var res []ownerProblem
+
+	var keys [][]byte
+	err := txn.Iterate([]byte(ownerPrefix), func(key []byte, value func() ([]byte, error)) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		owner, name, ok := parseOwnerKey(key)
+
+		var alias Alias
+		err := ErrNotFound
+		if ok {
+			err = getJson(txn, prefix(aliasPrefix, name), &alias)
+		}
+		if err != nil && err != ErrNotFound {
+			return nil, err
+		}
+
+		var description string
+		switch {
+		case err == ErrNotFound:
+			description = fmt.Sprintf("owner index of %s has alias %s, which doesn't exist", owner, name)
+		case alias.Owner != owner:
+			description = fmt.Sprintf("owner index of %s has alias %s, which belongs to %s", owner, name, alias.Owner)
+		default:
+			continue
+		}
+
+		key := key
+		res = append(res, ownerProblem{description, func(txn kvTxn) error {
+			var alias Alias
+			err := getJson(txn, prefix(aliasPrefix, name), &alias)
+			if err == nil && alias.Owner == owner {
+				return nil
+			}
+			if err != nil && err != ErrNotFound {
+				return err
+			}
+
+			return txn.Delete(key)
+		}})
+	}
+
+	var aliases []Alias
+	var admin string
+	err = iterateValues(txn, []byte(aliasPrefix), func(key []byte, val []byte) error {
+		var alias Alias
+		if err := decodeJson(val, &alias); err != nil {
+			return err
+		}
+
+		aliases = append(aliases, alias)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = iterateValues(txn, []byte(userPrefix), func(key []byte, val []byte) error {
+		var user User
+		if err := decodeJson(val, &user); err != nil {
+			return err
+		}
+
+		if user.Admin {
+			admin = user.Name
+			return errStopIteration
+		}
+		return nil
+	})
+	if err != nil && err != errStopIteration {
+		return nil, err
+	}
+
+	for _, alias := range aliases {
+		name := alias.Alias
+
+		ownerExists, err := exists(txn, prefix(userPrefix, alias.Owner))
+		if err != nil {
+			return nil, err
+		}
+
+		if !ownerExists {
+			if admin == "" {
+				res = append(res, ownerProblem{
+					fmt.Sprintf("alias %s belongs to %s, who doesn't exist (there is no admin to give it to)", name, alias.Owner),
+					func(txn kvTxn) error { return nil },
+				})
+				continue
+			}
+
+			owner := alias.Owner
+			res = append(res, ownerProblem{
+				fmt.Sprintf("alias %s belongs to %s, who doesn't exist (repairing gives it to %s)", name, owner, admin),
+				func(txn kvTxn) error {
+					var alias Alias
+					err := getJson(txn, prefix(aliasPrefix, name), &alias)
+					if err == ErrNotFound {
+						return nil
+					}
+					if err != nil {
+						return err
+					}
+
+					ownerExists, err := exists(txn, prefix(userPrefix, alias.Owner))
+					if err != nil || ownerExists {
+						return err
+					}
+
+					if err := txn.Delete(ownerKey(alias.Owner, name)); err != nil {
+						return err
+					}
+					alias.Owner = admin
+					if err := s.addUserAlias(txn, admin, name); err != nil {
+						return err
+					}
+					return setJson(txn, prefix(aliasPrefix, name), &alias)
+				},
+			})
+			continue
+		}
+
+		indexed, err := exists(txn, ownerKey(alias.Owner, name))
+		if err != nil {
+			return nil, err
+		}
+
+		if !indexed {
+			owner := alias.Owner
+			res = append(res, ownerProblem{
+				fmt.Sprintf("alias %s is missing from the owner index of %s", name, owner),
+				func(txn kvTxn) error {
+					var alias Alias
+					err := getJson(txn, prefix(aliasPrefix, name), &alias)
+					if err == ErrNotFound || (err == nil && alias.Owner != owner) {
+						return nil
+					}
+					if err != nil {
+						return err
+					}
+
+					return s.addUserAlias(txn, owner, name)
+				},
+			})
+		}
+	}
+
+	return res, nil
+}
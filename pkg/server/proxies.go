@@ -0,0 +1,88 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// TrustedProxies are the reverse proxies that are trusted to say who they are
+// forwarding requests for in X-Forwarded-For.
+type TrustedProxies []*net.IPNet
+
+// TrustedProxiesFromEnv reads TRUSTED_PROXIES, a comma or space separated list
+// of ips and networks like 10.0.0.0/8. Without it, X-Forwarded-For is ignored.
+func TrustedProxiesFromEnv() (TrustedProxies, error) {
+	return ParseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+}
+
+func ParseTrustedProxies(value string) (TrustedProxies, error) {
+	var res TrustedProxies
+	for _, field := range strings.FieldsFunc(value, func(c rune) bool {
+		return c == ',' || c == ' '
+	}) {
+		if !strings.Contains(field, "/") {
+			ip := net.ParseIP(field)
+			if ip == nil {
+				return nil, fmt.Errorf("trusted proxy %q is not an ip or network", field)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			res = append(res, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(field)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q is not an ip or network", field)
+		}
+		res = append(res, network)
+	}
+
+	return res, nil
+}
+
+func (p TrustedProxies) Contains(ip net.IP) bool {
+	for _, network := range p {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the ip a request was made from. When it came through trusted
+// proxies, X-Forwarded-For is followed back from the last proxy to the first
+// address that isn't a trusted proxy. Anything before that could have been
+// made up by the client. It returns nil when the ip can't be read.
+func (p TrustedProxies) ClientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !p.Contains(ip) {
+		return ip
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		next := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if next == nil {
+			// not an ip, the last proxy is the best that is known
+			break
+		}
+
+		ip = next
+		if !p.Contains(ip) {
+			break
+		}
+	}
+
+	return ip
+}
@@ -1,6 +1,8 @@
 package server
 
 import (
+	crand "crypto/rand"
+	"math/big"
 	"math/rand"
 	"strings"
 	"time"
@@ -24,7 +26,7 @@ func RandSeq(n int, params ...string) string {
 	return b.String()
 }
 
-func NonExistentRandom(store *Store) (string, error) {
+func NonExistentRandom(store Store) (string, error) {
 	for {
 		res := RandSeq(5, "ABCDEFGHIJKLMNOPQRSTUVWXYZ")
 		alias, err := store.GetAlias(res)
@@ -36,3 +38,20 @@ func NonExistentRandom(store *Store) (string, error) {
 		}
 	}
 }
+
+// SecureRandSeq works like RandSeq, but uses a cryptographically secure source of
+// randomness. Use it for anything that has to stay secret.
+func SecureRandSeq(n int) (string, error) {
+	chars := []byte("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789")
+
+	b := make([]byte, n)
+	for i := range b {
+		c, err := crand.Int(crand.Reader, big.NewInt(int64(len(chars))))
+		if err != nil {
+			return "", err
+		}
+		b[i] = chars[c.Int64()]
+	}
+
+	return string(b), nil
+}
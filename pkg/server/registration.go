@@ -0,0 +1,125 @@
+package server
+
+import (
+	"errors"
+	"net/mail"
+	"strings"
+)
+
+var (
+	ErrRegistrationDisabled = errors.New("registration is disabled")
+	ErrInvalidEmail         = errors.New("not a valid email address")
+	ErrEmailNotAllowed      = errors.New("email addresses of this domain can't be used to sign up")
+	ErrUserExists           = errors.New("user exists")
+	ErrPendingApproval      = errors.New("account is waiting for approval by an admin")
+	ErrNotPending           = errors.New("user isn't waiting for approval")
+)
+
+// emailDomain returns the domain of an email address, in lower case.
+func emailDomain(email string) (string, error) {
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email {
+		return "", ErrInvalidEmail
+	}
+
+	return strings.ToLower(address.Address[strings.LastIndexByte(address.Address, '@')+1:]), nil
+}
+
+// emailAllowed reports whether people can sign up with an address of domain.
+func (s Settings) emailAllowed(domain string) bool {
+	if len(s.AllowedDomains) == 0 {
+		return true
+	}
+
+	for _, allowed := range s.AllowedDomains {
+		if strings.EqualFold(strings.TrimPrefix(allowed, "@"), domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseDomains parses a list of domains separated by commas or whitespace, like
+// the allowed domains in the admin panel.
+func ParseDomains(value string) []string {
+	var res []string
+	for _, domain := range strings.FieldsFunc(value, func(c rune) bool {
+		return c == ',' || c == ' ' || c == '\t' || c == '\r' || c == '\n'
+	}) {
+		res = append(res, strings.ToLower(strings.TrimPrefix(domain, "@")))
+	}
+
+	return res
+}
+
+// Domains returns the allowed domains in the form ParseDomains reads.
+func (s Settings) Domains() string {
+	return strings.Join(s.AllowedDomains, ", ")
+}
+
+// Register signs up a new user, if the registration mode allows it. With
+// RegistrationApproval, the user is pending until an admin approves them.
+func (lm LoginManager) Register(name string, email string, password string) (User, error) {
+	settings, err := lm.store.GetSettings()
+	if err != nil {
+		return User{}, err
+	}
+
+	mode := settings.RegistrationMode()
+	if mode == RegistrationDisabled {
+		return User{}, ErrRegistrationDisabled
+	}
+
+	domain, err := emailDomain(email)
+	if err != nil {
+		return User{}, err
+	}
+	if !settings.emailAllowed(domain) {
+		return User{}, ErrEmailNotAllowed
+	}
+
+	user := User{
+		Name:     name,
+		Password: []byte(password),
+		Email:    email,
+		Pending:  mode == RegistrationApproval,
+	}
+
+	exists, err := lm.CreateUser(user)
+	if err != nil {
+		return User{}, err
+	}
+	if exists {
+		return User{}, ErrUserExists
+	}
+
+	return user, nil
+}
+
+// Approve lets a pending user log in.
+func (lm LoginManager) Approve(name string) error {
+	user, err := lm.store.GetUser(name)
+	if err != nil {
+		return err
+	}
+	if !user.Pending {
+		return ErrNotPending
+	}
+
+	user.Pending = false
+	return lm.store.UpdateUser(&user)
+}
+
+// Reject removes a pending user.
+func (lm LoginManager) Reject(name string) error {
+	user, err := lm.store.GetUser(name)
+	if err != nil {
+		return err
+	}
+	if !user.Pending {
+		return ErrNotPending
+	}
+
+	return lm.store.RmUser(name)
+}
@@ -2,43 +2,60 @@ package server
 
 import (
 	"encoding/gob"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/go-chi/chi/middleware"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
 	"golang.org/x/crypto/bcrypt"
 	"html/template"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	url2 "net/url"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 	"unicode"
 )
 
 const sessionName = "session"
 const sessionUserValue = "user"
 const sessionMessageValue = "message"
-
-
-
-func sessionKey () []byte {
-	env := os.Getenv("SESSION_KEY")
+const sessionTokenValue = "token"
+const sessionInviteValue = "invite"
+const sessionNewInviteValue = "newinvite"
+const sessionPendingLoginValue = "pendinglogin"
+const sessionRecoveryCodesValue = "recoverycodes"
+const sessionWebAuthnValue = "webauthn"
+const sessionOIDCValue = "oidc"
+const sessionCSRFValue = "csrf"
+
+
+func dbBackend() string {
+	env := os.Getenv("DB_BACKEND")
 	if env == "" {
-		res := RandSeq(64)
-		log.Printf("using random session key %s", res)
+		res := BackendBadger
+		log.Printf("using %s as db backend", res)
 
-		return []byte(res)
+		return res
 	} else {
-		return []byte(env)
+		return env
 	}
 }
 
-func dbLocation () string {
+func dbLocation (backend string) string {
 	env := os.Getenv("DB_LOCATION")
 	if env == "" {
 		res := "store.db"
+		if backend == BackendBolt {
+			res = "store.bolt"
+		}
 		log.Printf("using %s as db location", res)
 
 		return res
@@ -47,6 +64,44 @@ func dbLocation () string {
 	}
 }
 
+// fileLocation returns where uploaded files are kept. By default they are next
+// to the database, so they end up on the same volume.
+func fileLocation(location string) string {
+	env := os.Getenv("FILE_LOCATION")
+	if env == "" {
+		res := filepath.Join(filepath.Dir(location), "files")
+		log.Printf("using %s as file location", res)
+
+		return res
+	} else {
+		return env
+	}
+}
+
+// adminPasswordFile returns where the password of the admin made on the first
+// start is written, as it is set in ADMIN_PASSWORD_FILE. By default it is next
+// to the database, where short can write for sure.
+func adminPasswordFile(config StoreConfig) string {
+	env := os.Getenv("ADMIN_PASSWORD_FILE")
+	if env != "" {
+		return env
+	}
+
+	return filepath.Join(filepath.Dir(config.Location), "admin_password")
+}
+
+// StoreConfigFromEnv returns the configuration of the store as it is set in the
+// environment (DB_BACKEND, DB_LOCATION and FILE_LOCATION).
+func StoreConfigFromEnv() StoreConfig {
+	backend := dbBackend()
+	location := dbLocation(backend)
+	return StoreConfig{
+		Backend:      backend,
+		Location:     location,
+		FileLocation: fileLocation(location),
+	}
+}
+
 func baseUrl () string {
 	env := os.Getenv("BASE_URL")
 	if env == "" {
@@ -55,7 +110,21 @@ func baseUrl () string {
 		return env
 	}
 }
-var BaseUrl = baseUrl()
+
+// maxUploadSize returns the largest form a file can be uploaded with, in bytes,
+// as it is set in MAX_UPLOAD_SIZE.
+func maxUploadSize() (int64, error) {
+	env := os.Getenv("MAX_UPLOAD_SIZE")
+	if env == "" {
+		return defaultMaxUploadSize, nil
+	}
+
+	res, err := strconv.ParseInt(env, 10, 64)
+	if err != nil || res <= 0 {
+		return 0, fmt.Errorf("MAX_UPLOAD_SIZE %q is not a number of bytes", env)
+	}
+	return res, nil
+}
 
 func IsUrl(str string) bool {
 	u, err := url2.Parse(str)
@@ -67,23 +136,28 @@ func StartServer() error {
 	r.Use(middleware.Logger)
 
 	gob.Register(SessionUser{})
+	gob.Register(PendingLogin{})
+	gob.Register(WebAuthnChallenge{})
+	gob.Register(OIDCState{})
 
-	sessionStore := sessions.NewCookieStore(sessionKey())
 
 	funcMap := template.FuncMap{
 		"url": func(s string) template.URL {
 			return template.URL(s)
 		},
-		"filename": func (s string) string {
-			for i := len(s)-1; i >= 0; i-- {
-				if s[i] == ':' {
-					return s[:i]
-				}
-			}
-
-			return s
+		"time": func(t time.Time) string {
+			return t.Format("2006-01-02 15:04")
+		},
+		"date": func(t time.Time) string {
+			return t.Format("2006-01-02")
 		},
+		"datetimelocal": func(t time.Time) string {
+			return t.Format(datetimeLocalFormat)
+		},
+		"filename": filename,
 	}
+	base := baseUrl()
+
 	index, err := template.New("index.gohtml").
 		Funcs(funcMap).
 		ParseFiles("static/index.gohtml")
@@ -91,16 +165,67 @@ func StartServer() error {
 		return err
 	}
 
-	store, err := NewStore(dbLocation())
+	storeConfig := StoreConfigFromEnv()
+	store, err := NewStore(storeConfig)
 	if err != nil {
 		return err
 	}
 	defer store.Close()
 
-	lm, err := NewLoginManager(store)
+	keys, err := sessionKeys(store)
+	if err != nil {
+		return err
+	}
+	sessionStore := sessions.NewCookieStore(keys...)
+	// lax and not strict, the cookie is needed when coming back from single
+	// sign-on
+	sessionStore.Options.SameSite = http.SameSiteLaxMode
+	sessionStore.Options.HttpOnly = true
+	sessionStore.Options.Secure = strings.HasPrefix(base, "https://")
+
+	csrf, err := NewCSRFProtection(sessionStore, base)
+	if err != nil {
+		return err
+	}
+	r.Use(csrf.Middleware)
+
+	// ldap users are tried first, local users keep working next to them
+	var authenticators []Authenticator
+	if config := LDAPConfigFromEnv(); config != nil {
+		authenticators = append(authenticators, NewLDAPAuthenticator(*config))
+	}
+	authenticators = append(authenticators, NewLocalAuthenticator(store))
+
+	lm, err := NewLoginManager(store, adminPasswordFile(storeConfig), authenticators...)
+	if err != nil {
+		return err
+	}
+
+	wa, err := NewWebAuthn(lm, base)
+	if err != nil {
+		return err
+	}
+
+	var sso *OIDC
+	if config := OIDCConfigFromEnv(); config != nil {
+		sso = NewOIDC(lm, *config, base)
+	}
+
+	proxies, err := TrustedProxiesFromEnv()
+	if err != nil {
+		return err
+	}
+	maxUpload, err := maxUploadSize()
 	if err != nil {
 		return err
 	}
+	throttle := NewThrottle()
+
+	recorder := NewClickRecorder(store)
+	defer recorder.Close()
+
+	stopSweeper := StartSweeper(store, sweepInterval)
+	defer stopSweeper()
 
 	r.HandleFunc("/__API__/logout", func(w http.ResponseWriter, r *http.Request) {
 		session, err := sessionStore.Get(r, sessionName)
@@ -109,7 +234,14 @@ func StartServer() error {
 			// continue, we may not be able to get it, but we can set it
 		}
 
+		if su, ok := session.Values[sessionUserValue].(SessionUser); ok {
+			if err := lm.EndSession(su); err != nil {
+				log.Printf("%v", err)
+			}
+		}
+
 		session.Values[sessionUserValue] = nil
+		delete(session.Values, sessionPendingLoginValue)
 		err = sessionStore.Save(r, w, session)
 		if err != nil {
 			log.Printf("%v", err)
@@ -136,11 +268,50 @@ func StartServer() error {
 		username := r.FormValue("username")
 		password := r.FormValue("password")
 
+		ip := proxies.ClientIP(r)
+		keys := []ThrottleKey{IPKey(ip), UserKey(username)}
+		if wait := throttle.Attempt(time.Now(), keys...); wait > 0 {
+			session.AddFlash(tooManyAttempts(wait), sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
 		su, err := lm.LogIn(User{
 			Name:     username,
 			Password: []byte(password),
 		})
 
+		if err == ErrNotFound || err == ErrInvalidPassword {
+			throttle.Fail(FailedAttempt{time.Now(), "password", username, ip.String()})
+		} else if err == nil {
+			throttle.Succeed(keys[:1], UserKey(username))
+		} else if err == ErrSecondFactorRequired || err == ErrPendingApproval {
+			// the password was right, but the code still has to be
+			// entered, or the user still has to be approved. When the
+			// password couldn't be checked, the attempt stays counted,
+			// so guessing isn't free while a source is down.
+			throttle.Succeed(keys)
+		}
+
+		if err == ErrPendingApproval {
+			session.AddFlash(err.Error(), sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		if err == ErrSecondFactorRequired {
+			// the index asks for the code, the user is only stored in the
+			// session by /__API__/login2
+			session.Values[sessionPendingLoginValue] = NewPendingLogin(su.Name, time.Now())
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		if err != nil && err != ErrNotFound && err != ErrInvalidPassword {
+			// like ldap being down
+			log.Printf("logging in %s: %v", username, err)
+		}
 		if err != nil {
 			session.AddFlash("unauthorized", sessionMessageValue)
 			_ = sessionStore.Save(r, w, session)
@@ -148,6 +319,15 @@ func StartServer() error {
 			return
 		}
 
+		su, err = lm.StartSession(su.Name, r.UserAgent(), proxies.ClientIP(r).String())
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("server error", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
 		session.Values[sessionUserValue] = su
 
 		err = sessionStore.Save(r, w, session)
@@ -157,7 +337,7 @@ func StartServer() error {
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 	}).Methods("POST")
 
-	r.HandleFunc("/__API__/changepw", func(w http.ResponseWriter, r *http.Request) {
+	r.HandleFunc("/__API__/login2", func(w http.ResponseWriter, r *http.Request) {
 		session, err := sessionStore.Get(r, sessionName)
 		if err != nil {
 			log.Printf("%v", err)
@@ -173,41 +353,47 @@ func StartServer() error {
 			return
 		}
 
-		password := r.FormValue("password")
-		passwordRepeat := r.FormValue("password-repeat")
-
-		if passwordRepeat != password {
-			session.AddFlash("passwords don't match", sessionMessageValue)
+		pending, ok := session.Values[sessionPendingLoginValue].(PendingLogin)
+		if !ok || time.Now().After(pending.Expires) {
+			delete(session.Values, sessionPendingLoginValue)
+			session.AddFlash("log in again, it took too long to enter the code", sessionMessageValue)
 			_ = sessionStore.Save(r, w, session)
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
 		}
 
-		if session.Values[sessionUserValue] == nil {
-			session.AddFlash("unauthorized", sessionMessageValue)
+		ip := proxies.ClientIP(r)
+		keys := []ThrottleKey{IPKey(ip), UserKey(pending.Name)}
+		if wait := throttle.Attempt(time.Now(), keys...); wait > 0 {
+			session.AddFlash(tooManyAttempts(wait), sessionMessageValue)
 			_ = sessionStore.Save(r, w, session)
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
 		}
 
-		su, ok := session.Values[sessionUserValue].(SessionUser)
-		if !ok {
-			session.AddFlash("unauthorized", sessionMessageValue)
+		su, err := lm.SecondFactor(pending.Name, r.FormValue("code"))
+		if err == ErrInvalidCode {
+			throttle.Fail(FailedAttempt{time.Now(), "code", pending.Name, ip.String()})
+		} else if err == nil {
+			throttle.Succeed(keys[:1], UserKey(pending.Name))
+		}
+
+		if err == ErrInvalidCode {
+			session.AddFlash(err.Error(), sessionMessageValue)
 			_ = sessionStore.Save(r, w, session)
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
 		}
-
-		user, err := lm.LoggedIn(su)
 		if err != nil {
 			log.Printf("%v", err)
+			delete(session.Values, sessionPendingLoginValue)
 			session.AddFlash("unauthorized", sessionMessageValue)
 			_ = sessionStore.Save(r, w, session)
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
 		}
 
-		err = lm.ChangePassword(*user, password)
+		su, err = lm.StartSession(su.Name, r.UserAgent(), proxies.ClientIP(r).String())
 		if err != nil {
 			log.Printf("%v", err)
 			session.AddFlash("server error", sessionMessageValue)
@@ -216,14 +402,17 @@ func StartServer() error {
 			return
 		}
 
-		session.Values[sessionUserValue] = nil
-		_ = sessionStore.Save(r, w, session)
+		delete(session.Values, sessionPendingLoginValue)
+		session.Values[sessionUserValue] = su
 
+		err = sessionStore.Save(r, w, session)
+		if err != nil {
+			log.Printf("%v", err)
+		}
 		http.Redirect(w, r, "/", http.StatusSeeOther)
-		return
 	}).Methods("POST")
 
-	r.HandleFunc("/__API__/setadmin", func(w http.ResponseWriter, r *http.Request) {
+	r.HandleFunc("/__API__/totp/begin", func(w http.ResponseWriter, r *http.Request) {
 		session, err := sessionStore.Get(r, sessionName)
 		if err != nil {
 			log.Printf("%v", err)
@@ -254,56 +443,81 @@ func StartServer() error {
 			return
 		}
 
-		if !user.Admin {
-			session.AddFlash("unauthorized", sessionMessageValue)
+		_, err = lm.BeginTOTP(user.Name)
+		if err == ErrTOTPEnabled {
+			session.AddFlash(err.Error(), sessionMessageValue)
 			_ = sessionStore.Save(r, w, session)
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
 		}
-
-		var body struct {
-			Name string `json:"name"`
-			Value bool `json:"value"`
-		}
-
-		err = json.NewDecoder(r.Body).Decode(&body)
 		if err != nil {
-			session.AddFlash("bad request", sessionMessageValue)
+			log.Printf("%v", err)
+			session.AddFlash("server error", sessionMessageValue)
 			_ = sessionStore.Save(r, w, session)
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
 		}
 
-		if body.Name == user.Name {
-			session.AddFlash("can't change your own admin status", sessionMessageValue)
-			_ = sessionStore.Save(r, w, session)
-			http.Redirect(w, r, "/", http.StatusSeeOther)
-			return
+		_ = sessionStore.Save(r, w, session)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}).Methods("POST")
+
+	// the qr code of the secret that is being set up, rendered here so the
+	// secret never goes to another service
+	r.HandleFunc("/__API__/totp/qr.png", func(w http.ResponseWriter, r *http.Request) {
+		session, err := sessionStore.Get(r, sessionName)
+		if err != nil {
+			log.Printf("%v", err)
+			// continue, we may not be able to get it, but we can set it
 		}
 
+		su, ok := session.Values[sessionUserValue].(SessionUser)
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
 
-		err = lm.SetAdmin(body.Name, body.Value)
+		user, err := lm.LoggedIn(su)
 		if err != nil {
 			log.Printf("%v", err)
-			session.AddFlash("server error", sessionMessageValue)
-			_ = sessionStore.Save(r, w, session)
-			http.Redirect(w, r, "/", http.StatusSeeOther)
+			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 
-		_ = sessionStore.Save(r, w, session)
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		if user.TOTPPending == "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
 
-		return
-	}).Methods("POST")
+		png, err := TOTPQRCode(user.Name, user.TOTPPending)
+		if err != nil {
+			log.Printf("%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
 
-	r.HandleFunc("/__API__/rmalias", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Cache-Control", "no-store")
+		_, _ = w.Write(png)
+	}).Methods("GET")
+
+	r.HandleFunc("/__API__/totp/enable", func(w http.ResponseWriter, r *http.Request) {
 		session, err := sessionStore.Get(r, sessionName)
 		if err != nil {
 			log.Printf("%v", err)
 			// continue, we may not be able to get it, but we can set it
 		}
 
+		err = r.ParseForm()
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("bad request", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
 		if session.Values[sessionUserValue] == nil {
 			session.AddFlash("unauthorized", sessionMessageValue)
 			_ = sessionStore.Save(r, w, session)
@@ -328,49 +542,30 @@ func StartServer() error {
 			return
 		}
 
-		body, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			fmt.Printf("%v", err)
-			session.AddFlash("server error", sessionMessageValue)
-			_ = sessionStore.Save(r, w, session)
-			http.Redirect(w, r, "/", http.StatusSeeOther)
-			return
-		}
-		aliasName := string(body)
-
-		alias, err := store.GetAlias(aliasName)
-		if err != nil {
-			fmt.Printf("%v", err)
-			session.AddFlash("server error", sessionMessageValue)
-			_ = sessionStore.Save(r, w, session)
-			http.Redirect(w, r, "/", http.StatusSeeOther)
-			return
-		}
-
-		if alias.Owner != user.Name && !user.Admin {
-			session.AddFlash("unauthorized", sessionMessageValue)
+		codes, err := lm.EnableTOTP(user.Name, r.FormValue("code"))
+		if err == ErrInvalidCode || err == ErrTOTPEnabled || err == ErrTOTPNotEnrolled {
+			session.AddFlash(err.Error(), sessionMessageValue)
 			_ = sessionStore.Save(r, w, session)
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
 		}
-
-		err = store.RmAlias(alias)
 		if err != nil {
-			fmt.Printf("%v", err)
+			log.Printf("%v", err)
 			session.AddFlash("server error", sessionMessageValue)
 			_ = sessionStore.Save(r, w, session)
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
 		}
 
-
-
+		// the recovery codes are shown once by the index
+		session.AddFlash(codes, sessionRecoveryCodesValue)
+		session.AddFlash("two-factor authentication enabled", sessionMessageValue)
 		_ = sessionStore.Save(r, w, session)
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}).Methods("POST")
 
-	r.HandleFunc("/__API__/rmuser", func(w http.ResponseWriter, r *http.Request) {
+	r.HandleFunc("/__API__/totp/cancel", func(w http.ResponseWriter, r *http.Request) {
 		session, err := sessionStore.Get(r, sessionName)
 		if err != nil {
 			log.Printf("%v", err)
@@ -393,24 +588,7 @@ func StartServer() error {
 		}
 
 		user, err := lm.LoggedIn(su)
-		if err != nil{
-			log.Printf("%v", err)
-			session.AddFlash("unauthorized", sessionMessageValue)
-			_ = sessionStore.Save(r, w, session)
-			http.Redirect(w, r, "/", http.StatusSeeOther)
-			return
-		}
-
-		body, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			fmt.Printf("%v", err)
-			session.AddFlash("server error", sessionMessageValue)
-			_ = sessionStore.Save(r, w, session)
-			http.Redirect(w, r, "/", http.StatusSeeOther)
-			return
-		}
-		deleteUserName := string(body)
-		if !user.Admin && user.Name != deleteUserName {
 			log.Printf("%v", err)
 			session.AddFlash("unauthorized", sessionMessageValue)
 			_ = sessionStore.Save(r, w, session)
@@ -418,28 +596,36 @@ func StartServer() error {
 			return
 		}
 
-		err = store.RmUser(deleteUserName)
+		err = lm.CancelTOTP(user.Name)
 		if err != nil {
-			fmt.Printf("%v", err)
+			log.Printf("%v", err)
 			session.AddFlash("server error", sessionMessageValue)
 			_ = sessionStore.Save(r, w, session)
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
 		}
 
-
 		_ = sessionStore.Save(r, w, session)
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}).Methods("POST")
 
-	r.HandleFunc("/__API__/createuser", func(w http.ResponseWriter, r *http.Request) {
+	r.HandleFunc("/__API__/totp/disable", func(w http.ResponseWriter, r *http.Request) {
 		session, err := sessionStore.Get(r, sessionName)
 		if err != nil {
 			log.Printf("%v", err)
 			// continue, we may not be able to get it, but we can set it
 		}
 
+		err = r.ParseForm()
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("bad request", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
 		if session.Values[sessionUserValue] == nil {
 			session.AddFlash("unauthorized", sessionMessageValue)
 			_ = sessionStore.Save(r, w, session)
@@ -456,7 +642,7 @@ func StartServer() error {
 		}
 
 		user, err := lm.LoggedIn(su)
-		if err != nil{
+		if err != nil {
 			log.Printf("%v", err)
 			session.AddFlash("unauthorized", sessionMessageValue)
 			_ = sessionStore.Save(r, w, session)
@@ -464,37 +650,733 @@ func StartServer() error {
 			return
 		}
 
-		if !user.Admin {
-			log.Printf("%v", err)
-			session.AddFlash("unauthorized", sessionMessageValue)
+		err = lm.DisableTOTP(user.Name, r.FormValue("code"))
+		if err == ErrInvalidCode || err == ErrTOTPDisabled {
+			session.AddFlash(err.Error(), sessionMessageValue)
 			_ = sessionStore.Save(r, w, session)
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
 		}
-
-		err = r.ParseForm()
 		if err != nil {
 			log.Printf("%v", err)
-			session.AddFlash("bad request", sessionMessageValue)
+			session.AddFlash("server error", sessionMessageValue)
 			_ = sessionStore.Save(r, w, session)
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
 		}
 
-		username := r.FormValue("username")
-		password := r.FormValue("password")
-		admin := r.FormValue("admin")
-		var adminBool bool
-		if admin == "on" {
-			adminBool = true
-		} else {
-			adminBool = false
-		}
+		session.AddFlash("two-factor authentication disabled", sessionMessageValue)
+		_ = sessionStore.Save(r, w, session)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}).Methods("POST")
 
-		if username == "" {
-			session.AddFlash("username cannot be empty", sessionMessageValue)
-			_ = sessionStore.Save(r, w, session)
-			http.Redirect(w, r, "/", http.StatusSeeOther)
+	// single sign-on sends people to the provider, which sends them back to
+	// the callback
+	r.HandleFunc("/__API__/oidc/login", func(w http.ResponseWriter, r *http.Request) {
+		if sso == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		session, err := sessionStore.Get(r, sessionName)
+		if err != nil {
+			log.Printf("%v", err)
+			// continue, we may not be able to get it, but we can set it
+		}
+
+		url, state, err := sso.Begin(r.Context(), time.Now())
+		if err == ErrOIDCUnavailable {
+			session.AddFlash(err.Error(), sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("server error", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		session.Values[sessionOIDCValue] = state
+		_ = sessionStore.Save(r, w, session)
+		http.Redirect(w, r, url, http.StatusSeeOther)
+	}).Methods("GET")
+
+	r.HandleFunc(oidcCallbackPath, func(w http.ResponseWriter, r *http.Request) {
+		if sso == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		session, err := sessionStore.Get(r, sessionName)
+		if err != nil {
+			log.Printf("%v", err)
+			// continue, we may not be able to get it, but we can set it
+		}
+
+		// the state can only be used once
+		state, _ := session.Values[sessionOIDCValue].(OIDCState)
+		delete(session.Values, sessionOIDCValue)
+
+		if reason := r.FormValue("error"); reason != "" {
+			log.Printf("single sign-on failed: %s %s", reason, r.FormValue("error_description"))
+			session.AddFlash(fmt.Sprintf("single sign-on failed: %s", reason), sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		su, err := sso.Finish(r.Context(), state, r.FormValue("state"), r.FormValue("code"))
+		if err == ErrSecondFactorRequired {
+			// like after a password, the index asks for the code
+			session.Values[sessionPendingLoginValue] = NewPendingLogin(su.Name, time.Now())
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		if err == ErrOIDCState || err == ErrOIDCNoUsername || err == ErrOIDCUserExists || err == ErrOIDCUnavailable {
+			session.AddFlash(err.Error(), sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		if err != nil {
+			log.Printf("single sign-on failed: %v", err)
+			session.AddFlash("single sign-on failed", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		su, err = lm.StartSession(su.Name, r.UserAgent(), proxies.ClientIP(r).String())
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("server error", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		delete(session.Values, sessionPendingLoginValue)
+		session.Values[sessionUserValue] = su
+
+		err = sessionStore.Save(r, w, session)
+		if err != nil {
+			log.Printf("%v", err)
+		}
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	}).Methods("GET")
+
+	// adding a passkey and logging in with one take two requests: the first
+	// returns the options for the browser, with a challenge that is kept in
+	// the session, and the second checks what the authenticator made of it
+	r.HandleFunc("/__API__/webauthn/register/begin", func(w http.ResponseWriter, r *http.Request) {
+		session, err := sessionStore.Get(r, sessionName)
+		if err != nil {
+			log.Printf("%v", err)
+			// continue, we may not be able to get it, but we can set it
+		}
+
+		su, ok := session.Values[sessionUserValue].(SessionUser)
+		if !ok {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		user, err := lm.LoggedIn(su)
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		challenge, options, err := wa.BeginRegistration(user.Name)
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("server error", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		session.Values[sessionWebAuthnValue] = challenge
+		_ = sessionStore.Save(r, w, session)
+		writeJson(w, http.StatusOK, options)
+	}).Methods("POST")
+
+	r.HandleFunc("/__API__/webauthn/register/finish", func(w http.ResponseWriter, r *http.Request) {
+		session, err := sessionStore.Get(r, sessionName)
+		if err != nil {
+			log.Printf("%v", err)
+			// continue, we may not be able to get it, but we can set it
+		}
+
+		if session.Values[sessionUserValue] == nil {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		su, ok := session.Values[sessionUserValue].(SessionUser)
+		if !ok {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		user, err := lm.LoggedIn(su)
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		var body struct {
+			Name       string              `json:"name"`
+			Credential WebAuthnAttestation `json:"credential"`
+		}
+		err = json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("bad request", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		if body.Name == "" {
+			body.Name = "passkey"
+		}
+
+		// a challenge can only be used once
+		challenge, _ := session.Values[sessionWebAuthnValue].(WebAuthnChallenge)
+		delete(session.Values, sessionWebAuthnValue)
+
+		if challenge.Name != user.Name {
+			session.AddFlash(ErrChallengeExpired.Error(), sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		_, err = wa.FinishRegistration(challenge, body.Name, body.Credential)
+		if err == ErrInvalidCredential || err == ErrChallengeExpired || err == ErrCredentialExists || err == ErrUnsupportedKey {
+			session.AddFlash(err.Error(), sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("server error", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		session.AddFlash(fmt.Sprintf("added passkey %s", body.Name), sessionMessageValue)
+		_ = sessionStore.Save(r, w, session)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}).Methods("POST")
+
+	r.HandleFunc("/__API__/webauthn/login/begin", func(w http.ResponseWriter, r *http.Request) {
+		session, err := sessionStore.Get(r, sessionName)
+		if err != nil {
+			log.Printf("%v", err)
+			// continue, we may not be able to get it, but we can set it
+		}
+
+		challenge, options, err := wa.BeginLogin()
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("server error", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		session.Values[sessionWebAuthnValue] = challenge
+		_ = sessionStore.Save(r, w, session)
+		writeJson(w, http.StatusOK, options)
+	}).Methods("POST")
+
+	r.HandleFunc("/__API__/webauthn/login/finish", func(w http.ResponseWriter, r *http.Request) {
+		session, err := sessionStore.Get(r, sessionName)
+		if err != nil {
+			log.Printf("%v", err)
+			// continue, we may not be able to get it, but we can set it
+		}
+
+		var assertion WebAuthnAssertion
+		err = json.NewDecoder(r.Body).Decode(&assertion)
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("bad request", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		challenge, ok := session.Values[sessionWebAuthnValue].(WebAuthnChallenge)
+		delete(session.Values, sessionWebAuthnValue)
+		if !ok {
+			session.AddFlash(ErrChallengeExpired.Error(), sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		su, err := wa.FinishLogin(challenge, assertion)
+		if err == ErrInvalidCredential || err == ErrUnknownCredential || err == ErrChallengeExpired ||
+			err == ErrUnsupportedKey || err == ErrSignCountRegression || err == ErrPendingApproval {
+			session.AddFlash(err.Error(), sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("server error", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		su, err = lm.StartSession(su.Name, r.UserAgent(), proxies.ClientIP(r).String())
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("server error", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		delete(session.Values, sessionPendingLoginValue)
+		session.Values[sessionUserValue] = su
+
+		err = sessionStore.Save(r, w, session)
+		if err != nil {
+			log.Printf("%v", err)
+		}
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	}).Methods("POST")
+
+	r.HandleFunc("/__API__/rmcredential", func(w http.ResponseWriter, r *http.Request) {
+		session, err := sessionStore.Get(r, sessionName)
+		if err != nil {
+			log.Printf("%v", err)
+			// continue, we may not be able to get it, but we can set it
+		}
+
+		if session.Values[sessionUserValue] == nil {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		su, ok := session.Values[sessionUserValue].(SessionUser)
+		if !ok {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		user, err := lm.LoggedIn(su)
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("server error", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		err = lm.RmCredential(user.Name, string(body))
+		if err == ErrUnknownCredential {
+			session.AddFlash("passkey not found", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("server error", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		_ = sessionStore.Save(r, w, session)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}).Methods("POST")
+
+	r.HandleFunc("/__API__/changepw", func(w http.ResponseWriter, r *http.Request) {
+		session, err := sessionStore.Get(r, sessionName)
+		if err != nil {
+			log.Printf("%v", err)
+			// continue, we may not be able to get it, but we can set it
+		}
+
+		err = r.ParseForm()
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("bad request", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		password := r.FormValue("password")
+		passwordRepeat := r.FormValue("password-repeat")
+
+		if passwordRepeat != password {
+			session.AddFlash("passwords don't match", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		if session.Values[sessionUserValue] == nil {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		su, ok := session.Values[sessionUserValue].(SessionUser)
+		if !ok {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		user, err := lm.LoggedIn(su)
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		err = lm.ChangePassword(*user, password)
+		if err == ErrExternalUser {
+			session.AddFlash(err.Error(), sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("server error", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		session.Values[sessionUserValue] = nil
+		_ = sessionStore.Save(r, w, session)
+
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}).Methods("POST")
+
+	r.HandleFunc("/__API__/setadmin", func(w http.ResponseWriter, r *http.Request) {
+		session, err := sessionStore.Get(r, sessionName)
+		if err != nil {
+			log.Printf("%v", err)
+			// continue, we may not be able to get it, but we can set it
+		}
+
+		if session.Values[sessionUserValue] == nil {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		su, ok := session.Values[sessionUserValue].(SessionUser)
+		if !ok {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		user, err := lm.LoggedIn(su)
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		if !user.Admin {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		var body struct {
+			Name string `json:"name"`
+			Value bool `json:"value"`
+		}
+
+		err = json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			session.AddFlash("bad request", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		if body.Name == user.Name {
+			session.AddFlash("can't change your own admin status", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+
+		err = lm.SetAdmin(body.Name, body.Value)
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("server error", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		_ = sessionStore.Save(r, w, session)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+
+		return
+	}).Methods("POST")
+
+	r.HandleFunc("/__API__/rmalias", func(w http.ResponseWriter, r *http.Request) {
+		session, err := sessionStore.Get(r, sessionName)
+		if err != nil {
+			log.Printf("%v", err)
+			// continue, we may not be able to get it, but we can set it
+		}
+
+		if session.Values[sessionUserValue] == nil {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		su, ok := session.Values[sessionUserValue].(SessionUser)
+		if !ok {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		user, err := lm.LoggedIn(su)
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			fmt.Printf("%v", err)
+			session.AddFlash("server error", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		aliasName := string(body)
+
+		alias, err := store.GetAlias(aliasName)
+		if err != nil {
+			fmt.Printf("%v", err)
+			session.AddFlash("server error", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		if alias.Owner != user.Name && !user.Admin {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		err = store.RmAlias(alias)
+		if err != nil {
+			fmt.Printf("%v", err)
+			session.AddFlash("server error", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+
+
+		_ = sessionStore.Save(r, w, session)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}).Methods("POST")
+
+	r.HandleFunc("/__API__/rmuser", func(w http.ResponseWriter, r *http.Request) {
+		session, err := sessionStore.Get(r, sessionName)
+		if err != nil {
+			log.Printf("%v", err)
+			// continue, we may not be able to get it, but we can set it
+		}
+
+		if session.Values[sessionUserValue] == nil {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		su, ok := session.Values[sessionUserValue].(SessionUser)
+		if !ok {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		user, err := lm.LoggedIn(su)
+		if err != nil{
+			log.Printf("%v", err)
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			fmt.Printf("%v", err)
+			session.AddFlash("server error", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		deleteUserName := string(body)
+		if !user.Admin && user.Name != deleteUserName {
+			log.Printf("%v", err)
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		err = store.RmUser(deleteUserName)
+		if err != nil {
+			fmt.Printf("%v", err)
+			session.AddFlash("server error", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+
+		_ = sessionStore.Save(r, w, session)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}).Methods("POST")
+
+	r.HandleFunc("/__API__/createuser", func(w http.ResponseWriter, r *http.Request) {
+		session, err := sessionStore.Get(r, sessionName)
+		if err != nil {
+			log.Printf("%v", err)
+			// continue, we may not be able to get it, but we can set it
+		}
+
+		if session.Values[sessionUserValue] == nil {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		su, ok := session.Values[sessionUserValue].(SessionUser)
+		if !ok {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		user, err := lm.LoggedIn(su)
+		if err != nil{
+			log.Printf("%v", err)
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		if !user.Admin {
+			log.Printf("%v", err)
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		err = r.ParseForm()
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("bad request", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		username := r.FormValue("username")
+		password := r.FormValue("password")
+		admin := r.FormValue("admin")
+		var adminBool bool
+		if admin == "on" {
+			adminBool = true
+		} else {
+			adminBool = false
+		}
+
+		if username == "" {
+			session.AddFlash("username cannot be empty", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
 		}
 
@@ -505,15 +1387,1163 @@ func StartServer() error {
 			Aliases:  nil,
 		})
 		if err != nil {
-			fmt.Printf("%v", err)
+			fmt.Printf("%v", err)
+			session.AddFlash("server error", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		if exists {
+			session.AddFlash("user exists", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		_ = sessionStore.Save(r, w, session)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}).Methods("POST")
+
+	r.HandleFunc("/__API__/register", func(w http.ResponseWriter, r *http.Request) {
+		session, err := sessionStore.Get(r, sessionName)
+		if err != nil {
+			log.Printf("%v", err)
+			// continue, we may not be able to get it, but we can set it
+		}
+
+		err = r.ParseForm()
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("bad request", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		username := r.FormValue("username")
+		email := r.FormValue("email")
+		password := r.FormValue("password")
+		passwordRepeat := r.FormValue("password-repeat")
+
+		if username == "" {
+			session.AddFlash("username cannot be empty", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		if password == "" {
+			session.AddFlash("password cannot be empty", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		if passwordRepeat != password {
+			session.AddFlash("passwords don't match", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		user, err := lm.Register(username, email, password)
+		if err == ErrRegistrationDisabled || err == ErrInvalidEmail || err == ErrEmailNotAllowed || err == ErrUserExists {
+			session.AddFlash(err.Error(), sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("server error", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		if user.Pending {
+			session.AddFlash("signed up, you can log in once an admin has approved your account", sessionMessageValue)
+		} else {
+			session.AddFlash("signed up, you can log in now", sessionMessageValue)
+		}
+		_ = sessionStore.Save(r, w, session)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}).Methods("POST")
+
+	r.HandleFunc("/__API__/approveuser", func(w http.ResponseWriter, r *http.Request) {
+		session, err := sessionStore.Get(r, sessionName)
+		if err != nil {
+			log.Printf("%v", err)
+			// continue, we may not be able to get it, but we can set it
+		}
+
+		if session.Values[sessionUserValue] == nil {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		su, ok := session.Values[sessionUserValue].(SessionUser)
+		if !ok {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		user, err := lm.LoggedIn(su)
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		if !user.Admin {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("server error", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		err = lm.Approve(string(body))
+		if err == ErrNotFound || err == ErrNotPending {
+			session.AddFlash(ErrNotPending.Error(), sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("server error", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		session.AddFlash(fmt.Sprintf("approved %s", string(body)), sessionMessageValue)
+		_ = sessionStore.Save(r, w, session)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}).Methods("POST")
+
+	r.HandleFunc("/__API__/rejectuser", func(w http.ResponseWriter, r *http.Request) {
+		session, err := sessionStore.Get(r, sessionName)
+		if err != nil {
+			log.Printf("%v", err)
+			// continue, we may not be able to get it, but we can set it
+		}
+
+		if session.Values[sessionUserValue] == nil {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		su, ok := session.Values[sessionUserValue].(SessionUser)
+		if !ok {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		user, err := lm.LoggedIn(su)
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		if !user.Admin {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("server error", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		err = lm.Reject(string(body))
+		if err == ErrNotFound || err == ErrNotPending {
+			session.AddFlash(ErrNotPending.Error(), sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("server error", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		session.AddFlash(fmt.Sprintf("rejected %s", string(body)), sessionMessageValue)
+		_ = sessionStore.Save(r, w, session)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}).Methods("POST")
+
+	r.HandleFunc("/__API__/settings", func(w http.ResponseWriter, r *http.Request) {
+		session, err := sessionStore.Get(r, sessionName)
+		if err != nil {
+			log.Printf("%v", err)
+			// continue, we may not be able to get it, but we can set it
+		}
+
+		if session.Values[sessionUserValue] == nil {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		su, ok := session.Values[sessionUserValue].(SessionUser)
+		if !ok {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		user, err := lm.LoggedIn(su)
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		if !user.Admin {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		err = r.ParseForm()
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("bad request", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		settings, err := store.GetSettings()
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("server error", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		registration := r.FormValue("registration")
+		switch registration {
+		case RegistrationDisabled, RegistrationOpen, RegistrationApproval:
+		default:
+			session.AddFlash("not a valid registration mode", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		settings.Registration = registration
+		settings.AllowedDomains = ParseDomains(r.FormValue("domains"))
+		settings.RequireAdminTOTP = r.FormValue("require_admin_totp") == "on"
+
+		err = store.UpdateSettings(settings)
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("server error", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		session.AddFlash("settings saved", sessionMessageValue)
+		_ = sessionStore.Save(r, w, session)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}).Methods("POST")
+
+	// invite links lead here, the index shows a form to create a user with
+	// the invite
+	r.HandleFunc("/__API__/invite/{code}", func(w http.ResponseWriter, r *http.Request) {
+		session, err := sessionStore.Get(r, sessionName)
+		if err != nil {
+			log.Printf("%v", err)
+			// continue, we may not be able to get it, but we can set it
+		}
+
+		session.AddFlash(mux.Vars(r)["code"], sessionInviteValue)
+		_ = sessionStore.Save(r, w, session)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	}).Methods("GET")
+
+	r.HandleFunc("/__API__/acceptinvite", func(w http.ResponseWriter, r *http.Request) {
+		session, err := sessionStore.Get(r, sessionName)
+		if err != nil {
+			log.Printf("%v", err)
+			// continue, we may not be able to get it, but we can set it
+		}
+
+		err = r.ParseForm()
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("bad request", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		code := r.FormValue("code")
+		username := r.FormValue("username")
+		password := r.FormValue("password")
+		passwordRepeat := r.FormValue("password-repeat")
+
+		// the form is shown again after a mistake
+		retry := func(message string) {
+			session.AddFlash(message, sessionMessageValue)
+			session.AddFlash(code, sessionInviteValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+		}
+
+		if username == "" {
+			retry("username cannot be empty")
+			return
+		}
+
+		if password == "" {
+			retry("password cannot be empty")
+			return
+		}
+
+		if passwordRepeat != password {
+			retry("passwords don't match")
+			return
+		}
+
+		user, err := lm.AcceptInvite(code, username, password)
+		if err == ErrUserExists {
+			retry(err.Error())
+			return
+		}
+		if err == ErrInvalidInvite {
+			session.AddFlash(err.Error(), sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("server error", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		su, err := lm.StartSession(user.Name, r.UserAgent(), proxies.ClientIP(r).String())
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("server error", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		session.Values[sessionUserValue] = su
+		session.AddFlash(fmt.Sprintf("welcome, %s", user.Name), sessionMessageValue)
+		_ = sessionStore.Save(r, w, session)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}).Methods("POST")
+
+	r.HandleFunc("/__API__/createinvite", func(w http.ResponseWriter, r *http.Request) {
+		session, err := sessionStore.Get(r, sessionName)
+		if err != nil {
+			log.Printf("%v", err)
+			// continue, we may not be able to get it, but we can set it
+		}
+
+		if session.Values[sessionUserValue] == nil {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		su, ok := session.Values[sessionUserValue].(SessionUser)
+		if !ok {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		user, err := lm.LoggedIn(su)
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		if !user.Admin {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		err = r.ParseForm()
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("bad request", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		expires := time.Now().Add(DefaultInviteExpiry)
+		if days := r.FormValue("expires"); days != "" {
+			n, err := strconv.Atoi(days)
+			if err != nil || n <= 0 {
+				session.AddFlash("expiry must be a positive number of days", sessionMessageValue)
+				_ = sessionStore.Save(r, w, session)
+				http.Redirect(w, r, "/", http.StatusSeeOther)
+				return
+			}
+			expires = time.Now().AddDate(0, 0, n)
+		}
+
+		code, _, err := lm.CreateInvite(user.Name, r.FormValue("note"), r.FormValue("admin") == "on", expires)
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("server error", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		session.AddFlash(code, sessionNewInviteValue)
+		_ = sessionStore.Save(r, w, session)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}).Methods("POST")
+
+	r.HandleFunc("/__API__/rminvite", func(w http.ResponseWriter, r *http.Request) {
+		session, err := sessionStore.Get(r, sessionName)
+		if err != nil {
+			log.Printf("%v", err)
+			// continue, we may not be able to get it, but we can set it
+		}
+
+		if session.Values[sessionUserValue] == nil {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		su, ok := session.Values[sessionUserValue].(SessionUser)
+		if !ok {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		user, err := lm.LoggedIn(su)
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		if !user.Admin {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("server error", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		err = store.RmInvite(string(body))
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("server error", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		_ = sessionStore.Save(r, w, session)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}).Methods("POST")
+
+	r.HandleFunc("/__API__/clearlockout", func(w http.ResponseWriter, r *http.Request) {
+		session, err := sessionStore.Get(r, sessionName)
+		if err != nil {
+			log.Printf("%v", err)
+			// continue, we may not be able to get it, but we can set it
+		}
+
+		if session.Values[sessionUserValue] == nil {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		su, ok := session.Values[sessionUserValue].(SessionUser)
+		if !ok {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		user, err := lm.LoggedIn(su)
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		if !user.Admin {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("server error", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		key, err := ParseThrottleKey(string(body))
+		if err != nil {
+			session.AddFlash("bad request", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		throttle.Clear(key)
+		log.Printf("%s cleared the failed attempts of %s", user.Name, key)
+
+		_ = sessionStore.Save(r, w, session)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}).Methods("POST")
+
+	r.HandleFunc("/__API__/restore", func(w http.ResponseWriter, r *http.Request) {
+		session, err := sessionStore.Get(r, sessionName)
+		if err != nil {
+			log.Printf("%v", err)
+			// continue, we may not be able to get it, but we can set it
+		}
+
+		if session.Values[sessionUserValue] == nil {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		su, ok := session.Values[sessionUserValue].(SessionUser)
+		if !ok {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		user, err := lm.LoggedIn(su)
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		if !user.Admin {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		// the mode comes before the archive in the form, so the archive can
+		// be restored while it is received
+		mr, err := r.MultipartReader()
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("bad request", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		mode := RestoreMerge
+		var report RestoreReport
+		restored := false
+		for !restored {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				log.Printf("%v", err)
+				session.AddFlash("bad request", sessionMessageValue)
+				_ = sessionStore.Save(r, w, session)
+				http.Redirect(w, r, "/", http.StatusSeeOther)
+				return
+			}
+
+			switch part.FormName() {
+			case "mode":
+				value, err := ioutil.ReadAll(io.LimitReader(part, maxFormValueSize))
+				if err != nil {
+					log.Printf("%v", err)
+					session.AddFlash("bad request", sessionMessageValue)
+					_ = sessionStore.Save(r, w, session)
+					http.Redirect(w, r, "/", http.StatusSeeOther)
+					return
+				}
+				mode = string(value)
+			case "backup":
+				if mode != RestoreMerge && mode != RestoreReplace {
+					session.AddFlash("mode must be merge or replace", sessionMessageValue)
+					_ = sessionStore.Save(r, w, session)
+					http.Redirect(w, r, "/", http.StatusSeeOther)
+					return
+				}
+
+				report, err = store.Restore(part, mode)
+				if errors.Is(err, ErrInvalidBackup) || errors.Is(err, ErrSchemaTooNew) {
+					session.AddFlash(err.Error(), sessionMessageValue)
+					_ = sessionStore.Save(r, w, session)
+					http.Redirect(w, r, "/", http.StatusSeeOther)
+					return
+				}
+				if err != nil {
+					log.Printf("%v", err)
+					session.AddFlash("server error", sessionMessageValue)
+					_ = sessionStore.Save(r, w, session)
+					http.Redirect(w, r, "/", http.StatusSeeOther)
+					return
+				}
+				restored = true
+			}
+		}
+
+		if !restored {
+			session.AddFlash("no backup was uploaded", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		session.AddFlash(report.String(), sessionMessageValue)
+		_ = sessionStore.Save(r, w, session)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}).Methods("POST")
+
+	r.HandleFunc("/__API__/createalias", func(w http.ResponseWriter, r *http.Request) {
+		session, err := sessionStore.Get(r, sessionName)
+		if err != nil {
+			log.Printf("%v", err)
+			// continue, we may not be able to get it, but we can set it
+		}
+
+		if session.Values[sessionUserValue] == nil {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		su, ok := session.Values[sessionUserValue].(SessionUser)
+		if !ok {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		user, err := lm.LoggedIn(su)
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		form, err := parseUploadForm(store, w, r, maxUpload)
+		if err == ErrUploadTooLarge {
+			session.AddFlash(uploadTooLarge(maxUpload), sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("bad request", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		created := false
+		defer func() {
+			if !created {
+				form.Discard()
+			}
+		}()
+
+		url := form.FormValue("url")
+		alias := form.FormValue("alias")
+		password := form.FormValue("password")
+
+		expires, err := parseExpiry(form.FormValue("expires"))
+		if err != nil {
+			session.AddFlash("not a valid expiry date", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		if expires != nil && expires.Before(time.Now()) {
+			session.AddFlash("expiry date must be in the future", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		maxUses, err := parseMaxUses(form.FormValue("maxuses"))
+		if err != nil {
+			session.AddFlash(err.Error(), sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		var hashedPassword []byte
+		if password != "" {
+			hashedPassword, err = bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+			if err != nil {
+				log.Printf("%v", err)
+				session.AddFlash("unauthorized", sessionMessageValue)
+				_ = sessionStore.Save(r, w, session)
+				http.Redirect(w, r, "/", http.StatusSeeOther)
+				return
+			}
+		}
+
+		err = validateNewAlias(store, alias)
+		if isAliasError(err) {
+			session.AddFlash(err.Error(), sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		} else if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("server error", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		fileIdentifier := form.File
+
+		if !IsUrl(url) && fileIdentifier == "" {
+			session.AddFlash("not a valid url", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		err = store.CreateAlias(Alias{
+			Owner: user.Name,
+			Url:   url,
+			Alias: alias,
+			Password: hashedPassword,
+			File: fileIdentifier,
+			Expires: expires,
+			MaxUses: maxUses,
+		})
+		if err == ErrAliasTaken {
+			// someone else took the alias after it was validated
+			session.AddFlash(err.Error(), sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		} else if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("server error", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		created = true
+
+		_ = sessionStore.Save(r, w, session)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}).Methods("POST")
+
+	r.HandleFunc("/__API__/updatealias", func(w http.ResponseWriter, r *http.Request) {
+		session, err := sessionStore.Get(r, sessionName)
+		if err != nil {
+			log.Printf("%v", err)
+			// continue, we may not be able to get it, but we can set it
+		}
+
+		if session.Values[sessionUserValue] == nil {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		su, ok := session.Values[sessionUserValue].(SessionUser)
+		if !ok {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		user, err := lm.LoggedIn(su)
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		form, err := parseUploadForm(store, w, r, maxUpload)
+		if err == ErrUploadTooLarge {
+			session.AddFlash(uploadTooLarge(maxUpload), sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("bad request", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		updated := false
+		defer func() {
+			if !updated {
+				form.Discard()
+			}
+		}()
+
+		original := form.FormValue("original")
+		alias, err := store.GetAlias(original)
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("server error", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		if alias == nil {
+			session.AddFlash("alias could not be found", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		if alias.Owner != user.Name && !user.Admin {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		newName := form.FormValue("alias")
+		if newName != original {
+			err = validateNewAlias(store, newName)
+			if isAliasError(err) {
+				session.AddFlash(err.Error(), sessionMessageValue)
+				_ = sessionStore.Save(r, w, session)
+				http.Redirect(w, r, "/", http.StatusSeeOther)
+				return
+			} else if err != nil {
+				log.Printf("%v", err)
+				session.AddFlash("server error", sessionMessageValue)
+				_ = sessionStore.Save(r, w, session)
+				http.Redirect(w, r, "/", http.StatusSeeOther)
+				return
+			}
+			alias.Alias = newName
+		}
+
+		if form.FormValue("removepassword") == "on" {
+			alias.Password = nil
+		} else if password := form.FormValue("password"); password != "" {
+			alias.Password, err = bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+			if err != nil {
+				log.Printf("%v", err)
+				session.AddFlash("server error", sessionMessageValue)
+				_ = sessionStore.Save(r, w, session)
+				http.Redirect(w, r, "/", http.StatusSeeOther)
+				return
+			}
+		}
+
+		alias.Expires, err = parseExpiry(form.FormValue("expires"))
+		if err != nil {
+			session.AddFlash("not a valid expiry date", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		if alias.Expired(time.Now()) {
+			session.AddFlash("expiry date must be in the future", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		alias.MaxUses, err = parseMaxUses(form.FormValue("maxuses"))
+		if err != nil {
+			session.AddFlash(err.Error(), sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		url := form.FormValue("url")
+		if form.File != "" {
+			alias.File = form.File
+			alias.Url = ""
+		} else if url != "" || alias.File == "" {
+			if !IsUrl(url) {
+				session.AddFlash("not a valid url", sessionMessageValue)
+				_ = sessionStore.Save(r, w, session)
+				http.Redirect(w, r, "/", http.StatusSeeOther)
+				return
+			}
+			alias.Url = url
+			alias.File = ""
+		}
+
+		err = store.UpdateAlias(original, *alias)
+		if err == ErrAliasTaken {
+			session.AddFlash(err.Error(), sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		} else if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("server error", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		updated = true
+
+		_ = sessionStore.Save(r, w, session)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}).Methods("POST")
+
+	r.HandleFunc("/__API__/createtoken", func(w http.ResponseWriter, r *http.Request) {
+		session, err := sessionStore.Get(r, sessionName)
+		if err != nil {
+			log.Printf("%v", err)
+			// continue, we may not be able to get it, but we can set it
+		}
+
+		if session.Values[sessionUserValue] == nil {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		su, ok := session.Values[sessionUserValue].(SessionUser)
+		if !ok {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		user, err := lm.LoggedIn(su)
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		err = r.ParseForm()
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("bad request", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		name := r.FormValue("name")
+		if name == "" {
+			session.AddFlash("token name cannot be empty", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		var expires *time.Time
+		if days := r.FormValue("expires"); days != "" {
+			n, err := strconv.Atoi(days)
+			if err != nil || n <= 0 {
+				session.AddFlash("expiry must be a positive number of days", sessionMessageValue)
+				_ = sessionStore.Save(r, w, session)
+				http.Redirect(w, r, "/", http.StatusSeeOther)
+				return
+			}
+			t := time.Now().AddDate(0, 0, n)
+			expires = &t
+		}
+
+		value, _, err := lm.CreateToken(user.Name, name, expires)
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("server error", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		session.AddFlash(value, sessionTokenValue)
+		_ = sessionStore.Save(r, w, session)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}).Methods("POST")
+
+	r.HandleFunc("/__API__/rmtoken", func(w http.ResponseWriter, r *http.Request) {
+		session, err := sessionStore.Get(r, sessionName)
+		if err != nil {
+			log.Printf("%v", err)
+			// continue, we may not be able to get it, but we can set it
+		}
+
+		if session.Values[sessionUserValue] == nil {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		su, ok := session.Values[sessionUserValue].(SessionUser)
+		if !ok {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		user, err := lm.LoggedIn(su)
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Printf("%v", err)
 			session.AddFlash("server error", sessionMessageValue)
 			_ = sessionStore.Save(r, w, session)
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
 		}
 
-		if exists {
-			session.AddFlash("user exists", sessionMessageValue)
+		token, err := store.GetToken(string(body))
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("server error", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		if token == nil || token.Owner != user.Name {
+			session.AddFlash("token not found", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		err = store.RmToken(token.Id)
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("server error", sessionMessageValue)
 			_ = sessionStore.Save(r, w, session)
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
@@ -524,22 +2554,13 @@ func StartServer() error {
 		return
 	}).Methods("POST")
 
-	r.HandleFunc("/__API__/createalias", func(w http.ResponseWriter, r *http.Request) {
+	r.HandleFunc("/__API__/rmsession", func(w http.ResponseWriter, r *http.Request) {
 		session, err := sessionStore.Get(r, sessionName)
 		if err != nil {
 			log.Printf("%v", err)
 			// continue, we may not be able to get it, but we can set it
 		}
 
-		err = r.ParseMultipartForm(100 * 1024 * 1024)
-		if err != nil {
-			log.Printf("%v", err)
-			session.AddFlash("bad request", sessionMessageValue)
-			_ = sessionStore.Save(r, w, session)
-			http.Redirect(w, r, "/", http.StatusSeeOther)
-			return
-		}
-
 		if session.Values[sessionUserValue] == nil {
 			session.AddFlash("unauthorized", sessionMessageValue)
 			_ = sessionStore.Save(r, w, session)
@@ -564,23 +2585,7 @@ func StartServer() error {
 			return
 		}
 
-		url := r.FormValue("url")
-		alias := r.FormValue("alias")
-		password := r.FormValue("password")
-
-		var hashedPassword []byte
-		if password != "" {
-			hashedPassword, err = bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-			if err != nil {
-				log.Printf("%v", err)
-				session.AddFlash("unauthorized", sessionMessageValue)
-				_ = sessionStore.Save(r, w, session)
-				http.Redirect(w, r, "/", http.StatusSeeOther)
-				return
-			}
-		}
-
-		existingAlias, err := store.GetAlias(alias)
+		body, err := ioutil.ReadAll(r.Body)
 		if err != nil {
 			log.Printf("%v", err)
 			session.AddFlash("server error", sessionMessageValue)
@@ -588,87 +2593,121 @@ func StartServer() error {
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
 		}
-		if existingAlias != nil {
-			session.AddFlash("alias name exists", sessionMessageValue)
+
+		err = lm.RevokeSession(user.Name, string(body))
+		if err == ErrNotFound {
+			session.AddFlash("session not found", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("server error", sessionMessageValue)
 			_ = sessionStore.Save(r, w, session)
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
 		}
-		if alias == "__API__" {
-			session.AddFlash("can't use __API__ as alias (used internally)", sessionMessageValue)
+
+		_ = sessionStore.Save(r, w, session)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}).Methods("POST")
+
+	r.HandleFunc("/__API__/rmothersessions", func(w http.ResponseWriter, r *http.Request) {
+		session, err := sessionStore.Get(r, sessionName)
+		if err != nil {
+			log.Printf("%v", err)
+			// continue, we may not be able to get it, but we can set it
+		}
+
+		if session.Values[sessionUserValue] == nil {
+			session.AddFlash("unauthorized", sessionMessageValue)
 			_ = sessionStore.Save(r, w, session)
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
 		}
 
-		if alias == "" {
-			session.AddFlash("alias name can't be empty", sessionMessageValue)
+		su, ok := session.Values[sessionUserValue].(SessionUser)
+		if !ok {
+			session.AddFlash("unauthorized", sessionMessageValue)
 			_ = sessionStore.Save(r, w, session)
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
 		}
 
-		if !IsValidAlias(alias) {
+		_, err = lm.LoggedIn(su)
+		if err != nil {
 			log.Printf("%v", err)
-			session.AddFlash("not a valid url", sessionMessageValue)
+			session.AddFlash("unauthorized", sessionMessageValue)
 			_ = sessionStore.Save(r, w, session)
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
 		}
 
-		file, handler, err := r.FormFile("file")
-		fileIdentifier := ""
-		if err != nil && err != http.ErrMissingFile {
+		err = lm.RevokeOtherSessions(su)
+		if err != nil {
 			log.Printf("%v", err)
 			session.AddFlash("server error", sessionMessageValue)
 			_ = sessionStore.Save(r, w, session)
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
-		} else if err == nil {
-			defer file.Close()
+		}
 
-			fileIdentifier = fmt.Sprintf("%s:%s", handler.Filename, RandSeq(20))
-			fmt.Printf("Uploaded File: %+v\n", handler.Filename)
-			fmt.Printf("File Size: %+v\n", handler.Size)
-			fmt.Printf("MIME Header: %+v\n", handler.Header)
-			fmt.Printf("FileIdentifier: %+v\n", fileIdentifier)
+		session.AddFlash("you have been logged out everywhere else", sessionMessageValue)
+		_ = sessionStore.Save(r, w, session)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}).Methods("POST")
 
-			data, err := ioutil.ReadAll(file)
-			if err != nil {
-				log.Printf("%v", err)
-				session.AddFlash("bad request", sessionMessageValue)
-				_ = sessionStore.Save(r, w, session)
-				http.Redirect(w, r, "/", http.StatusSeeOther)
-			}
+	r.HandleFunc("/__API__/logoutuser", func(w http.ResponseWriter, r *http.Request) {
+		session, err := sessionStore.Get(r, sessionName)
+		if err != nil {
+			log.Printf("%v", err)
+			// continue, we may not be able to get it, but we can set it
+		}
 
-			err = store.CreateFile(fileIdentifier, File{
-				Data: data,
-				Mime: handler.Header,
-			})
+		if session.Values[sessionUserValue] == nil {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
 
-			if err != nil {
-				log.Printf("%v", err)
-				session.AddFlash("server error", sessionMessageValue)
-				_ = sessionStore.Save(r, w, session)
-				http.Redirect(w, r, "/", http.StatusSeeOther)
-			}
+		su, ok := session.Values[sessionUserValue].(SessionUser)
+		if !ok {
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
 		}
 
+		user, err := lm.LoggedIn(su)
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("unauthorized", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
 
-		if !IsUrl(url) && fileIdentifier == "" {
-			session.AddFlash("not a valid url", sessionMessageValue)
+		if !user.Admin {
+			session.AddFlash("unauthorized", sessionMessageValue)
 			_ = sessionStore.Save(r, w, session)
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
 		}
 
-		err = store.CreateAlias(Alias{
-			Owner: user.Name,
-			Url:   url,
-			Alias: alias,
-			Password: hashedPassword,
-			File: fileIdentifier,
-		})
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Printf("%v", err)
+			session.AddFlash("server error", sessionMessageValue)
+			_ = sessionStore.Save(r, w, session)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		err = lm.RevokeSessions(string(body))
 		if err != nil {
 			log.Printf("%v", err)
 			session.AddFlash("server error", sessionMessageValue)
@@ -677,11 +2716,15 @@ func StartServer() error {
 			return
 		}
 
+		log.Printf("%s logged out %s everywhere", user.Name, string(body))
+		session.AddFlash(fmt.Sprintf("%s has been logged out everywhere", string(body)), sessionMessageValue)
 		_ = sessionStore.Save(r, w, session)
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}).Methods("POST")
 
+	registerApi(r, store, lm, sessionStore, base, maxUpload)
+
 	r.HandleFunc("/__API__/dropzone.js", func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, "static/dropzone.min.js")
 	}).Methods("GET")
@@ -702,7 +2745,11 @@ func StartServer() error {
 				return
 			}
 			user, err = lm.LoggedIn(su)
-			if err != nil {
+			if err == ErrSessionRevoked {
+				// logged out somewhere else, or by an admin
+				session.Values[sessionUserValue] = nil
+				session.AddFlash(err.Error(), sessionMessageValue)
+			} else if err != nil {
 				log.Printf("%v", err)
 				session.Values[sessionUserValue] = nil
 				_ = sessionStore.Save(r, w, session)
@@ -724,9 +2771,75 @@ func StartServer() error {
 			return
 		}
 
+		newTokensI := session.Flashes(sessionTokenValue)
+		newToken := ""
+		if len(newTokensI) > 0 {
+			newToken, _ = newTokensI[0].(string)
+		}
+
+		// an invite link was opened
+		var invite *Invite
+		inviteCodesI := session.Flashes(sessionInviteValue)
+		inviteCode := ""
+		if len(inviteCodesI) > 0 && user == nil {
+			inviteCode, _ = inviteCodesI[0].(string)
+			invite, err = lm.CheckInvite(inviteCode)
+			if err == ErrInvalidInvite {
+				messages = append(messages, err.Error())
+			} else if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+
+		// recovery codes of two-factor authentication that was just enabled
+		var recoveryCodes []string
+		recoveryCodesI := session.Flashes(sessionRecoveryCodesValue)
+		if len(recoveryCodesI) > 0 {
+			recoveryCodes, _ = recoveryCodesI[0].([]string)
+		}
+
+		// the name of the single sign-on provider, if there is one
+		ssoName := ""
+		if sso != nil {
+			ssoName = sso.Name()
+		}
+
+		// logged in with a password, but the code still has to be entered
+		var pendingLogin *PendingLogin
+		if pending, ok := session.Values[sessionPendingLoginValue].(PendingLogin); ok && user == nil {
+			if time.Now().After(pending.Expires) {
+				delete(session.Values, sessionPendingLoginValue)
+			} else {
+				pendingLogin = &pending
+			}
+		}
+
+		newInvitesI := session.Flashes(sessionNewInviteValue)
+		newInvite := ""
+		if len(newInvitesI) > 0 {
+			newInvite, _ = newInvitesI[0].(string)
+		}
+
 		var aliases []Alias
 		var users []User
+		var invites []Invite
+		var tokens []Token
+		var stats map[string]AliasStats
 		var randomPassword string
+		var pendingUsers []User
+		var sessions []LoginSession
+		var currentSession string
+		var lockouts []Lockout
+		var failedAttempts []FailedAttempt
+
+		settings, err := store.GetSettings()
+		if err != nil {
+			log.Printf("%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
 
 		if user != nil {
 			aliases, err = store.GetUserAliases(user)
@@ -736,8 +2849,47 @@ func StartServer() error {
 				return
 			}
 
+			tokens, err = store.GetUserTokens(user.Name)
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			sessions, err = store.GetUserSessions(user.Name)
+			if err != nil {
+				log.Printf("%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			currentSession = session.Values[sessionUserValue].(SessionUser).Session
+
+			stats = make(map[string]AliasStats, len(aliases))
+			for _, alias := range aliases {
+				stats[alias.Alias], err = store.GetAliasStats(alias.Alias, statsDays, time.Now())
+				if err != nil {
+					log.Printf("%v", err)
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+			}
+
 			if user.Admin {
-				users, err = store.GetUsers()
+				all, err := store.GetUsers()
+				if err != nil {
+					log.Printf("%v", err)
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				for _, u := range all {
+					if u.Pending {
+						pendingUsers = append(pendingUsers, u)
+					} else {
+						users = append(users, u)
+					}
+				}
+
+				invites, err = store.GetInvites()
 				if err != nil {
 					log.Printf("%v", err)
 					w.WriteHeader(http.StatusInternalServerError)
@@ -745,9 +2897,19 @@ func StartServer() error {
 				}
 
 				randomPassword = RandSeq(8, "abcdefghijklmnopqrstuvwxyz")
+
+				lockouts = throttle.Lockouts(time.Now())
+				failedAttempts = throttle.FailedAttempts()
 			}
 		}
 
+		token, err := csrfToken(session)
+		if err != nil {
+			log.Printf("%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
 		_ = sessionStore.Save(r, w, session)
 
 		err = index.Execute(w, struct {
@@ -758,14 +2920,53 @@ func StartServer() error {
 			BaseUrl string
 			Users []User
 			RandomPassword string
+			Tokens []Token
+			NewToken string
+			Stats map[string]AliasStats
+			PendingUsers []User
+			Settings Settings
+			Invite *Invite
+			InviteCode string
+			Invites []Invite
+			NewInvite string
+			RecoveryCodes []string
+			PendingLogin *PendingLogin
+			SSO string
+			Sessions []LoginSession
+			CurrentSession string
+			CSRF string
+			Lockouts []Lockout
+			FailedAttempts []FailedAttempt
+			Now time.Time
+			// MaxUpload is the largest file that can be uploaded, in bytes.
+			MaxUpload int64
 		}{
 			user,
 			messages,
 			randomAlias,
 			aliases,
-			BaseUrl,
+			base,
 			users,
 			randomPassword,
+			tokens,
+			newToken,
+			stats,
+			pendingUsers,
+			settings,
+			invite,
+			inviteCode,
+			invites,
+			newInvite,
+			recoveryCodes,
+			pendingLogin,
+			ssoName,
+			sessions,
+			currentSession,
+			token,
+			lockouts,
+			failedAttempts,
+			time.Now(),
+			maxUpload,
 		})
 		if err != nil {
 			log.Printf("%v", err)
@@ -800,6 +3001,19 @@ func StartServer() error {
 			return
 		}
 
+		if alias.Expired(time.Now()) || alias.UsedUp() {
+			http.Error(w, "Gone", http.StatusGone)
+			return
+		}
+
+
+		click := Click{
+			Alias:      alias.Alias,
+			Time:       time.Now(),
+			Referrer:   referrerHost(r.Referer()),
+			Agent:      userAgentClass(r.UserAgent()),
+			Authorized: true,
+		}
 
 		if alias.Password != nil {
 			_, password, ok := r.BasicAuth()
@@ -810,25 +3024,68 @@ func StartServer() error {
 				return
 			}
 
+			ip := proxies.ClientIP(r)
+			keys := []ThrottleKey{IPKey(ip), AliasKey(alias.Alias)}
+			if wait := throttle.Attempt(time.Now(), keys...); wait > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(retryAfter(wait)))
+				http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+				return
+			}
+
 			err := bcrypt.CompareHashAndPassword(alias.Password, []byte(password))
 			if err != nil {
+				throttle.Fail(FailedAttempt{time.Now(), "alias password", alias.Alias, ip.String()})
+
+				click.Authorized = false
+				recorder.Record(click)
+
 				w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
 				http.Error(w, "Unauthorized", http.StatusUnauthorized)
 				return
 			}
+			throttle.Succeed(keys[:1], AliasKey(alias.Alias))
+
+		}
 
+		if alias.MaxUses > 0 {
+			alias, err = store.UseAlias(alias.Alias)
+			if err == ErrAliasUsedUp {
+				http.Error(w, "Gone", http.StatusGone)
+				return
+			}
+			if err != nil {
+				log.Printf("%v", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
 		}
 
+		recorder.Record(click)
+
+		// browsers cache permanent redirects, after which they never come
+		// back to count clicks or find out an alias was changed, expired or
+		// used up. Files have to be checked with the server every time for
+		// the same reason.
 		if alias.File == "" {
-			http.Redirect(w, r, alias.Url, http.StatusPermanentRedirect)
+			w.Header().Set("Cache-Control", "no-store")
+			http.Redirect(w, r, alias.Url, http.StatusFound)
 		} else {
-			file, err := store.GetFile(alias.File)
+			file, data, err := store.OpenFile(alias.File)
 			if err != nil {
 				session.AddFlash("file not found", sessionMessageValue)
 				_ = sessionStore.Save(r, w, session)
 				http.Redirect(w, r, "/", http.StatusSeeOther)
 				return
 			}
+			defer data.Close()
+
+			if alias.UsedUp() {
+				// this was the last use, nobody can download the file anymore.
+				// The contents can still be read through data after removing it.
+				if err := store.RmFile(alias.File); err != nil {
+					log.Printf("%v", err)
+				}
+			}
 
 			h := w.Header()
 			for name, values := range file.Mime {
@@ -836,17 +3093,25 @@ func StartServer() error {
 					h.Add(name, value)
 				}
 			}
-
-			index := 0
-			for index < len(file.Data) {
-				b, err := w.Write(file.Data[index:])
-				if err != nil {
-					w.WriteHeader(http.StatusInternalServerError)
-					return
+			if len(file.Hash) > 0 {
+				h.Set("ETag", fmt.Sprintf(`"%s"`, hex.EncodeToString(file.Hash)))
+			}
+			h.Set("Cache-Control", "no-cache")
+
+			if alias.MaxUses > 0 {
+				// every request uses up the alias a bit more, so only ever
+				// serve the whole file. Otherwise a partial download, or a
+				// 304 or 412 to a conditional request, could take the last
+				// use, after which the file is gone.
+				for _, name := range []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since"} {
+					r.Header.Del(name)
 				}
-				index += b
+				h.Set("Cache-Control", "no-store")
 			}
-			w.WriteHeader(http.StatusOK)
+
+			// handles range requests and conditional requests using the
+			// ETag and the upload time of the file
+			http.ServeContent(w, r, filename(alias.File), file.Created, data)
 		}
 
 	}).Methods("GET")
@@ -856,6 +3121,70 @@ func StartServer() error {
 	return http.ListenAndServe(url, r)
 }
 
+var (
+	ErrAliasTaken    = errors.New("alias is already taken")
+	ErrAliasReserved = errors.New("can't use __API__ as alias (used internally)")
+	ErrAliasEmpty    = errors.New("alias name can't be empty")
+	ErrAliasInvalid  = errors.New("not a valid alias")
+	ErrAliasUsedUp   = errors.New("alias has been used up")
+)
+
+// isAliasError reports whether err is one of the alias validation errors, which
+// can be shown to the user as is.
+func isAliasError(err error) bool {
+	return err == ErrAliasTaken || err == ErrAliasReserved || err == ErrAliasEmpty || err == ErrAliasInvalid
+}
+
+// validateNewAlias checks whether a new alias can be created with the given name.
+func validateNewAlias(store Store, alias string) error {
+	if alias == "__API__" {
+		return ErrAliasReserved
+	}
+	if alias == "" {
+		return ErrAliasEmpty
+	}
+	if !IsValidAlias(alias) {
+		return ErrAliasInvalid
+	}
+
+	existingAlias, err := store.GetAlias(alias)
+	if err != nil {
+		return err
+	}
+	if existingAlias != nil {
+		return ErrAliasTaken
+	}
+
+	return nil
+}
+
+// parseMaxUses parses the maximum number of uses of an alias. An empty value
+// means there is no limit.
+func parseMaxUses(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	res, err := strconv.Atoi(value)
+	if err != nil || res < 0 {
+		return 0, errors.New("maximum number of uses must be a positive number")
+	}
+
+	return res, nil
+}
+
+// filename returns the original name of an uploaded file from its identifier,
+// which has the form name:random.
+func filename(identifier string) string {
+	for i := len(identifier)-1; i >= 0; i-- {
+		if identifier[i] == ':' {
+			return identifier[:i]
+		}
+	}
+
+	return identifier
+}
+
 func IsValidAlias(alias string) bool {
 	for _, c := range alias {
 		switch {
@@ -0,0 +1,179 @@
+package server
+
+import (
+	crand "crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Session cookies are signed and encrypted with keys that are kept in the
+// store, so restarting doesn't log everyone out. There can be more than one
+// key: the first one is used for new cookies, the others can still be read.
+// That way keys can be rotated without logging anyone out, old keys are
+// dropped once the cookies they made have expired. Like the sessions they are
+// for, they aren't part of backups.
+
+const sessionKeysKey = "sessionkeys"
+
+const sessionHashKeyLength = 64
+
+// 32 bytes picks AES-256.
+const sessionBlockKeyLength = 32
+
+var ErrSessionKeysFromEnv = errors.New("the session keys are set with SESSION_KEY, rotate them there")
+
+// SessionKey is a pair of keys for session cookies.
+type SessionKey struct {
+	// Hash signs cookies.
+	Hash []byte
+	// Block encrypts cookies. Cookies aren't encrypted when it is empty.
+	Block   []byte `json:",omitempty"`
+	Created time.Time
+}
+
+func NewSessionKey(now time.Time) (SessionKey, error) {
+	res := SessionKey{
+		Hash:    make([]byte, sessionHashKeyLength),
+		Block:   make([]byte, sessionBlockKeyLength),
+		Created: now,
+	}
+
+	if _, err := crand.Read(res.Hash); err != nil {
+		return SessionKey{}, err
+	}
+	if _, err := crand.Read(res.Block); err != nil {
+		return SessionKey{}, err
+	}
+
+	return res, nil
+}
+
+// GetSessionKeys returns the stored keys, the one that is used for new cookies
+// first. It returns none when no keys have been made yet.
+func (s kvStore) GetSessionKeys() ([]SessionKey, error) {
+	var res []SessionKey
+	return res, s.db.View(func(txn kvTxn) error {
+		err := getJson(txn, []byte(sessionKeysKey), &res)
+		if err == ErrNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+func (s kvStore) UpdateSessionKeys(keys []SessionKey) error {
+	return s.db.Update(func(txn kvTxn) error {
+		return setJson(txn, []byte(sessionKeysKey), &keys)
+	})
+}
+
+// RotateSessionKeys makes a new key for new cookies. The old keys are kept
+// until the cookies they made have expired.
+func RotateSessionKeys(store Store, now time.Time) ([]SessionKey, error) {
+	keys, err := store.GetSessionKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := NewSessionKey(now)
+	if err != nil {
+		return nil, err
+	}
+
+	res := []SessionKey{key}
+	for i, old := range keys {
+		// a key has been replaced since the key before it was made, its
+		// cookies expire like sessions do
+		replaced := now
+		if i > 0 {
+			replaced = keys[i-1].Created
+		}
+		if now.Sub(replaced) > sessionIdleTimeout {
+			break
+		}
+		res = append(res, old)
+	}
+
+	return res, store.UpdateSessionKeys(res)
+}
+
+// sessionKeys returns the key pairs of the session cookie store. They come
+// from SESSION_KEY and SESSION_ENCRYPTION_KEY when those are set, and from the
+// store otherwise, where they are made on the first start.
+func sessionKeys(store Store) ([][]byte, error) {
+	keys, err := SessionKeysFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	if keys == nil {
+		keys, err = store.GetSessionKeys()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(keys) == 0 {
+		keys, err = RotateSessionKeys(store, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("made a new session key")
+	}
+
+	var res [][]byte
+	for _, key := range keys {
+		res = append(res, key.Hash, key.Block)
+	}
+
+	return res, nil
+}
+
+// SessionKeysFromEnv reads SESSION_KEY and SESSION_ENCRYPTION_KEY, which can
+// both be a comma or space separated list of keys to rotate them. The first
+// key is used for new cookies. The encryption keys go with the signing keys in
+// the same place, and have to be 16, 24 or 32 characters long. It returns nil
+// when SESSION_KEY isn't set.
+func SessionKeysFromEnv() ([]SessionKey, error) {
+	hashKeys := splitKeys(os.Getenv("SESSION_KEY"))
+	blockKeys := splitKeys(os.Getenv("SESSION_ENCRYPTION_KEY"))
+	if len(hashKeys) == 0 {
+		if len(blockKeys) != 0 {
+			return nil, errors.New("SESSION_ENCRYPTION_KEY is set without SESSION_KEY")
+		}
+		return nil, nil
+	}
+	if len(blockKeys) > len(hashKeys) {
+		return nil, errors.New("SESSION_ENCRYPTION_KEY has more keys than SESSION_KEY")
+	}
+
+	var res []SessionKey
+	for i, hash := range hashKeys {
+		key := SessionKey{
+			Hash: []byte(hash),
+		}
+
+		if i < len(blockKeys) {
+			switch len(blockKeys[i]) {
+			case 16, 24, 32:
+				key.Block = []byte(blockKeys[i])
+			default:
+				return nil, fmt.Errorf("session encryption key %d is %d characters long, it has to be 16, 24 or 32", i+1, len(blockKeys[i]))
+			}
+		}
+
+		res = append(res, key)
+	}
+
+	return res, nil
+}
+
+func splitKeys(value string) []string {
+	return strings.FieldsFunc(value, func(c rune) bool {
+		return c == ',' || c == ' '
+	})
+}
@@ -0,0 +1,319 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Every login gets a session record in the store, which the session cookie
+// points to. Removing the record logs out whoever has the cookie, so users can
+// log out devices they lost and changing a password logs out everyone who
+// still knew the old one.
+
+const sessionPrefix = "session_"
+const sessionIdLength = 32
+
+// Sessions that haven't been used for this long are removed, like the cookie
+// that points to them.
+const sessionIdleTimeout = 30 * 24 * time.Hour
+
+// Last seen timestamps are only written when they are older than this, so
+// browsing around doesn't cause a write for every request.
+const sessionTouchInterval = time.Minute
+
+var ErrSessionRevoked = errors.New("you have been logged out")
+
+// LoginSession is a login of a user on a device.
+type LoginSession struct {
+	Id       string
+	Owner    string
+	Created  time.Time
+	LastSeen time.Time
+	// Agent is the user agent of the browser that logged in.
+	Agent string
+	IP    string
+}
+
+func (s LoginSession) Expired(now time.Time) bool {
+	return now.Sub(s.LastSeen) > sessionIdleTimeout
+}
+
+// Device describes the browser and operating system of the session, like
+// "Firefox on Linux".
+func (s LoginSession) Device() string {
+	return describeAgent(s.Agent)
+}
+
+func (s kvStore) CreateSession(session LoginSession) error {
+	return s.db.Update(func(txn kvTxn) error {
+		return setJson(txn, prefix(sessionPrefix, session.Id), &session)
+	})
+}
+
+func (s kvStore) GetSession(id string) (*LoginSession, error) {
+	var res *LoginSession
+	return res, s.db.View(func(txn kvTxn) error {
+		err := getJson(txn, prefix(sessionPrefix, id), &res)
+		if err == ErrNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+// GetUserSessions returns the sessions of owner, the last seen first.
+func (s kvStore) GetUserSessions(owner string) ([]LoginSession, error) {
+	var res []LoginSession
+	err := s.db.View(func(txn kvTxn) error {
+		return iterateValues(txn, []byte(sessionPrefix), func(key []byte, val []byte) error {
+			var session LoginSession
+			if err := decodeJson(val, &session); err != nil {
+				return err
+			}
+
+			if session.Owner == owner {
+				res = append(res, session)
+			}
+			return nil
+		})
+	})
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].LastSeen.After(res[j].LastSeen)
+	})
+
+	return res, err
+}
+
+// TouchSession marks a session as seen at now. Pages load several things at
+// once with the same session, so conflicting updates are tried again.
+func (s kvStore) TouchSession(id string, now time.Time) error {
+	return s.update(func(txn kvTxn, remove func(blob string)) error {
+		var session LoginSession
+		err := getJson(txn, prefix(sessionPrefix, id), &session)
+		if err != nil {
+			return err
+		}
+
+		session.LastSeen = now
+
+		return setJson(txn, prefix(sessionPrefix, session.Id), &session)
+	})
+}
+
+func (s kvStore) RmSession(id string) error {
+	return s.db.Update(func(txn kvTxn) error {
+		return txn.Delete(prefix(sessionPrefix, id))
+	})
+}
+
+func (s kvStore) RmUserSessions(owner string) error {
+	return s.db.Update(func(txn kvTxn) error {
+		return s.rmSessions(txn, func(session LoginSession) bool {
+			return session.Owner == owner
+		})
+	})
+}
+
+// RmExpiredSessions removes the sessions that expired before now, and returns
+// how many were removed.
+func (s kvStore) RmExpiredSessions(now time.Time) (int, error) {
+	removed := 0
+	err := s.db.Update(func(txn kvTxn) error {
+		removed = 0
+		return s.rmSessions(txn, func(session LoginSession) bool {
+			if session.Expired(now) {
+				removed += 1
+				return true
+			}
+			return false
+		})
+	})
+
+	return removed, err
+}
+
+// rmSessions removes the sessions that match as part of txn.
+func (s kvStore) rmSessions(txn kvTxn, match func(session LoginSession) bool) error {
+	var toRemove [][]byte
+
+	err := iterateValues(txn, []byte(sessionPrefix), func(key []byte, val []byte) error {
+		var session LoginSession
+		if err := decodeJson(val, &session); err != nil {
+			return err
+		}
+
+		if match(session) {
+			toRemove = append(toRemove, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range toRemove {
+		if err := txn.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// StartSession logs in name on the device with the user agent agent and ip.
+func (lm LoginManager) StartSession(name string, agent string, ip string) (SessionUser, error) {
+	id, err := SecureRandSeq(sessionIdLength)
+	if err != nil {
+		return SessionUser{}, err
+	}
+
+	now := time.Now()
+	err = lm.store.CreateSession(LoginSession{
+		Id:       id,
+		Owner:    name,
+		Created:  now,
+		LastSeen: now,
+		Agent:    agent,
+		IP:       ip,
+	})
+	if err != nil {
+		return SessionUser{}, err
+	}
+
+	return SessionUser{
+		Name:    name,
+		Session: id,
+	}, nil
+}
+
+// checkSession returns ErrSessionRevoked when the session of su has been
+// removed or has expired, and marks it as seen otherwise.
+func (lm LoginManager) checkSession(su SessionUser) error {
+	if su.Session == "" {
+		return ErrSessionRevoked
+	}
+
+	session, err := lm.store.GetSession(su.Session)
+	if err != nil {
+		return err
+	}
+	if session == nil || session.Owner != su.Name {
+		return ErrSessionRevoked
+	}
+
+	now := time.Now()
+	if session.Expired(now) {
+		return ErrSessionRevoked
+	}
+
+	if now.Sub(session.LastSeen) > sessionTouchInterval {
+		// when it was last seen is only shown to the user, failing to
+		// store it doesn't have to fail the request
+		err := lm.store.TouchSession(session.Id, now)
+		if err == ErrNotFound {
+			return ErrSessionRevoked
+		} else if err != nil {
+			log.Printf("failed to mark a session of %s as seen: %v", session.Owner, err)
+		}
+	}
+
+	return nil
+}
+
+// EndSession logs out the session of su.
+func (lm LoginManager) EndSession(su SessionUser) error {
+	if su.Session == "" {
+		return nil
+	}
+	return lm.store.RmSession(su.Session)
+}
+
+// RevokeSession logs out one of the sessions of name. It returns ErrNotFound
+// when name has no session with that id.
+func (lm LoginManager) RevokeSession(name string, id string) error {
+	session, err := lm.store.GetSession(id)
+	if err != nil {
+		return err
+	}
+	if session == nil || session.Owner != name {
+		return ErrNotFound
+	}
+
+	return lm.store.RmSession(id)
+}
+
+// RevokeOtherSessions logs out the user of su everywhere but in su.
+func (lm LoginManager) RevokeOtherSessions(su SessionUser) error {
+	sessions, err := lm.store.GetUserSessions(su.Name)
+	if err != nil {
+		return err
+	}
+
+	for _, session := range sessions {
+		if session.Id == su.Session {
+			continue
+		}
+		if err := lm.store.RmSession(session.Id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RevokeSessions logs out name everywhere.
+func (lm LoginManager) RevokeSessions(name string) error {
+	return lm.store.RmUserSessions(name)
+}
+
+// describeAgent makes a user agent readable. It only knows the common browsers,
+// anything else is shown by its first product.
+func describeAgent(agent string) string {
+	if strings.TrimSpace(agent) == "" {
+		return "unknown device"
+	}
+
+	var browser string
+	switch {
+	case strings.Contains(agent, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(agent, "OPR/"):
+		browser = "Opera"
+	case strings.Contains(agent, "Firefox/"), strings.Contains(agent, "FxiOS/"):
+		browser = "Firefox"
+	case strings.Contains(agent, "Chrome/"), strings.Contains(agent, "CriOS/"):
+		browser = "Chrome"
+	case strings.Contains(agent, "Safari/"):
+		browser = "Safari"
+	default:
+		product := strings.Fields(agent)[0]
+		if i := strings.IndexByte(product, '/'); i >= 0 {
+			product = product[:i]
+		}
+		return product
+	}
+
+	var os string
+	switch {
+	case strings.Contains(agent, "iPhone"), strings.Contains(agent, "iPad"):
+		os = "iOS"
+	case strings.Contains(agent, "Android"):
+		os = "Android"
+	case strings.Contains(agent, "Windows"):
+		os = "Windows"
+	case strings.Contains(agent, "Mac OS X"):
+		os = "macOS"
+	case strings.Contains(agent, "CrOS"):
+		os = "ChromeOS"
+	case strings.Contains(agent, "Linux"):
+		os = "Linux"
+	default:
+		return browser
+	}
+
+	return browser + " on " + os
+}
@@ -0,0 +1,55 @@
+package server
+
+// Settings that admins can change in the admin panel are kept in a single
+// record, so they are part of backups like everything else.
+const settingsKey = "settings"
+
+// How new users can sign up.
+const (
+	// RegistrationDisabled only lets admins create users. It is the default.
+	RegistrationDisabled = "disabled"
+	// RegistrationOpen lets anyone sign up and log in right away.
+	RegistrationOpen = "open"
+	// RegistrationApproval lets anyone sign up, but they can only log in
+	// once an admin has approved them.
+	RegistrationApproval = "approval"
+)
+
+type Settings struct {
+	// Registration is one of RegistrationDisabled, RegistrationOpen or
+	// RegistrationApproval. Empty is the same as RegistrationDisabled.
+	Registration string
+	// AllowedDomains are the domains of the email addresses people can sign
+	// up with. When there are none, any address can be used.
+	AllowedDomains []string `json:",omitempty"`
+	// RequireAdminTOTP makes admins set up two-factor authentication before
+	// they can do anything only admins can do.
+	RequireAdminTOTP bool `json:",omitempty"`
+}
+
+// RegistrationMode returns how new users can sign up.
+func (s Settings) RegistrationMode() string {
+	switch s.Registration {
+	case RegistrationOpen, RegistrationApproval:
+		return s.Registration
+	default:
+		return RegistrationDisabled
+	}
+}
+
+func (s kvStore) GetSettings() (Settings, error) {
+	var res Settings
+	return res, s.db.View(func(txn kvTxn) error {
+		err := getJson(txn, []byte(settingsKey), &res)
+		if err == ErrNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+func (s kvStore) UpdateSettings(settings Settings) error {
+	return s.db.Update(func(txn kvTxn) error {
+		return setJson(txn, []byte(settingsKey), &settings)
+	})
+}
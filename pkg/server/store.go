@@ -1,12 +1,11 @@
 package server
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
-	"github.com/dgraph-io/badger"
+	"io"
 	"log"
 	"net/textproto"
+	"time"
 )
 
 const userPrefix = "user_"
@@ -18,21 +17,218 @@ func prefix(prefix string, key string) []byte {
 	return []byte(fmt.Sprintf("%s%s", prefix, key))
 }
 
-type Store struct {
-	db *badger.DB
+// Store keeps users, their aliases and the files behind them, api tokens,
+// sessions and clicks. All backends share the same implementation on top of a kv, they only
+// differ in where records and blobs are kept.
+type Store interface {
+	CreateUser(user User) error
+	// AddUser creates user like CreateUser, but returns ErrUserExists when the
+	// name is taken instead of replacing that user.
+	AddUser(user User) error
+	// GetUser returns ErrNotFound when there is no user called name.
+	GetUser(name string) (User, error)
+	CountUsers() (int, error)
+	UpdateUser(user *User) error
+	// ChangeUser calls change with the user called name and stores what it
+	// made of them, in one transaction. Nothing is stored when change returns
+	// an error. change is called again when the user was changed at the same
+	// time, with the changes that were made.
+	ChangeUser(name string, change func(user *User) error) error
+	GetUsers() ([]User, error)
+	RmUser(name string) error
+	SetAdmin(name string, value bool) error
+
+	// GetAlias returns nil when there is no alias called alias.
+	GetAlias(alias string) (*Alias, error)
+	CreateAlias(alias Alias) error
+	UpdateAlias(name string, alias Alias) error
+	UseAlias(name string) (*Alias, error)
+	GetUserAliases(user *User) ([]Alias, error)
+	GetUserAliasNames(owner string) ([]string, error)
+	GetAliases() ([]Alias, error)
+	// GetExpiredAliases returns the aliases that expired before now.
+	GetExpiredAliases(now time.Time) ([]Alias, error)
+	RmAlias(alias *Alias) error
+	// CheckOwners looks for mismatches between the aliases and the index of
+	// who owns them, and repairs them when repair is set.
+	CheckOwners(repair bool) ([]string, error)
+
+	CreateFile(identifier string, mime textproto.MIMEHeader, data io.Reader) (*File, error)
+	GetFile(identifier string) (*File, error)
+	OpenFile(identifier string) (*File, io.ReadSeekCloser, error)
+	RmFile(identifier string) error
+
+	CreateToken(token Token) error
+	// GetToken returns nil when there is no token with that id.
+	GetToken(id string) (*Token, error)
+	GetUserTokens(owner string) ([]Token, error)
+	TouchToken(id string, now time.Time) error
+	RmToken(id string) error
+
+	CreateSession(session LoginSession) error
+	// GetSession returns nil when there is no session with that id.
+	GetSession(id string) (*LoginSession, error)
+	GetUserSessions(owner string) ([]LoginSession, error)
+	TouchSession(id string, now time.Time) error
+	RmSession(id string) error
+	RmUserSessions(owner string) error
+	RmExpiredSessions(now time.Time) (int, error)
+	// GetSessionKeys returns the keys of session cookies, the one for new
+	// cookies first.
+	GetSessionKeys() ([]SessionKey, error)
+	UpdateSessionKeys(keys []SessionKey) error
+
+	RecordClicks(clicks []Click, sequence uint64) error
+	GetAliasClicks(alias string) ([]Click, error)
+	GetAliasStats(alias string, days int, now time.Time) (AliasStats, error)
+
+	CreateInvite(invite Invite) error
+	// GetInvite returns nil when there is no invite with that id.
+	GetInvite(id string) (*Invite, error)
+	GetInvites() ([]Invite, error)
+	RmInvite(id string) error
+	// AcceptInvite creates user and uses up the invite at once. It returns
+	// ErrInvalidInvite when the invite can't be used anymore and
+	// ErrUserExists when the name is taken.
+	AcceptInvite(id string, user User, now time.Time) error
+
+	// GetSettings returns the settings of the admin panel, which are all
+	// defaults until they have been changed.
+	GetSettings() (Settings, error)
+	UpdateSettings(settings Settings) error
+
+	// Backup writes a consistent snapshot of the store to w while it is in
+	// use, Restore reads one back in RestoreMerge or RestoreReplace mode.
+	Backup(w io.Writer) error
+	Restore(r io.Reader, mode string) (RestoreReport, error)
+
+	Close()
 }
 
-func NewStore(location string) (*Store, error) {
-	db, err := badger.Open(badger.DefaultOptions(location))
+// The backends a store can be kept in.
+const (
+	BackendBadger = "badger"
+	BackendBolt   = "bolt"
+	BackendMemory = "memory"
+)
+
+type StoreConfig struct {
+	// Backend is one of BackendBadger, BackendBolt or BackendMemory. The
+	// default is BackendBadger.
+	Backend string
+	// Location is the directory (badger) or file (bolt) the database is kept
+	// in. It isn't used by the memory backend.
+	Location string
+	// FileLocation is the directory the contents of uploaded files are kept
+	// in. The memory backend keeps them in memory instead.
+	FileLocation string
+}
+
+// NewStore opens a store and brings its database up to date with migrations.
+// It refuses to open a database made by a newer version, see ErrSchemaTooNew.
+func NewStore(config StoreConfig) (Store, error) {
+	s, err := openStore(config)
 	if err != nil {
 		return nil, err
 	}
-	return &Store{
-		db,
+
+	if _, err := s.migrate(false); err != nil {
+		_ = s.db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// openStore opens a store without looking at its schema version.
+func openStore(config StoreConfig) (*kvStore, error) {
+	var db kv
+	var blobs BlobStore
+	var err error
+
+	switch config.Backend {
+	case BackendBadger, "":
+		db, err = openBadger(config.Location)
+	case BackendBolt:
+		db, err = openBolt(config.Location)
+	case BackendMemory:
+		db, blobs = newMemoryKV(), NewMemoryBlobStore()
+	default:
+		return nil, fmt.Errorf("unknown store backend %q", config.Backend)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if blobs == nil {
+		blobs, err = NewDiskBlobStore(config.FileLocation)
+		if err != nil {
+			_ = db.Close()
+			return nil, err
+		}
+	}
+
+	return &kvStore{
+		newLockedKV(db),
+		blobs,
 	}, nil
 }
 
-func (s Store) Close() {
+type kvStore struct {
+	db    kv
+	blobs BlobStore
+}
+
+// update runs fn in a read-write transaction. Blobs passed to remove by fn are
+// only removed once the transaction has been committed, so a failed
+// transaction never leaves a file without its contents. When the transaction
+// conflicts with another one, it is run again.
+func (s kvStore) update(fn func(txn kvTxn, remove func(blob string)) error) error {
+	var blobs []string
+	for {
+		err := s.db.Update(func(txn kvTxn) error {
+			blobs = nil
+			return fn(txn, func(blob string) {
+				blobs = append(blobs, blob)
+			})
+		})
+		if err == errConflict {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		break
+	}
+
+	for _, blob := range blobs {
+		if err := s.blobs.Remove(blob); err != nil {
+			log.Printf("failed to remove blob %s: %v", blob, err)
+		}
+	}
+
+	return nil
+}
+
+// exclusive runs fn with a store that is the only one that can write until fn
+// returns. Writes made through s wait for it, so fn must only use the store
+// it is given.
+func (s kvStore) exclusive(fn func(s kvStore) error) error {
+	locked, ok := s.db.(lockedKV)
+	if !ok {
+		return fn(s)
+	}
+
+	locked.lock.Lock()
+	defer locked.lock.Unlock()
+
+	return fn(kvStore{
+		locked.kv,
+		s.blobs,
+	})
+}
+
+func (s kvStore) Close() {
 	err := s.db.Close()
 	if err != nil {
 		log.Fatalf("%v", err)
@@ -43,7 +239,37 @@ type User struct {
 	Name     string
 	Password []byte
 	Admin    bool
-	Aliases  []string
+	// Email is only known of users who signed up themselves.
+	Email string `json:",omitempty"`
+	// Pending users signed up, but can't log in until an admin approves
+	// them.
+	Pending bool `json:",omitempty"`
+	// TOTPSecret is the secret of the authenticator of users with two-factor
+	// authentication. TOTPPending holds the secret while it is being set up.
+	TOTPSecret  string `json:",omitempty"`
+	TOTPPending string `json:",omitempty"`
+	// TOTPLastStep is the time step of the last code that was used, so codes
+	// can't be used twice.
+	TOTPLastStep int64 `json:",omitempty"`
+	// RecoveryCodes are the hashes of the recovery codes that haven't been
+	// used yet.
+	RecoveryCodes [][]byte `json:",omitempty"`
+	// WebAuthnId identifies the user to their passkeys.
+	WebAuthnId  []byte               `json:",omitempty"`
+	Credentials []WebAuthnCredential `json:",omitempty"`
+	// OIDCIssuer and OIDCSubject link users to the account they log in with
+	// at an OpenID Connect provider.
+	OIDCIssuer  string `json:",omitempty"`
+	OIDCSubject string `json:",omitempty"`
+	// Source is where users come from that log in with a password that
+	// isn't kept here, like ldap. It is empty for local users.
+	Source string `json:",omitempty"`
+	// AdminNeedsTOTP is set instead of Admin on admins who can't use their
+	// rights until they set up two-factor authentication. It isn't stored.
+	AdminNeedsTOTP bool `json:"-"`
+	// Aliases holds the aliases of users from before they were kept in the
+	// owner index. They are moved there when the store is opened.
+	Aliases []string `json:",omitempty"`
 }
 
 type Alias struct {
@@ -52,322 +278,514 @@ type Alias struct {
 	Alias string
 	Password []byte
 	File string
+	Expires *time.Time
+	// MaxUses is the number of times an alias can be resolved, or 0 when
+	// there is no limit. Uses counts how often it has been resolved so far.
+	MaxUses int
+	Uses int
+}
+
+func (a Alias) Expired(now time.Time) bool {
+	return a.Expires != nil && now.After(*a.Expires)
+}
+
+func (a Alias) UsedUp() bool {
+	return a.MaxUses > 0 && a.Uses >= a.MaxUses
 }
 
 type File struct {
-	Data []byte
-	Mime textproto.MIMEHeader
+	// Data holds the contents of files uploaded before they were kept in the
+	// blob store. It is moved there when the store is opened.
+	Data    []byte `json:",omitempty"`
+	Mime    textproto.MIMEHeader
+	Blob    string
+	Size    int64
+	Hash    []byte
+	Created time.Time
 }
 
-func (s *Store) CreateUser(user User) error {
-	return s.db.Update(func(txn *badger.Txn) error {
-		var b bytes.Buffer
-		err := json.NewEncoder(&b).Encode(&user)
+func (s *kvStore) CreateUser(user User) error {
+	return s.db.Update(func(txn kvTxn) error {
+		return setJson(txn, prefix(userPrefix, user.Name), &user)
+	})
+}
+
+// AddUser stores a new user, or returns ErrUserExists when the name is taken.
+// Users added with the same name at the same time conflict, after which the
+// others see that the name was taken.
+func (s *kvStore) AddUser(user User) error {
+	return s.update(func(txn kvTxn, remove func(blob string)) error {
+		taken, err := exists(txn, prefix(userPrefix, user.Name))
 		if err != nil {
 			return err
 		}
+		if taken {
+			return ErrUserExists
+		}
 
-		return txn.Set(prefix(userPrefix, user.Name), b.Bytes())
+		return setJson(txn, prefix(userPrefix, user.Name), &user)
 	})
 }
 
-func (s *Store) GetUser(name string) (User, error) {
+func (s *kvStore) GetUser(name string) (User, error) {
 	var res User
-	return res, s.db.View(func(txn *badger.Txn) error {
-		entry, err := txn.Get(prefix(userPrefix, name))
-		if err != nil {
-			return err
-		}
-		return entry.Value(func(val []byte) error {
-			return json.NewDecoder(bytes.NewBuffer(val)).Decode(&res)
-		})
+	return res, s.db.View(func(txn kvTxn) error {
+		return getJson(txn, prefix(userPrefix, name), &res)
 	})
 }
 
-func (s *Store) CountUsers() (int, error) {
+func (s *kvStore) CountUsers() (int, error) {
 	res := 0
-	return res, s.db.View(func(txn *badger.Txn) error {
-		it := txn.NewIterator(badger.DefaultIteratorOptions)
-		for it.Seek([]byte(userPrefix)); it.ValidForPrefix([]byte(userPrefix)); it.Next() {
+	return res, s.db.View(func(txn kvTxn) error {
+		return txn.Iterate([]byte(userPrefix), func(key []byte, value func() ([]byte, error)) error {
 			res += 1
-		}
-
-		it.Close()
+			return nil
+		})
+	})
+}
 
-		return nil
+func (s kvStore) UpdateUser(user *User) error {
+	return s.db.Update(func(txn kvTxn) error {
+		return setJson(txn, prefix(userPrefix, user.Name), user)
 	})
 }
 
-func (s Store) UpdateUser(user *User) error {
-	return s.db.Update(func(txn *badger.Txn) error {
-		var b bytes.Buffer
-		err := json.NewEncoder(&b).Encode(&user)
-		if err != nil {
-			return err
+func (s kvStore) ChangeUser(name string, change func(user *User) error) error {
+	for {
+		err := s.db.Update(func(txn kvTxn) error {
+			var user User
+			if err := getJson(txn, prefix(userPrefix, name), &user); err != nil {
+				return err
+			}
+
+			if err := change(&user); err != nil {
+				return err
+			}
+
+			return setJson(txn, prefix(userPrefix, name), &user)
+		})
+		if err == errConflict {
+			continue
 		}
 
-		return txn.Set(prefix(userPrefix, user.Name), b.Bytes())
-	})
+		return err
+	}
 }
 
-func (s Store) GetAlias(alias string) (*Alias, error) {
+func (s kvStore) GetAlias(alias string) (*Alias, error) {
 	var res *Alias
-	return res, s.db.View(func(txn *badger.Txn) error {
-		entry, err := txn.Get(prefix(aliasPrefix, alias))
-		if err == badger.ErrKeyNotFound {
+	return res, s.db.View(func(txn kvTxn) error {
+		err := getJson(txn, prefix(aliasPrefix, alias), &res)
+		if err == ErrNotFound {
 			return nil
 		}
-		if err != nil {
-			return err
-		}
-		return entry.Value(func(val []byte) error {
-			return json.NewDecoder(bytes.NewBuffer(val)).Decode(&res)
-		})
+		return err
 	})
 }
 
-func (s Store) CreateAlias(alias Alias) error {
-	err := s.AddAliasToUser(alias.Owner, alias.Alias)
+// CreateAlias stores a new alias and adds it to the aliases of its owner, in a
+// single transaction. When there already is an alias with the same name,
+// ErrAliasTaken is returned. Two aliases with the same name created at the same
+// time conflict, after which one of them gets ErrAliasTaken.
+func (s kvStore) CreateAlias(alias Alias) error {
+	// the clicks of an alias that had the same name are removed after it, so
+	// some may be left. They don't belong to the new alias.
+	old, err := s.GetAlias(alias.Alias)
 	if err != nil {
 		return err
 	}
+	if old != nil {
+		return ErrAliasTaken
+	}
+	if err := s.rmAliasClicks(alias.Alias); err != nil {
+		return err
+	}
 
-	return s.db.Update(func(txn *badger.Txn) error {
-		var b bytes.Buffer
-		err := json.NewEncoder(&b).Encode(&alias)
+	return s.update(func(txn kvTxn, remove func(blob string)) error {
+		taken, err := exists(txn, prefix(aliasPrefix, alias.Alias))
 		if err != nil {
 			return err
 		}
+		if taken {
+			return ErrAliasTaken
+		}
 
-		return txn.Set(prefix(aliasPrefix, alias.Alias), b.Bytes())
-	})
-}
-
-func (s Store) AddAliasToUser(owner string, alias string) error {
-	return s.db.Update(func(txn *badger.Txn) error {
-		entry, err := txn.Get(prefix(userPrefix, owner))
+		err = s.addUserAlias(txn, alias.Owner, alias.Alias)
 		if err != nil {
 			return err
 		}
 
-		var user User
-		err = entry.Value(func(val []byte) error {
-			return json.NewDecoder(bytes.NewBuffer(val)).Decode(&user)
-		})
+		err = addAliasExpiry(txn, alias)
 		if err != nil {
 			return err
 		}
 
-		user.Aliases = append(user.Aliases, alias)
-
-		var b bytes.Buffer
-		err = json.NewEncoder(&b).Encode(&user)
+		// a count left behind by an alias that had the same name
+		err = moveClickCount(txn, alias.Alias, "")
 		if err != nil {
 			return err
 		}
 
-		return txn.Set(prefix(userPrefix, user.Name), b.Bytes())
+		return setJson(txn, prefix(aliasPrefix, alias.Alias), &alias)
 	})
 }
 
-func (s Store) RmAliasFromUser(owner string, alias string) error {
-	return s.db.Update(func(txn *badger.Txn) error {
-		entry, err := txn.Get(prefix(userPrefix, owner))
+// UpdateAlias replaces the alias currently called name with alias. When the
+// name or the owner of the alias changes, the owners' lists of aliases are
+// updated in the same transaction. When the alias no longer points to the file
+// it used to, that file is removed. The clicks of a renamed alias are moved
+// afterwards. The uses of the alias are kept as they are stored, they are only
+// counted by UseAlias, so editing a copy read earlier can't give uses back.
+func (s kvStore) UpdateAlias(name string, alias Alias) error {
+	err := s.update(func(txn kvTxn, remove func(blob string)) error {
+		var old Alias
+		err := getJson(txn, prefix(aliasPrefix, name), &old)
 		if err != nil {
 			return err
 		}
+		alias.Uses = old.Uses
 
-		var user User
-		err = entry.Value(func(val []byte) error {
-			return json.NewDecoder(bytes.NewBuffer(val)).Decode(&user)
-		})
-		if err != nil {
-			return err
+		if old.File != "" && old.File != alias.File {
+			err = s.rmFile(txn, old.File, remove)
+			if err != nil {
+				return err
+			}
 		}
 
-		var toRemove []int
-		for i, a := range user.Aliases {
-			if a == alias {
-				toRemove = append(toRemove, i)
+		if alias.Alias != name {
+			taken, err := exists(txn, prefix(aliasPrefix, alias.Alias))
+			if err != nil {
+				return err
+			}
+			if taken {
+				return ErrAliasTaken
+			}
+
+			err = txn.Delete(prefix(aliasPrefix, name))
+			if err != nil {
+				return err
+			}
+
+			err = moveClickCount(txn, name, alias.Alias)
+			if err != nil {
+				return err
 			}
 		}
 
-		for _, r := range toRemove {
-			user.Aliases = append(user.Aliases[:r], user.Aliases[r+1:]...)
+		if alias.Owner != old.Owner {
+			err = s.rmUserAlias(txn, old.Owner, name)
+			if err != nil {
+				return err
+			}
+			err = s.addUserAlias(txn, alias.Owner, alias.Alias)
+			if err != nil {
+				return err
+			}
+		} else if alias.Alias != name {
+			err = s.renameUserAlias(txn, old.Owner, name, alias.Alias)
+			if err != nil {
+				return err
+			}
 		}
 
-		var b bytes.Buffer
-		err = json.NewEncoder(&b).Encode(&user)
+		err = rmAliasExpiry(txn, old)
+		if err != nil {
+			return err
+		}
+		err = addAliasExpiry(txn, alias)
 		if err != nil {
 			return err
 		}
 
-		return txn.Set(prefix(userPrefix, user.Name), b.Bytes())
+		return setJson(txn, prefix(aliasPrefix, alias.Alias), &alias)
 	})
-}
+	if err != nil || alias.Alias == name {
+		return err
+	}
 
-func (s Store) GetUserAliases(user *User) ([]Alias, error) {
-	if user.Aliases == nil {
-		return nil, nil
+	if err := s.moveAliasClicks(name, alias.Alias); err != nil {
+		log.Printf("failed to move the clicks of %s to %s: %v", name, alias.Alias, err)
 	}
 
-	res := make([]Alias, len(user.Aliases))
+	return nil
+}
 
-	return res, s.db.View(func(txn *badger.Txn) error {
-		for i, alias := range user.Aliases {
-			entry, err := txn.Get(prefix(aliasPrefix, alias))
-			if err == badger.ErrKeyNotFound {
-				return nil
-			}
+// UseAlias counts a use of an alias with a limited number of uses, and returns
+// the alias as it is after that use. When the alias has already been used up,
+// ErrAliasUsedUp is returned. The check and the increment happen in a single
+// transaction, so concurrent requests can never both get the last use.
+func (s kvStore) UseAlias(name string) (*Alias, error) {
+	for {
+		var res *Alias
+		err := s.db.Update(func(txn kvTxn) error {
+			err := getJson(txn, prefix(aliasPrefix, name), &res)
 			if err != nil {
 				return err
 			}
-			err = entry.Value(func(val []byte) error {
-				return json.NewDecoder(bytes.NewBuffer(val)).Decode(&res[i])
-			})
-			if err != nil {
-				return err
+
+			if res.MaxUses == 0 {
+				return nil
+			}
+			if res.UsedUp() {
+				return ErrAliasUsedUp
 			}
+			res.Uses += 1
+
+			return setJson(txn, prefix(aliasPrefix, name), res)
+		})
+		if err == errConflict {
+			// someone else used the alias at the same time, try again with
+			// the count they left behind
+			continue
 		}
-		return nil
+		if err != nil {
+			return nil, err
+		}
+
+		return res, nil
+	}
+}
+
+// RmAlias removes an alias together with its file, and removes it from the
+// aliases of its owner, in a single transaction. Its clicks are removed
+// afterwards. Removing an alias that was already removed is not an error.
+func (s kvStore) RmAlias(alias *Alias) error {
+	removed := false
+	err := s.update(func(txn kvTxn, remove func(blob string)) error {
+		removed = false
+
+		var current Alias
+		err := getJson(txn, prefix(aliasPrefix, alias.Alias), &current)
+		if err == ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		removed = true
+		return s.rmAliasRecords(txn, current, remove)
 	})
+	if err != nil || !removed {
+		return err
+	}
+
+	s.cleanUpClicks([]string{alias.Alias})
+	return nil
+}
+
+// cleanUpClicks removes the clicks of aliases that were removed. Failing to do
+// so only leaves clicks behind, so it is logged instead of failing what was
+// already done.
+func (s kvStore) cleanUpClicks(aliases []string) {
+	for _, alias := range aliases {
+		if err := s.rmAliasClicks(alias); err != nil {
+			log.Printf("failed to remove the clicks of %s: %v", alias, err)
+		}
+	}
 }
 
-func (s Store) RmAlias(alias *Alias) error {
-	if err := s.RmAliasFromUser(alias.Owner, alias.Alias); err != nil {
+// rmAliasRecords removes an alias, its entries in the owner and expiry indexes,
+// its file and its click count as part of txn. Its clicks have to be removed with cleanUpClicks after the
+// transaction has been committed, there can be more of them than fit in it.
+func (s kvStore) rmAliasRecords(txn kvTxn, alias Alias, remove func(blob string)) error {
+	err := s.rmUserAlias(txn, alias.Owner, alias.Alias)
+	if err != nil {
 		return err
 	}
 
-	return s.db.Update(func(txn *badger.Txn) error {
-		err := s.RmAliasFiles(txn, alias.Alias)
+	if alias.File != "" {
+		err = s.rmFile(txn, alias.File, remove)
 		if err != nil {
 			return err
 		}
+	}
+
+	err = moveClickCount(txn, alias.Alias, "")
+	if err != nil {
+		return err
+	}
+
+	err = rmAliasExpiry(txn, alias)
+	if err != nil {
+		return err
+	}
+
+	return txn.Delete(prefix(aliasPrefix, alias.Alias))
+}
+
+func (s kvStore) GetAliases() ([]Alias, error) {
+	var res []Alias
+	return res, s.db.View(func(txn kvTxn) error {
+		return iterateValues(txn, []byte(aliasPrefix), func(key []byte, val []byte) error {
+			var alias Alias
+			if err := decodeJson(val, &alias); err != nil {
+				return err
+			}
 
-		return txn.Delete(prefix(aliasPrefix, alias.Alias))
+			res = append(res, alias)
+			return nil
+		})
 	})
 }
 
-func (s Store) GetUsers() ([]User, error) {
+func (s kvStore) GetUsers() ([]User, error) {
 	var res []User
-	return res, s.db.View(func(txn *badger.Txn) error {
-		it := txn.NewIterator(badger.DefaultIteratorOptions)
-		for it.Seek([]byte(userPrefix)); it.ValidForPrefix([]byte(userPrefix)); it.Next() {
-
+	return res, s.db.View(func(txn kvTxn) error {
+		return iterateValues(txn, []byte(userPrefix), func(key []byte, val []byte) error {
 			var user User
-			err := it.Item().Value(func(val []byte) error {
-				return json.NewDecoder(bytes.NewBuffer(val)).Decode(&user)
-			})
-
-			if err != nil {
+			if err := decodeJson(val, &user); err != nil {
 				return err
 			}
 
 			res = append(res, user)
-		}
-
-		it.Close()
-
-		return nil
+			return nil
+		})
 	})
 }
 
-func (s Store) RmUser(name string) error {
-	return s.db.Update(func(txn *badger.Txn) error {
-		var user User
-		entry, err := txn.Get(prefix(userPrefix, name))
+// RmUser removes a user together with their aliases, files, tokens and
+// sessions in a single transaction. The clicks on their aliases are removed
+// afterwards.
+func (s kvStore) RmUser(name string) error {
+	var removed []string
+	err := s.update(func(txn kvTxn, remove func(blob string)) error {
+		removed = nil
+
+		_, err := txn.Get(prefix(userPrefix, name))
 		if err != nil {
 			return err
 		}
 
-		err = entry.Value(func(val []byte) error {
-			return json.NewDecoder(bytes.NewBuffer(val)).Decode(&user)
-		})
+		aliases, err := userAliasNames(txn, name)
 		if err != nil {
 			return err
 		}
 
-		for _, alias := range user.Aliases {
-			err = s.RmAliasFiles(txn, alias)
+		for _, name := range aliases {
+			var alias Alias
+			err := getJson(txn, prefix(aliasPrefix, name), &alias)
+			if err == ErrNotFound {
+				continue
+			}
 			if err != nil {
 				return err
 			}
-			err = txn.Delete(prefix(aliasPrefix, alias))
+
+			err = s.rmAliasRecords(txn, alias, remove)
 			if err != nil {
 				return err
 			}
+			removed = append(removed, alias.Alias)
 		}
 
-		return txn.Delete(prefix(userPrefix, name))
-	})
-}
-
-func (s Store) SetAdmin(name string, value bool) error {
-	return s.db.Update(func(txn *badger.Txn) error {
-		var user User
-		entry, err := txn.Get(prefix(userPrefix, name))
+		err = s.rmUserTokens(txn, name)
 		if err != nil {
 			return err
 		}
-		err = entry.Value(func(val []byte) error {
-			return json.NewDecoder(bytes.NewBuffer(val)).Decode(&user)
+
+		err = s.rmSessions(txn, func(session LoginSession) bool {
+			return session.Owner == name
 		})
 		if err != nil {
 			return err
 		}
 
-		user.Admin = value
+		return txn.Delete(prefix(userPrefix, name))
+	})
+	if err != nil {
+		return err
+	}
+
+	s.cleanUpClicks(removed)
+	return nil
+}
 
-		var b bytes.Buffer
-		err = json.NewEncoder(&b).Encode(&user)
+func (s kvStore) SetAdmin(name string, value bool) error {
+	return s.db.Update(func(txn kvTxn) error {
+		var user User
+		err := getJson(txn, prefix(userPrefix, name), &user)
 		if err != nil {
 			return err
 		}
 
-		return txn.Set(prefix(userPrefix, user.Name), b.Bytes())
+		user.Admin = value
+
+		return setJson(txn, prefix(userPrefix, user.Name), &user)
 	})
 }
 
-func (s Store) CreateFile(identifier string, f File) error {
-	return s.db.Update(func(txn *badger.Txn) error {
-		var b bytes.Buffer
-		err := json.NewEncoder(&b).Encode(&f)
-		if err != nil {
-			return err
-		}
+// CreateFile stores the contents of a file read from data under identifier.
+// The contents are streamed into the blob store, so files of any size can be
+// stored without keeping them in memory.
+func (s kvStore) CreateFile(identifier string, mime textproto.MIMEHeader, data io.Reader) (*File, error) {
+	blob, size, hash, err := s.blobs.Write(data)
+	if err != nil {
+		return nil, err
+	}
+
+	f := File{
+		Mime:    mime,
+		Blob:    blob,
+		Size:    size,
+		Hash:    hash,
+		Created: time.Now(),
+	}
 
-		return txn.Set(prefix(filePrefix, identifier), b.Bytes())
+	err = s.db.Update(func(txn kvTxn) error {
+		return setJson(txn, prefix(filePrefix, identifier), &f)
 	})
+	if err != nil {
+		_ = s.blobs.Remove(blob)
+		return nil, err
+	}
+
+	return &f, nil
 }
 
-func (s Store) GetFile(identifier string) (*File, error) {
+func (s kvStore) GetFile(identifier string) (*File, error) {
 	var res *File
-	return res, s.db.View(func(txn *badger.Txn) error {
-		entry, err := txn.Get(prefix(filePrefix, identifier))
-		if err != nil {
-			return err
-		}
-		return entry.Value(func(val []byte) error {
-			return json.NewDecoder(bytes.NewBuffer(val)).Decode(&res)
-		})
+	return res, s.db.View(func(txn kvTxn) error {
+		return getJson(txn, prefix(filePrefix, identifier), &res)
 	})
 }
 
-func (s Store) RmAliasFiles(txn *badger.Txn, aliasName string) error {
-	var alias *Alias
-	entry, err := txn.Get(prefix(aliasPrefix, aliasName))
-	if err == badger.ErrKeyNotFound {
-		return nil
+// OpenFile returns a file together with a reader for its contents, which
+// has to be closed by the caller.
+func (s kvStore) OpenFile(identifier string) (*File, io.ReadSeekCloser, error) {
+	file, err := s.GetFile(identifier)
+	if err != nil {
+		return nil, nil, err
 	}
+
+	data, err := s.blobs.Open(file.Blob)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	err = entry.Value(func(val []byte) error {
-		return json.NewDecoder(bytes.NewBuffer(val)).Decode(&alias)
+
+	return file, data, nil
+}
+
+func (s kvStore) RmFile(identifier string) error {
+	return s.update(func(txn kvTxn, remove func(blob string)) error {
+		return s.rmFile(txn, identifier, remove)
 	})
+}
+
+// rmFile removes a file as part of txn, and passes its blob to remove.
+func (s kvStore) rmFile(txn kvTxn, identifier string, remove func(blob string)) error {
+	var file File
+	err := getJson(txn, prefix(filePrefix, identifier), &file)
+	if err == ErrNotFound {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
 
-	return txn.Delete(prefix(filePrefix, alias.File))
+	if file.Blob != "" {
+		remove(file.Blob)
+	}
+
+	return txn.Delete(prefix(filePrefix, identifier))
 }
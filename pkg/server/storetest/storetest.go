@@ -0,0 +1,1194 @@
+// Package storetest implements a conformance suite for server.Store, which
+// every backend has to pass. It is used like testing/fstest:
+//
+//	func TestStore(t *testing.T) {
+//		storetest.RunAll(t)
+//	}
+package storetest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/textproto"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jonay2000/short/pkg/server"
+)
+
+// Backends returns a function for every backend that opens a new, empty store
+// kept in a temporary directory of t.
+func Backends() map[string]func(t *testing.T) server.Store {
+	open := func(backend string, location func(dir string) string) func(t *testing.T) server.Store {
+		return func(t *testing.T) server.Store {
+			dir := t.TempDir()
+			store, err := server.NewStore(server.StoreConfig{
+				Backend:      backend,
+				Location:     location(dir),
+				FileLocation: filepath.Join(dir, "files"),
+			})
+			if err != nil {
+				t.Fatalf("opening %s store: %v", backend, err)
+			}
+			t.Cleanup(store.Close)
+
+			return store
+		}
+	}
+
+	return map[string]func(t *testing.T) server.Store{
+		server.BackendBadger: open(server.BackendBadger, func(dir string) string {
+			return filepath.Join(dir, "store.db")
+		}),
+		server.BackendBolt: open(server.BackendBolt, func(dir string) string {
+			return filepath.Join(dir, "store.bolt")
+		}),
+		server.BackendMemory: open(server.BackendMemory, func(dir string) string {
+			return ""
+		}),
+	}
+}
+
+// RunAll runs the suite against every backend.
+func RunAll(t *testing.T) {
+	for name, newStore := range Backends() {
+		newStore := newStore
+		t.Run(name, func(t *testing.T) {
+			Run(t, newStore)
+		})
+	}
+}
+
+// Run runs the suite against stores made by newStore. Every test gets a new,
+// empty store.
+func Run(t *testing.T, newStore func(t *testing.T) server.Store) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s server.Store)
+	}{
+		{"Users", testUsers},
+		{"AddUserConcurrently", testAddUserConcurrently},
+		{"ChangeUserConcurrently", testChangeUserConcurrently},
+		{"RmUser", testRmUser},
+		{"Aliases", testAliases},
+		{"CreateAliasConcurrently", testCreateAliasConcurrently},
+		{"CreateAliasWithoutOwner", testCreateAliasWithoutOwner},
+		{"RenameAlias", testRenameAlias},
+		{"ChangeAliasOwner", testChangeAliasOwner},
+		{"OwnerNamesWithSeparator", testOwnerNamesWithSeparator},
+		{"CheckOwners", testCheckOwners},
+		{"UseAlias", testUseAlias},
+		{"UseAliasConcurrently", testUseAliasConcurrently},
+		{"RmAlias", testRmAlias},
+		{"ExpiredAliases", testExpiredAliases},
+		{"Files", testFiles},
+		{"ReplaceAliasFile", testReplaceAliasFile},
+		{"Tokens", testTokens},
+		{"Sessions", testSessions},
+		{"SessionKeys", testSessionKeys},
+		{"Clicks", testClicks},
+		{"Invites", testInvites},
+		{"Settings", testSettings},
+		{"Backup", testBackup},
+		{"RestoreMerge", testRestoreMerge},
+		{"RestoreInvalid", testRestoreInvalid},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.fn(t, newStore(t))
+		})
+	}
+}
+
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func createUser(t *testing.T, s server.Store, name string) {
+	t.Helper()
+	check(t, s.CreateUser(server.User{
+		Name:     name,
+		Password: []byte("hash"),
+	}))
+}
+
+func createAlias(t *testing.T, s server.Store, alias server.Alias) {
+	t.Helper()
+	check(t, s.CreateAlias(alias))
+}
+
+func createFile(t *testing.T, s server.Store, identifier string, contents string) {
+	t.Helper()
+	_, err := s.CreateFile(identifier, textproto.MIMEHeader{
+		"Content-Type": {"text/plain"},
+	}, strings.NewReader(contents))
+	check(t, err)
+}
+
+func aliasNames(aliases []server.Alias) []string {
+	var res []string
+	for _, a := range aliases {
+		res = append(res, a.Alias)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func equalNames(a []string, b ...string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func userAliases(t *testing.T, s server.Store, name string) []string {
+	t.Helper()
+	user, err := s.GetUser(name)
+	check(t, err)
+	aliases, err := s.GetUserAliases(&user)
+	check(t, err)
+	return aliasNames(aliases)
+}
+
+func testUsers(t *testing.T, s server.Store) {
+	if _, err := s.GetUser("alice"); !errors.Is(err, server.ErrNotFound) {
+		t.Fatalf("getting a missing user returned %v, expected ErrNotFound", err)
+	}
+
+	createUser(t, s, "alice")
+	createUser(t, s, "bob")
+
+	count, err := s.CountUsers()
+	check(t, err)
+	if count != 2 {
+		t.Errorf("counted %d users, expected 2", count)
+	}
+
+	users, err := s.GetUsers()
+	check(t, err)
+	if len(users) != 2 || users[0].Name != "alice" || users[1].Name != "bob" {
+		t.Errorf("listed users %+v, expected alice and bob", users)
+	}
+
+	check(t, s.SetAdmin("bob", true))
+	bob, err := s.GetUser("bob")
+	check(t, err)
+	if !bob.Admin {
+		t.Errorf("bob is not an admin after SetAdmin")
+	}
+
+	bob.Password = []byte("other")
+	check(t, s.UpdateUser(&bob))
+	bob, err = s.GetUser("bob")
+	check(t, err)
+	if string(bob.Password) != "other" || !bob.Admin {
+		t.Errorf("user after UpdateUser is %+v", bob)
+	}
+}
+
+func testAddUserConcurrently(t *testing.T, s server.Store) {
+	const signups = 10
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var emails []string
+	for i := 0; i < signups; i++ {
+		email := fmt.Sprintf("alice%d@example.com", i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := s.AddUser(server.User{Name: "alice", Email: email})
+			if err == nil {
+				lock.Lock()
+				emails = append(emails, email)
+				lock.Unlock()
+			} else if !errors.Is(err, server.ErrUserExists) {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(emails) != 1 {
+		t.Fatalf("the same user was added %d times", len(emails))
+	}
+
+	alice, err := s.GetUser("alice")
+	check(t, err)
+	if alice.Email != emails[0] {
+		t.Errorf("user has email %s, expected the one that was added, %s", alice.Email, emails[0])
+	}
+}
+
+func testChangeUserConcurrently(t *testing.T, s server.Store) {
+	createUser(t, s, "alice")
+
+	// every change adds a code, none of them is lost
+	const changes = 10
+	var wg sync.WaitGroup
+	for i := 0; i < changes; i++ {
+		code := []byte(fmt.Sprintf("code%d", i))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := s.ChangeUser("alice", func(user *server.User) error {
+				user.RecoveryCodes = append(user.RecoveryCodes, code)
+				return nil
+			})
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	alice, err := s.GetUser("alice")
+	check(t, err)
+	if len(alice.RecoveryCodes) != changes {
+		t.Errorf("user has %d codes after %d changes", len(alice.RecoveryCodes), changes)
+	}
+
+	// a change that fails isn't stored
+	errFailed := errors.New("failed")
+	err = s.ChangeUser("alice", func(user *server.User) error {
+		user.RecoveryCodes = nil
+		return errFailed
+	})
+	if err != errFailed {
+		t.Errorf("failed change returned %v", err)
+	}
+	alice, err = s.GetUser("alice")
+	check(t, err)
+	if len(alice.RecoveryCodes) != changes {
+		t.Errorf("failed change was stored")
+	}
+
+	err = s.ChangeUser("bob", func(user *server.User) error {
+		return nil
+	})
+	if !errors.Is(err, server.ErrNotFound) {
+		t.Errorf("changing a missing user returned %v, expected ErrNotFound", err)
+	}
+}
+
+func testRmUser(t *testing.T, s server.Store) {
+	createUser(t, s, "alice")
+	createUser(t, s, "bob")
+	createFile(t, s, "a.txt:1", "contents")
+	createAlias(t, s, server.Alias{Owner: "alice", Alias: "a", File: "a.txt:1"})
+	createAlias(t, s, server.Alias{Owner: "alice", Alias: "b", Url: "https://example.com"})
+	createAlias(t, s, server.Alias{Owner: "bob", Alias: "c", Url: "https://example.com"})
+	check(t, s.CreateToken(server.Token{Id: "t1", Owner: "alice"}))
+	check(t, s.CreateToken(server.Token{Id: "t2", Owner: "bob"}))
+	check(t, s.CreateSession(server.LoginSession{Id: "s1", Owner: "alice"}))
+	check(t, s.CreateSession(server.LoginSession{Id: "s2", Owner: "bob"}))
+	check(t, s.RecordClicks([]server.Click{{Alias: "a", Time: time.Now()}}, 0))
+
+	check(t, s.RmUser("alice"))
+
+	if _, err := s.GetUser("alice"); !errors.Is(err, server.ErrNotFound) {
+		t.Errorf("getting a removed user returned %v, expected ErrNotFound", err)
+	}
+	aliases, err := s.GetAliases()
+	check(t, err)
+	if names := aliasNames(aliases); !equalNames(names, "c") {
+		t.Errorf("aliases left after removing alice are %v, expected only c", names)
+	}
+	if _, err := s.GetFile("a.txt:1"); err == nil {
+		t.Errorf("file of a removed user still exists")
+	}
+	if token, err := s.GetToken("t1"); err != nil || token != nil {
+		t.Errorf("token of a removed user still exists")
+	}
+	if token, err := s.GetToken("t2"); err != nil || token == nil {
+		t.Errorf("token of another user was removed")
+	}
+	if session, err := s.GetSession("s1"); err != nil || session != nil {
+		t.Errorf("session of a removed user still exists")
+	}
+	if session, err := s.GetSession("s2"); err != nil || session == nil {
+		t.Errorf("session of another user was removed")
+	}
+	clicks, err := s.GetAliasClicks("a")
+	check(t, err)
+	if len(clicks) != 0 {
+		t.Errorf("clicks of a removed user still exist")
+	}
+}
+
+func testAliases(t *testing.T, s server.Store) {
+	alias, err := s.GetAlias("a")
+	check(t, err)
+	if alias != nil {
+		t.Fatalf("got %+v for an alias that doesn't exist", alias)
+	}
+
+	createUser(t, s, "alice")
+	createUser(t, s, "bob")
+
+	expires := time.Now().Add(time.Hour).Round(0)
+	createAlias(t, s, server.Alias{
+		Owner:    "alice",
+		Alias:    "a",
+		Url:      "https://example.com",
+		Password: []byte("hash"),
+		Expires:  &expires,
+		MaxUses:  3,
+	})
+	createAlias(t, s, server.Alias{Owner: "alice", Alias: "b", Url: "https://example.org"})
+	createAlias(t, s, server.Alias{Owner: "bob", Alias: "c", Url: "https://example.net"})
+
+	alias, err = s.GetAlias("a")
+	check(t, err)
+	if alias == nil || alias.Owner != "alice" || alias.Url != "https://example.com" ||
+		string(alias.Password) != "hash" || alias.MaxUses != 3 ||
+		alias.Expires == nil || !alias.Expires.Equal(expires) {
+		t.Errorf("got alias %+v", alias)
+	}
+
+	if names := userAliases(t, s, "alice"); !equalNames(names, "a", "b") {
+		t.Errorf("aliases of alice are %v, expected a and b", names)
+	}
+	if names := userAliases(t, s, "bob"); !equalNames(names, "c") {
+		t.Errorf("aliases of bob are %v, expected c", names)
+	}
+
+	aliases, err := s.GetAliases()
+	check(t, err)
+	if names := aliasNames(aliases); !equalNames(names, "a", "b", "c") {
+		t.Errorf("all aliases are %v, expected a, b and c", names)
+	}
+}
+
+func testCreateAliasConcurrently(t *testing.T, s server.Store) {
+	const users = 10
+	for i := 0; i < users; i++ {
+		createUser(t, s, fmt.Sprintf("user%d", i))
+	}
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var owners []string
+	for i := 0; i < users; i++ {
+		owner := fmt.Sprintf("user%d", i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := s.CreateAlias(server.Alias{Owner: owner, Alias: "a", Url: "https://example.com"})
+			if err == nil {
+				lock.Lock()
+				owners = append(owners, owner)
+				lock.Unlock()
+			} else if !errors.Is(err, server.ErrAliasTaken) {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(owners) != 1 {
+		t.Fatalf("the same alias was created %d times", len(owners))
+	}
+
+	alias, err := s.GetAlias("a")
+	check(t, err)
+	if alias == nil || alias.Owner != owners[0] {
+		t.Errorf("alias is %+v, expected it to be owned by %s", alias, owners[0])
+	}
+	for i := 0; i < users; i++ {
+		name := fmt.Sprintf("user%d", i)
+		names := userAliases(t, s, name)
+		if name == owners[0] && !equalNames(names, "a") {
+			t.Errorf("aliases of the owner are %v, expected a", names)
+		} else if name != owners[0] && len(names) != 0 {
+			t.Errorf("%s has aliases %v, expected none", name, names)
+		}
+	}
+}
+
+func testCreateAliasWithoutOwner(t *testing.T, s server.Store) {
+	err := s.CreateAlias(server.Alias{Owner: "nobody", Alias: "a", Url: "https://example.com"})
+	if err == nil {
+		t.Fatalf("created an alias for a user that doesn't exist")
+	}
+
+	alias, err := s.GetAlias("a")
+	check(t, err)
+	if alias != nil {
+		t.Errorf("alias was stored even though creating it failed")
+	}
+}
+
+func testRenameAlias(t *testing.T, s server.Store) {
+	createUser(t, s, "alice")
+	createAlias(t, s, server.Alias{Owner: "alice", Alias: "a", Url: "https://example.com"})
+	createAlias(t, s, server.Alias{Owner: "alice", Alias: "b", Url: "https://example.org"})
+	check(t, s.RecordClicks([]server.Click{
+		{Alias: "a", Time: time.Now()},
+		{Alias: "a", Time: time.Now()},
+	}, 0))
+
+	err := s.UpdateAlias("a", server.Alias{Owner: "alice", Alias: "b", Url: "https://example.com"})
+	if !errors.Is(err, server.ErrAliasTaken) {
+		t.Errorf("renaming onto an existing alias returned %v, expected ErrAliasTaken", err)
+	}
+
+	check(t, s.UpdateAlias("a", server.Alias{Owner: "alice", Alias: "c", Url: "https://example.net"}))
+
+	old, err := s.GetAlias("a")
+	check(t, err)
+	if old != nil {
+		t.Errorf("alias still exists under its old name")
+	}
+	renamed, err := s.GetAlias("c")
+	check(t, err)
+	if renamed == nil || renamed.Url != "https://example.net" {
+		t.Errorf("renamed alias is %+v", renamed)
+	}
+	if names := userAliases(t, s, "alice"); !equalNames(names, "b", "c") {
+		t.Errorf("aliases of alice after renaming are %v, expected b and c", names)
+	}
+
+	clicks, err := s.GetAliasClicks("c")
+	check(t, err)
+	if len(clicks) != 2 || clicks[0].Alias != "c" {
+		t.Errorf("clicks after renaming are %+v, expected 2 on c", clicks)
+	}
+	clicks, err = s.GetAliasClicks("a")
+	check(t, err)
+	if len(clicks) != 0 {
+		t.Errorf("clicks were left behind under the old name")
+	}
+
+	stats, err := s.GetAliasStats("c", 7, time.Now())
+	check(t, err)
+	if stats.Total != 2 || stats.Daily[6].Count != 2 {
+		t.Errorf("renamed alias has %d clicks in total and %d today, expected 2", stats.Total, stats.Daily[6].Count)
+	}
+	stats, err = s.GetAliasStats("a", 7, time.Now())
+	check(t, err)
+	if stats.Total != 0 {
+		t.Errorf("old name still has %d clicks", stats.Total)
+	}
+}
+
+func testChangeAliasOwner(t *testing.T, s server.Store) {
+	createUser(t, s, "alice")
+	createUser(t, s, "bob")
+	createAlias(t, s, server.Alias{Owner: "alice", Alias: "a", Url: "https://example.com"})
+	createAlias(t, s, server.Alias{Owner: "alice", Alias: "b", Url: "https://example.com"})
+
+	check(t, s.UpdateAlias("a", server.Alias{Owner: "bob", Alias: "c", Url: "https://example.com"}))
+
+	if names := userAliases(t, s, "alice"); !equalNames(names, "b") {
+		t.Errorf("aliases of alice are %v, expected b", names)
+	}
+	if names := userAliases(t, s, "bob"); !equalNames(names, "c") {
+		t.Errorf("aliases of bob are %v, expected c", names)
+	}
+
+	err := s.UpdateAlias("c", server.Alias{Owner: "nobody", Alias: "c", Url: "https://example.com"})
+	if err == nil {
+		t.Errorf("gave an alias to a user that doesn't exist")
+	}
+	alias, err := s.GetAlias("c")
+	check(t, err)
+	if alias == nil || alias.Owner != "bob" {
+		t.Errorf("alias is %+v after failing to change its owner", alias)
+	}
+}
+
+func testOwnerNamesWithSeparator(t *testing.T, s server.Store) {
+	createUser(t, s, "a")
+	createUser(t, s, "a:b")
+	createAlias(t, s, server.Alias{Owner: "a", Alias: "x", Url: "https://example.com"})
+	createAlias(t, s, server.Alias{Owner: "a:b", Alias: "y", Url: "https://example.com"})
+
+	names, err := s.GetUserAliasNames("a")
+	check(t, err)
+	if !equalNames(names, "x") {
+		t.Errorf("aliases of a are %v, expected x", names)
+	}
+	names, err = s.GetUserAliasNames("a:b")
+	check(t, err)
+	if !equalNames(names, "y") {
+		t.Errorf("aliases of a:b are %v, expected y", names)
+	}
+
+	check(t, s.RmUser("a"))
+	alias, err := s.GetAlias("y")
+	check(t, err)
+	if alias == nil {
+		t.Errorf("removing a removed the aliases of a:b")
+	}
+}
+
+func testCheckOwners(t *testing.T, s server.Store) {
+	createUser(t, s, "alice")
+	createUser(t, s, "bob")
+	createUser(t, s, "carol")
+	createAlias(t, s, server.Alias{Owner: "alice", Alias: "a", Url: "https://example.com"})
+	createAlias(t, s, server.Alias{Owner: "alice", Alias: "b", Url: "https://example.com"})
+	createAlias(t, s, server.Alias{Owner: "bob", Alias: "c", Url: "https://example.com"})
+	createAlias(t, s, server.Alias{Owner: "carol", Alias: "d", Url: "https://example.com"})
+	check(t, s.UpdateAlias("a", server.Alias{Owner: "bob", Alias: "e", Url: "https://example.com"}))
+	check(t, s.UpdateAlias("b", server.Alias{Owner: "alice", Alias: "f", Url: "https://example.com"}))
+	check(t, s.RmAlias(&server.Alias{Owner: "bob", Alias: "c"}))
+	check(t, s.RmUser("carol"))
+
+	problems, err := s.CheckOwners(false)
+	check(t, err)
+	if len(problems) != 0 {
+		t.Errorf("found problems in a consistent store: %v", problems)
+	}
+
+	names, err := s.GetUserAliasNames("bob")
+	check(t, err)
+	if !equalNames(names, "e") {
+		t.Errorf("aliases of bob are %v, expected e", names)
+	}
+}
+
+func testUseAlias(t *testing.T, s server.Store) {
+	createUser(t, s, "alice")
+	createAlias(t, s, server.Alias{Owner: "alice", Alias: "unlimited", Url: "https://example.com"})
+	createAlias(t, s, server.Alias{Owner: "alice", Alias: "limited", Url: "https://example.com", MaxUses: 2})
+
+	alias, err := s.UseAlias("unlimited")
+	check(t, err)
+	if alias.Uses != 0 {
+		t.Errorf("uses of an unlimited alias are counted")
+	}
+
+	for i := 1; i <= 2; i++ {
+		alias, err := s.UseAlias("limited")
+		check(t, err)
+		if alias.Uses != i {
+			t.Errorf("alias has %d uses after using it %d times", alias.Uses, i)
+		}
+	}
+
+	if _, err := s.UseAlias("limited"); !errors.Is(err, server.ErrAliasUsedUp) {
+		t.Errorf("using a used up alias returned %v, expected ErrAliasUsedUp", err)
+	}
+
+	// an edit made to a copy from before the uses doesn't reopen the alias
+	check(t, s.UpdateAlias("limited", server.Alias{Owner: "alice", Alias: "limited", Url: "https://example.net", MaxUses: 2}))
+	if _, err := s.UseAlias("limited"); !errors.Is(err, server.ErrAliasUsedUp) {
+		t.Errorf("using a used up alias after editing it returned %v, expected ErrAliasUsedUp", err)
+	}
+}
+
+func testUseAliasConcurrently(t *testing.T, s server.Store) {
+	createUser(t, s, "alice")
+	createAlias(t, s, server.Alias{Owner: "alice", Alias: "once", Url: "https://example.com", MaxUses: 1})
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	used := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.UseAlias("once")
+			if err == nil {
+				lock.Lock()
+				used += 1
+				lock.Unlock()
+			} else if !errors.Is(err, server.ErrAliasUsedUp) {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if used != 1 {
+		t.Errorf("an alias with one use was used %d times", used)
+	}
+}
+
+func testRmAlias(t *testing.T, s server.Store) {
+	createUser(t, s, "alice")
+	createFile(t, s, "a.txt:1", "contents")
+	createAlias(t, s, server.Alias{Owner: "alice", Alias: "a", File: "a.txt:1"})
+	createAlias(t, s, server.Alias{Owner: "alice", Alias: "b", Url: "https://example.com"})
+	check(t, s.RecordClicks([]server.Click{{Alias: "a", Time: time.Now()}}, 0))
+
+	alias, err := s.GetAlias("a")
+	check(t, err)
+	check(t, s.RmAlias(alias))
+
+	alias, err = s.GetAlias("a")
+	check(t, err)
+	if alias != nil {
+		t.Errorf("removed alias still exists")
+	}
+	if names := userAliases(t, s, "alice"); !equalNames(names, "b") {
+		t.Errorf("aliases of alice after removing a are %v, expected b", names)
+	}
+	if _, err := s.GetFile("a.txt:1"); err == nil {
+		t.Errorf("file of a removed alias still exists")
+	}
+	check(t, s.RmAlias(&server.Alias{Owner: "alice", Alias: "a"}))
+	clicks, err := s.GetAliasClicks("a")
+	check(t, err)
+	if len(clicks) != 0 {
+		t.Errorf("clicks of a removed alias still exist")
+	}
+	stats, err := s.GetAliasStats("a", 7, time.Now())
+	check(t, err)
+	if stats.Total != 0 {
+		t.Errorf("removed alias still has %d clicks counted", stats.Total)
+	}
+}
+
+func testExpiredAliases(t *testing.T, s server.Store) {
+	now := time.Now().Round(0)
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+	createUser(t, s, "alice")
+	createAlias(t, s, server.Alias{Owner: "alice", Alias: "a", Url: "https://example.com", Expires: &past})
+	createAlias(t, s, server.Alias{Owner: "alice", Alias: "b", Url: "https://example.com", Expires: &future})
+	createAlias(t, s, server.Alias{Owner: "alice", Alias: "c", Url: "https://example.com"})
+	createAlias(t, s, server.Alias{Owner: "alice", Alias: "d", Url: "https://example.com", Expires: &past})
+	createAlias(t, s, server.Alias{Owner: "alice", Alias: "e", Url: "https://example.com", Expires: &past})
+	createAlias(t, s, server.Alias{Owner: "alice", Alias: "f", Url: "https://example.com", Expires: &past})
+
+	// changing when an alias expires, renaming it or removing it keeps the
+	// expiry index up to date
+	check(t, s.UpdateAlias("d", server.Alias{Owner: "alice", Alias: "d", Url: "https://example.com", Expires: &future}))
+	check(t, s.UpdateAlias("e", server.Alias{Owner: "alice", Alias: "e2", Url: "https://example.com", Expires: &past}))
+	check(t, s.RmAlias(&server.Alias{Owner: "alice", Alias: "f"}))
+
+	expired, err := s.GetExpiredAliases(now)
+	check(t, err)
+	if names := aliasNames(expired); !equalNames(names, "a", "e2") {
+		t.Errorf("expired aliases are %v, expected a and e2", names)
+	}
+
+	removed, err := server.SweepExpiredAliases(s, now)
+	check(t, err)
+	if removed != 2 {
+		t.Errorf("sweeping removed %d aliases, expected 2", removed)
+	}
+
+	// the index isn't backed up, a restore rebuilds it
+	archive := backup(t, s)
+	_, err = s.Restore(bytes.NewReader(archive), server.RestoreReplace)
+	check(t, err)
+
+	expired, err = s.GetExpiredAliases(future.Add(time.Second))
+	check(t, err)
+	if names := aliasNames(expired); !equalNames(names, "b", "d") {
+		t.Errorf("aliases expired an hour later are %v, expected b and d", names)
+	}
+}
+
+func testFiles(t *testing.T, s server.Store) {
+	if _, err := s.GetFile("missing"); !errors.Is(err, server.ErrNotFound) {
+		t.Errorf("getting a missing file returned %v, expected ErrNotFound", err)
+	}
+
+	contents := strings.Repeat("some contents ", 1000)
+	createFile(t, s, "a.txt:1", contents)
+
+	file, data, err := s.OpenFile("a.txt:1")
+	check(t, err)
+	read, err := ioutil.ReadAll(data)
+	check(t, err)
+	check(t, data.Close())
+
+	hash := sha256.Sum256([]byte(contents))
+	if string(read) != contents {
+		t.Errorf("read back different contents than were stored")
+	}
+	if file.Size != int64(len(contents)) || !bytes.Equal(file.Hash, hash[:]) {
+		t.Errorf("file has size %d and hash %x, expected %d and %x", file.Size, file.Hash, len(contents), hash)
+	}
+	if file.Mime.Get("Content-Type") != "text/plain" {
+		t.Errorf("file has headers %v", file.Mime)
+	}
+	if file.Created.IsZero() {
+		t.Errorf("file has no creation time")
+	}
+
+	check(t, s.RmFile("a.txt:1"))
+	if _, _, err := s.OpenFile("a.txt:1"); err == nil {
+		t.Errorf("removed file can still be opened")
+	}
+	check(t, s.RmFile("a.txt:1"))
+}
+
+func testReplaceAliasFile(t *testing.T, s server.Store) {
+	createUser(t, s, "alice")
+	createFile(t, s, "a.txt:1", "old")
+	createFile(t, s, "b.txt:2", "new")
+	createAlias(t, s, server.Alias{Owner: "alice", Alias: "a", File: "a.txt:1"})
+
+	check(t, s.UpdateAlias("a", server.Alias{Owner: "alice", Alias: "a", File: "b.txt:2"}))
+
+	if _, err := s.GetFile("a.txt:1"); err == nil {
+		t.Errorf("file that was replaced still exists")
+	}
+	if _, err := s.GetFile("b.txt:2"); err != nil {
+		t.Errorf("new file of the alias is gone: %v", err)
+	}
+}
+
+func testTokens(t *testing.T, s server.Store) {
+	token, err := s.GetToken("missing")
+	check(t, err)
+	if token != nil {
+		t.Errorf("got %+v for a token that doesn't exist", token)
+	}
+
+	created := time.Now().Round(0)
+	check(t, s.CreateToken(server.Token{Id: "t1", Owner: "alice", Name: "one", Hash: []byte("h1"), Created: created}))
+	check(t, s.CreateToken(server.Token{Id: "t2", Owner: "alice", Name: "two"}))
+	check(t, s.CreateToken(server.Token{Id: "t3", Owner: "bob", Name: "three"}))
+
+	token, err = s.GetToken("t1")
+	check(t, err)
+	if token == nil || token.Name != "one" || string(token.Hash) != "h1" || !token.Created.Equal(created) {
+		t.Errorf("got token %+v", token)
+	}
+
+	tokens, err := s.GetUserTokens("alice")
+	check(t, err)
+	if len(tokens) != 2 {
+		t.Errorf("alice has %d tokens, expected 2", len(tokens))
+	}
+
+	now := time.Now().Round(0)
+	check(t, s.TouchToken("t1", now))
+	token, err = s.GetToken("t1")
+	check(t, err)
+	if token.LastUsed == nil || !token.LastUsed.Equal(now) {
+		t.Errorf("token was last used at %v, expected %v", token.LastUsed, now)
+	}
+
+	check(t, s.RmToken("t1"))
+	token, err = s.GetToken("t1")
+	check(t, err)
+	if token != nil {
+		t.Errorf("removed token still exists")
+	}
+}
+
+func testSessions(t *testing.T, s server.Store) {
+	session, err := s.GetSession("missing")
+	check(t, err)
+	if session != nil {
+		t.Errorf("got %+v for a session that doesn't exist", session)
+	}
+
+	now := time.Now().Round(0)
+	old := now.Add(-40 * 24 * time.Hour)
+	check(t, s.CreateSession(server.LoginSession{Id: "s1", Owner: "alice", Created: old, LastSeen: old, Agent: "curl/7.0"}))
+	check(t, s.CreateSession(server.LoginSession{Id: "s2", Owner: "alice", Created: now, LastSeen: now}))
+	check(t, s.CreateSession(server.LoginSession{Id: "s3", Owner: "bob", Created: now, LastSeen: now}))
+
+	session, err = s.GetSession("s1")
+	check(t, err)
+	if session == nil || session.Owner != "alice" || session.Agent != "curl/7.0" || !session.Created.Equal(old) {
+		t.Errorf("got session %+v", session)
+	}
+
+	sessions, err := s.GetUserSessions("alice")
+	check(t, err)
+	if len(sessions) != 2 || sessions[0].Id != "s2" {
+		t.Errorf("alice has sessions %+v, expected s2 and s1", sessions)
+	}
+
+	check(t, s.TouchSession("s2", now.Add(time.Hour)))
+	session, err = s.GetSession("s2")
+	check(t, err)
+	if !session.LastSeen.Equal(now.Add(time.Hour)) {
+		t.Errorf("session was last seen at %v, expected %v", session.LastSeen, now.Add(time.Hour))
+	}
+
+	removed, err := s.RmExpiredSessions(now)
+	check(t, err)
+	if removed != 1 {
+		t.Errorf("removed %d expired sessions, expected 1", removed)
+	}
+	if session, err := s.GetSession("s1"); err != nil || session != nil {
+		t.Errorf("expired session still exists")
+	}
+
+	check(t, s.RmUserSessions("alice"))
+	sessions, err = s.GetUserSessions("alice")
+	check(t, err)
+	if len(sessions) != 0 {
+		t.Errorf("alice still has %d sessions", len(sessions))
+	}
+	if session, err := s.GetSession("s3"); err != nil || session == nil {
+		t.Errorf("session of another user was removed")
+	}
+
+	check(t, s.RmSession("s3"))
+	if session, err := s.GetSession("s3"); err != nil || session != nil {
+		t.Errorf("removed session still exists")
+	}
+}
+
+func testClicks(t *testing.T, s server.Store) {
+	createUser(t, s, "alice")
+	createAlias(t, s, server.Alias{Owner: "alice", Alias: "a", Url: "https://example.com"})
+	createAlias(t, s, server.Alias{Owner: "alice", Alias: "ab", Url: "https://example.com"})
+
+	now := time.Date(2021, 6, 15, 12, 0, 0, 0, time.Local)
+	check(t, s.RecordClicks([]server.Click{
+		{Alias: "a", Time: now.AddDate(0, 0, -30)},
+		{Alias: "a", Time: now.AddDate(0, 0, -1)},
+		{Alias: "a", Time: now, Referrer: "example.com", Agent: "desktop", Authorized: true},
+		{Alias: "ab", Time: now},
+	}, 0))
+	// the same time again, with a sequence that keeps the keys apart
+	check(t, s.RecordClicks([]server.Click{{Alias: "a", Time: now}}, 4))
+
+	clicks, err := s.GetAliasClicks("a")
+	check(t, err)
+	if len(clicks) != 4 {
+		t.Fatalf("alias a has %d clicks, expected 4", len(clicks))
+	}
+	if !clicks[0].Time.Equal(now.AddDate(0, 0, -30)) {
+		t.Errorf("clicks are not ordered by time")
+	}
+	if clicks[2].Referrer != "example.com" || clicks[2].Agent != "desktop" || !clicks[2].Authorized {
+		t.Errorf("got click %+v", clicks[2])
+	}
+
+	stats, err := s.GetAliasStats("a", 7, now)
+	check(t, err)
+	if stats.Total != 4 {
+		t.Errorf("alias a has %d clicks in total, expected 4", stats.Total)
+	}
+	if len(stats.Daily) != 7 {
+		t.Fatalf("got %d days of stats, expected 7", len(stats.Daily))
+	}
+	if stats.Daily[6].Count != 2 || stats.Daily[5].Count != 1 {
+		t.Errorf("got daily stats %+v", stats.Daily)
+	}
+	if stats.Daily[6].Percent != 100 || stats.Daily[5].Percent != 50 {
+		t.Errorf("got percentages %d and %d, expected 100 and 50", stats.Daily[6].Percent, stats.Daily[5].Percent)
+	}
+
+	// clicks that are recorded after their alias was removed are left out,
+	// so an alias that gets the name later doesn't start out with them
+	check(t, s.RmAlias(&server.Alias{Owner: "alice", Alias: "ab"}))
+	check(t, s.RecordClicks([]server.Click{{Alias: "ab", Time: now}, {Alias: "a", Time: now}}, 5))
+	createAlias(t, s, server.Alias{Owner: "alice", Alias: "ab", Url: "https://example.org"})
+	clicks, err = s.GetAliasClicks("ab")
+	check(t, err)
+	stats, err = s.GetAliasStats("ab", 7, now)
+	check(t, err)
+	if len(clicks) != 0 || stats.Total != 0 {
+		t.Errorf("new alias ab has %d clicks and a count of %d, expected none", len(clicks), stats.Total)
+	}
+	clicks, err = s.GetAliasClicks("a")
+	check(t, err)
+	if len(clicks) != 5 {
+		t.Errorf("alias a has %d clicks, expected 5", len(clicks))
+	}
+}
+
+func testInvites(t *testing.T, s server.Store) {
+	now := time.Now().Round(0)
+	check(t, s.CreateInvite(server.Invite{Id: "i1", Admin: true, Created: now, Expires: now.Add(time.Hour)}))
+	check(t, s.CreateInvite(server.Invite{Id: "i2", Created: now, Expires: now.Add(-time.Hour)}))
+	createUser(t, s, "alice")
+
+	invites, err := s.GetInvites()
+	check(t, err)
+	if len(invites) != 2 {
+		t.Errorf("got %d invites, expected 2", len(invites))
+	}
+
+	err = s.AcceptInvite("i1", server.User{Name: "alice"}, now)
+	if !errors.Is(err, server.ErrUserExists) {
+		t.Errorf("accepting an invite with a taken name returned %v, expected ErrUserExists", err)
+	}
+	err = s.AcceptInvite("i2", server.User{Name: "bob"}, now)
+	if !errors.Is(err, server.ErrInvalidInvite) {
+		t.Errorf("accepting an expired invite returned %v, expected ErrInvalidInvite", err)
+	}
+
+	check(t, s.AcceptInvite("i1", server.User{Name: "bob", Admin: true}, now))
+	user, err := s.GetUser("bob")
+	check(t, err)
+	if !user.Admin {
+		t.Errorf("user created with an admin invite isn't an admin")
+	}
+
+	invite, err := s.GetInvite("i1")
+	check(t, err)
+	if invite == nil || invite.Used == nil || invite.UsedBy != "bob" {
+		t.Errorf("invite wasn't marked as used: %+v", invite)
+	}
+
+	err = s.AcceptInvite("i1", server.User{Name: "carol"}, now)
+	if !errors.Is(err, server.ErrInvalidInvite) {
+		t.Errorf("accepting an invite twice returned %v, expected ErrInvalidInvite", err)
+	}
+
+	check(t, s.RmInvite("i2"))
+	invite, err = s.GetInvite("i2")
+	check(t, err)
+	if invite != nil {
+		t.Errorf("removed invite still exists")
+	}
+}
+
+func testSessionKeys(t *testing.T, s server.Store) {
+	keys, err := s.GetSessionKeys()
+	check(t, err)
+	if len(keys) != 0 {
+		t.Fatalf("got %d session keys in an empty store", len(keys))
+	}
+
+	start := time.Now()
+	first, err := server.RotateSessionKeys(s, start)
+	check(t, err)
+	second, err := server.RotateSessionKeys(s, start.Add(time.Hour))
+	check(t, err)
+	if len(second) != 2 || !bytes.Equal(second[1].Hash, first[0].Hash) || bytes.Equal(second[0].Hash, first[0].Hash) {
+		t.Fatalf("after rotating got %d keys, expected the new one and the old one", len(second))
+	}
+	if len(second[0].Block) != 32 {
+		t.Errorf("got an encryption key of %d bytes, expected 32", len(second[0].Block))
+	}
+
+	keys, err = s.GetSessionKeys()
+	check(t, err)
+	if len(keys) != 2 || !bytes.Equal(keys[0].Hash, second[0].Hash) || !bytes.Equal(keys[0].Block, second[0].Block) {
+		t.Errorf("got %d stored keys, expected the rotated ones", len(keys))
+	}
+
+	// the first key was replaced an hour after it was made, its cookies
+	// expire a month after that
+	third, err := server.RotateSessionKeys(s, start.Add(32*24*time.Hour))
+	check(t, err)
+	if len(third) != 2 || !bytes.Equal(third[1].Hash, second[0].Hash) {
+		t.Errorf("got %d keys after a month, expected the key that was replaced a month ago to be dropped", len(third))
+	}
+}
+
+func testSettings(t *testing.T, s server.Store) {
+	settings, err := s.GetSettings()
+	check(t, err)
+	if settings.RegistrationMode() != server.RegistrationDisabled {
+		t.Errorf("registration is %s by default, expected disabled", settings.RegistrationMode())
+	}
+
+	check(t, s.UpdateSettings(server.Settings{
+		Registration:   server.RegistrationApproval,
+		AllowedDomains: []string{"example.com"},
+	}))
+
+	settings, err = s.GetSettings()
+	check(t, err)
+	if settings.RegistrationMode() != server.RegistrationApproval || !equalNames(settings.AllowedDomains, "example.com") {
+		t.Errorf("got settings %+v", settings)
+	}
+}
+
+func backup(t *testing.T, s server.Store) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	check(t, s.Backup(&buf))
+	return buf.Bytes()
+}
+
+func readFile(t *testing.T, s server.Store, identifier string) string {
+	t.Helper()
+	_, data, err := s.OpenFile(identifier)
+	check(t, err)
+	defer data.Close()
+
+	read, err := ioutil.ReadAll(data)
+	check(t, err)
+	return string(read)
+}
+
+func testBackup(t *testing.T, s server.Store) {
+	createUser(t, s, "alice")
+	createUser(t, s, "bob")
+	createFile(t, s, "a.txt:1", "contents")
+	createAlias(t, s, server.Alias{Owner: "alice", Alias: "a", File: "a.txt:1"})
+	createAlias(t, s, server.Alias{Owner: "bob", Alias: "b", Url: "https://example.com"})
+	check(t, s.CreateToken(server.Token{Id: "t1", Owner: "alice", Name: "one"}))
+	check(t, s.RecordClicks([]server.Click{{Alias: "a", Time: time.Now()}}, 0))
+
+	archive := backup(t, s)
+
+	// change everything, a restore in replace mode undoes all of it
+	check(t, s.RmUser("bob"))
+	createUser(t, s, "carol")
+	createAlias(t, s, server.Alias{Owner: "carol", Alias: "c", Url: "https://example.org"})
+	check(t, s.RmToken("t1"))
+	check(t, s.CreateSession(server.LoginSession{Id: "s1", Owner: "alice"}))
+	check(t, s.CreateSession(server.LoginSession{Id: "s2", Owner: "carol"}))
+	keys, err := server.RotateSessionKeys(s, time.Now())
+	check(t, err)
+	check(t, s.UpdateAlias("a", server.Alias{Owner: "alice", Alias: "a2", File: "a.txt:1"}))
+
+	report, err := s.Restore(bytes.NewReader(archive), server.RestoreReplace)
+	check(t, err)
+	if report.Restored["users"] != 2 || report.Restored["aliases"] != 2 || report.Restored["files"] != 1 {
+		t.Errorf("got report %v", report)
+	}
+
+	users, err := s.GetUsers()
+	check(t, err)
+	var names []string
+	for _, user := range users {
+		names = append(names, user.Name)
+	}
+	if !equalNames(names, "alice", "bob") {
+		t.Errorf("got users %v after restoring", names)
+	}
+
+	aliases, err := s.GetAliases()
+	check(t, err)
+	if !equalNames(aliasNames(aliases), "a", "b") {
+		t.Errorf("got aliases %v after restoring", aliasNames(aliases))
+	}
+	if !equalNames(userAliases(t, s, "bob"), "b") {
+		t.Errorf("owner index of bob wasn't restored")
+	}
+	if contents := readFile(t, s, "a.txt:1"); contents != "contents" {
+		t.Errorf("file has contents %q after restoring", contents)
+	}
+
+	token, err := s.GetToken("t1")
+	check(t, err)
+	if token == nil {
+		t.Errorf("token wasn't restored")
+	}
+
+	clicks, err := s.GetAliasClicks("a")
+	check(t, err)
+	if len(clicks) != 1 {
+		t.Errorf("alias a has %d clicks after restoring, expected 1", len(clicks))
+	}
+	stats, err := s.GetAliasStats("a", 7, time.Now())
+	check(t, err)
+	if stats.Total != 1 {
+		t.Errorf("alias a has %d clicks counted after restoring, expected 1", stats.Total)
+	}
+
+	problems, err := s.CheckOwners(false)
+	check(t, err)
+	if len(problems) != 0 {
+		t.Errorf("restore left problems: %v", problems)
+	}
+
+	// sessions and session keys aren't backed up, they are kept except for
+	// the sessions of users that are gone
+	session, err := s.GetSession("s1")
+	check(t, err)
+	if session == nil {
+		t.Errorf("session of alice was removed by restoring")
+	}
+	session, err = s.GetSession("s2")
+	check(t, err)
+	if session != nil {
+		t.Errorf("session of carol is still there after restoring")
+	}
+	restoredKeys, err := s.GetSessionKeys()
+	check(t, err)
+	if len(restoredKeys) != 1 || !bytes.Equal(restoredKeys[0].Hash, keys[0].Hash) {
+		t.Errorf("session keys were changed by restoring")
+	}
+}
+
+func testRestoreMerge(t *testing.T, s server.Store) {
+	createUser(t, s, "alice")
+	createFile(t, s, "a.txt:1", "old")
+	createAlias(t, s, server.Alias{Owner: "alice", Alias: "a", File: "a.txt:1"})
+	createAlias(t, s, server.Alias{Owner: "alice", Alias: "b", Url: "https://example.com"})
+	createUser(t, s, "dave")
+	check(t, s.CreateToken(server.Token{Id: "t1", Owner: "alice", Name: "one"}))
+	check(t, s.CreateToken(server.Token{Id: "t2", Owner: "dave", Name: "two"}))
+
+	archive := backup(t, s)
+
+	check(t, s.RmAlias(&server.Alias{Alias: "b"}))
+	check(t, s.UpdateAlias("a", server.Alias{Owner: "alice", Alias: "a", Url: "https://example.org"}))
+	check(t, s.RmToken("t1"))
+	check(t, s.RmUser("dave"))
+
+	report, err := s.Restore(bytes.NewReader(archive), server.RestoreMerge)
+	check(t, err)
+	if report.Restored["aliases"] != 1 || report.Skipped["aliases"] != 1 || report.Skipped["users"] != 1 {
+		t.Errorf("got report %v", report)
+	}
+
+	// the alias that was still there is kept as it is, without the file it
+	// had in the backup
+	alias, err := s.GetAlias("a")
+	check(t, err)
+	if alias == nil || alias.Url != "https://example.org" {
+		t.Errorf("existing alias was changed to %+v", alias)
+	}
+	if _, err := s.GetFile("a.txt:1"); err == nil {
+		t.Errorf("file of a skipped alias was restored")
+	}
+
+	alias, err = s.GetAlias("b")
+	check(t, err)
+	if alias == nil {
+		t.Errorf("removed alias wasn't restored")
+	}
+	if !equalNames(userAliases(t, s, "alice"), "a", "b") {
+		t.Errorf("alice has aliases %v", userAliases(t, s, "alice"))
+	}
+
+	// the alice that is already there may not be the one in the backup, so
+	// she doesn't get its tokens. Those of a user that is restored are.
+	if token, err := s.GetToken("t1"); err != nil || token != nil {
+		t.Errorf("token of a skipped user was restored: %+v, %v", token, err)
+	}
+	if token, err := s.GetToken("t2"); err != nil || token == nil {
+		t.Errorf("token of a restored user wasn't restored: %+v, %v", token, err)
+	}
+}
+
+func testRestoreInvalid(t *testing.T, s server.Store) {
+	createUser(t, s, "alice")
+
+	for _, mode := range []string{server.RestoreMerge, server.RestoreReplace} {
+		_, err := s.Restore(strings.NewReader("not a backup"), mode)
+		if !errors.Is(err, server.ErrInvalidBackup) {
+			t.Errorf("restoring garbage in %s mode returned %v, expected ErrInvalidBackup", mode, err)
+		}
+	}
+
+	// a backup cut short is invalid as well
+	archive := backup(t, s)
+	_, err := s.Restore(bytes.NewReader(archive[:len(archive)/2]), server.RestoreReplace)
+	if !errors.Is(err, server.ErrInvalidBackup) {
+		t.Errorf("restoring half a backup returned %v, expected ErrInvalidBackup", err)
+	}
+
+	if _, err := s.GetUser("alice"); err != nil {
+		t.Errorf("user is gone after a failed restore: %v", err)
+	}
+}
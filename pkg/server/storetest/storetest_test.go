@@ -0,0 +1,11 @@
+package storetest_test
+
+import (
+	"testing"
+
+	"github.com/jonay2000/short/pkg/server/storetest"
+)
+
+func TestStore(t *testing.T) {
+	storetest.RunAll(t)
+}
@@ -0,0 +1,327 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Password guesses are slowed down per client ip, per user and per protected
+// alias. After a few free attempts, every failure doubles the time until the
+// next attempt is allowed, until whoever is guessing is locked out for a while.
+// The counts are kept in memory, guessing shouldn't cause writes to the store.
+
+// The kinds of things guesses are counted for.
+const (
+	ThrottleIP    = "ip"
+	ThrottleUser  = "user"
+	ThrottleAlias = "alias"
+)
+
+type throttlePolicy struct {
+	// free is the number of attempts that can be made without waiting.
+	free int
+	// lockout is the number of attempts after which there is a lockout.
+	lockout int
+}
+
+// Many people can share an ip, so it gets more attempts than a user.
+var throttlePolicies = map[string]throttlePolicy{
+	ThrottleIP:    {free: 20, lockout: 50},
+	ThrottleUser:  {free: 5, lockout: 10},
+	ThrottleAlias: {free: 5, lockout: 10},
+}
+
+const throttleLockout = 15 * time.Minute
+
+// Failures are forgotten once there haven't been any for this long.
+const throttleForget = time.Hour
+
+// At most this many keys are counted, so guessing with made up names can't use
+// up all memory. The ones that were seen the longest ago are forgotten first.
+const throttleMaxKeys = 100000
+
+// The number of failed attempts admins can look back on.
+const throttleLogSize = 100
+
+// delay is how long to wait after the last attempt, when failures attempts
+// have been made.
+func (p throttlePolicy) delay(failures int) time.Duration {
+	if failures < p.free {
+		return 0
+	}
+	if failures >= p.lockout || failures-p.free >= 20 {
+		return throttleLockout
+	}
+
+	delay := time.Second << uint(failures-p.free)
+	if delay > throttleLockout {
+		return throttleLockout
+	}
+	return delay
+}
+
+// ThrottleKey is what attempts are counted for.
+type ThrottleKey struct {
+	Kind string
+	Name string
+}
+
+func (k ThrottleKey) String() string {
+	return k.Kind + ":" + k.Name
+}
+
+// ParseThrottleKey reads a key written by ThrottleKey.String.
+func ParseThrottleKey(key string) (ThrottleKey, error) {
+	i := strings.IndexByte(key, ':')
+	if i < 0 {
+		return ThrottleKey{}, fmt.Errorf("invalid throttle key %q", key)
+	}
+	if _, ok := throttlePolicies[key[:i]]; !ok {
+		return ThrottleKey{}, fmt.Errorf("invalid throttle key %q", key)
+	}
+
+	return ThrottleKey{key[:i], key[i+1:]}, nil
+}
+
+// IPKey counts attempts from ip. IPv6 clients usually have a whole /64, so
+// that's what they are counted by.
+func IPKey(ip net.IP) ThrottleKey {
+	if ip == nil {
+		return ThrottleKey{ThrottleIP, "unknown"}
+	}
+	if ip.To4() == nil {
+		network := net.IPNet{IP: ip.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}
+		return ThrottleKey{ThrottleIP, network.String()}
+	}
+
+	return ThrottleKey{ThrottleIP, ip.String()}
+}
+
+func UserKey(name string) ThrottleKey {
+	return ThrottleKey{ThrottleUser, name}
+}
+
+func AliasKey(name string) ThrottleKey {
+	return ThrottleKey{ThrottleAlias, name}
+}
+
+// FailedAttempt is a wrong password or code someone tried.
+type FailedAttempt struct {
+	Time time.Time
+	// What was guessed: a password, a code or the password of an alias.
+	What string
+	// Name is the user or alias the attempt was for.
+	Name string
+	IP   string
+}
+
+// Lockout is a key of which attempts are being slowed down or locked out.
+type Lockout struct {
+	Key      ThrottleKey
+	Failures int
+	// Until is when the next attempt can be made.
+	Until  time.Time
+	Locked bool
+}
+
+type throttleEntry struct {
+	failures int
+	last     time.Time
+}
+
+// Throttle counts the password attempts made for keys.
+type Throttle struct {
+	mu      sync.Mutex
+	entries map[ThrottleKey]*throttleEntry
+	// log holds the last failed attempts, next is where the next one goes.
+	log  []FailedAttempt
+	next int
+}
+
+func NewThrottle() *Throttle {
+	return &Throttle{
+		entries: make(map[ThrottleKey]*throttleEntry),
+	}
+}
+
+func (t *Throttle) entry(key ThrottleKey, now time.Time) *throttleEntry {
+	entry, ok := t.entries[key]
+	if !ok || now.Sub(entry.last) > throttleForget {
+		return nil
+	}
+	return entry
+}
+
+func (t *Throttle) wait(key ThrottleKey, now time.Time) time.Duration {
+	entry := t.entry(key, now)
+	if entry == nil {
+		return 0
+	}
+
+	wait := entry.last.Add(throttlePolicies[key.Kind].delay(entry.failures)).Sub(now)
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// Attempt returns how long to wait before an attempt can be made for keys, or
+// 0 when it can be made now. Attempts that can be made are counted as failures
+// right away, so guesses made at the same time can't all get through. When the
+// attempt turns out to be right, call Succeed.
+func (t *Throttle) Attempt(now time.Time, keys ...ThrottleKey) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var wait time.Duration
+	for _, key := range keys {
+		if w := t.wait(key, now); w > wait {
+			wait = w
+		}
+	}
+	if wait > 0 {
+		return wait
+	}
+
+	for _, key := range keys {
+		entry := t.entry(key, now)
+		if entry == nil {
+			t.makeRoom(now)
+			entry = &throttleEntry{}
+			t.entries[key] = entry
+		}
+		entry.failures += 1
+		entry.last = now
+	}
+
+	return 0
+}
+
+// Succeed takes back the failure counted by Attempt, for an attempt that was
+// right. The failures of the keys in reset are all forgotten.
+func (t *Throttle) Succeed(keys []ThrottleKey, reset ...ThrottleKey) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, key := range keys {
+		entry, ok := t.entries[key]
+		if !ok {
+			continue
+		}
+		entry.failures -= 1
+		if entry.failures <= 0 {
+			delete(t.entries, key)
+		}
+	}
+
+	for _, key := range reset {
+		delete(t.entries, key)
+	}
+}
+
+// Fail logs a failed attempt. It was already counted by Attempt.
+func (t *Throttle) Fail(attempt FailedAttempt) {
+	log.Printf("wrong %s for %s from %s", attempt.What, attempt.Name, attempt.IP)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.log) < throttleLogSize {
+		t.log = append(t.log, attempt)
+	} else {
+		t.log[t.next] = attempt
+	}
+	t.next = (t.next + 1) % throttleLogSize
+}
+
+// FailedAttempts returns the last failed attempts, the latest first.
+func (t *Throttle) FailedAttempts() []FailedAttempt {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	res := make([]FailedAttempt, 0, len(t.log))
+	for i := 1; i <= len(t.log); i++ {
+		res = append(res, t.log[(t.next-i+len(t.log))%len(t.log)])
+	}
+	return res
+}
+
+// Lockouts returns the keys that have to wait before the next attempt, or
+// will after the next failure.
+func (t *Throttle) Lockouts(now time.Time) []Lockout {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var res []Lockout
+	for key := range t.entries {
+		entry := t.entry(key, now)
+		if entry == nil {
+			continue
+		}
+
+		policy := throttlePolicies[key.Kind]
+		if entry.failures < policy.free {
+			continue
+		}
+
+		until := entry.last.Add(policy.delay(entry.failures))
+		res = append(res, Lockout{
+			Key:      key,
+			Failures: entry.failures,
+			Until:    until,
+			Locked:   entry.failures >= policy.lockout && until.After(now),
+		})
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Key.String() < res[j].Key.String()
+	})
+
+	return res
+}
+
+// Clear forgets the failures of key, so attempts can be made right away.
+func (t *Throttle) Clear(key ThrottleKey) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.entries, key)
+}
+
+// makeRoom forgets old keys when there are too many. It has to be called with
+// the lock held.
+func (t *Throttle) makeRoom(now time.Time) {
+	if len(t.entries) < throttleMaxKeys {
+		return
+	}
+
+	var oldest ThrottleKey
+	var oldestTime time.Time
+	for key, entry := range t.entries {
+		if now.Sub(entry.last) > throttleForget {
+			delete(t.entries, key)
+			continue
+		}
+		if oldestTime.IsZero() || entry.last.Before(oldestTime) {
+			oldest, oldestTime = key, entry.last
+		}
+	}
+
+	if len(t.entries) >= throttleMaxKeys {
+		delete(t.entries, oldest)
+	}
+}
+
+// retryAfter is how long to wait in whole seconds, rounded up.
+func retryAfter(wait time.Duration) int {
+	return int((wait + time.Second - 1) / time.Second)
+}
+
+func tooManyAttempts(wait time.Duration) string {
+	return fmt.Sprintf("too many failed attempts, try again in %s", time.Duration(retryAfter(wait))*time.Second)
+}
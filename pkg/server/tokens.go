@@ -0,0 +1,224 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"strings"
+	"time"
+)
+
+const tokenPrefix = "token_"
+
+// API tokens look like st_<id><secret>. Only the id is ever shown again after a
+// token is created, the full token is only stored as a hash.
+const tokenMarker = "st_"
+const tokenIdLength = 8
+const tokenSecretLength = 32
+
+// Last used timestamps are only written when they are older than this, so
+// scripts making lots of requests don't cause a write for every one of them.
+const tokenTouchInterval = time.Minute
+
+var ErrInvalidToken = errors.New("invalid token")
+
+type Token struct {
+	Id       string
+	Owner    string
+	Name     string
+	Hash     []byte
+	Created  time.Time
+	Expires  *time.Time
+	LastUsed *time.Time
+}
+
+// Prefix is the part of the token that can be shown to identify it.
+func (t Token) Prefix() string {
+	return tokenMarker + t.Id
+}
+
+func (t Token) Expired(now time.Time) bool {
+	return t.Expires != nil && now.After(*t.Expires)
+}
+
+func hashToken(token string) []byte {
+	h := sha256.Sum256([]byte(token))
+	return h[:]
+}
+
+// parseTokenId returns the id part of a token, without checking whether the
+// token is valid.
+func parseTokenId(token string) (string, error) {
+	if !strings.HasPrefix(token, tokenMarker) {
+		return "", ErrInvalidToken
+	}
+	token = strings.TrimPrefix(token, tokenMarker)
+	if len(token) != tokenIdLength+tokenSecretLength {
+		return "", ErrInvalidToken
+	}
+
+	return token[:tokenIdLength], nil
+}
+
+func (s kvStore) CreateToken(token Token) error {
+	return s.db.Update(func(txn kvTxn) error {
+		return setJson(txn, prefix(tokenPrefix, token.Id), &token)
+	})
+}
+
+func (s kvStore) GetToken(id string) (*Token, error) {
+	var res *Token
+	return res, s.db.View(func(txn kvTxn) error {
+		err := getJson(txn, prefix(tokenPrefix, id), &res)
+		if err == ErrNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+func (s kvStore) GetUserTokens(owner string) ([]Token, error) {
+	var res []Token
+	return res, s.db.View(func(txn kvTxn) error {
+		return iterateValues(txn, []byte(tokenPrefix), func(key []byte, val []byte) error {
+			var token Token
+			if err := decodeJson(val, &token); err != nil {
+				return err
+			}
+
+			if token.Owner == owner {
+				res = append(res, token)
+			}
+			return nil
+		})
+	})
+}
+
+// TouchToken marks a token as used at now. Tokens are often used by several
+// requests at the same time, so conflicting updates are tried again.
+func (s kvStore) TouchToken(id string, now time.Time) error {
+	return s.update(func(txn kvTxn, remove func(blob string)) error {
+		var token Token
+		err := getJson(txn, prefix(tokenPrefix, id), &token)
+		if err != nil {
+			return err
+		}
+
+		token.LastUsed = &now
+
+		return setJson(txn, prefix(tokenPrefix, token.Id), &token)
+	})
+}
+
+func (s kvStore) RmToken(id string) error {
+	return s.db.Update(func(txn kvTxn) error {
+		return txn.Delete(prefix(tokenPrefix, id))
+	})
+}
+
+// rmUserTokens removes all tokens owned by owner as part of txn.
+func (s kvStore) rmUserTokens(txn kvTxn, owner string) error {
+	var toRemove [][]byte
+
+	err := iterateValues(txn, []byte(tokenPrefix), func(key []byte, val []byte) error {
+		var token Token
+		if err := decodeJson(val, &token); err != nil {
+			return err
+		}
+
+		if token.Owner == owner {
+			toRemove = append(toRemove, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range toRemove {
+		if err := txn.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CreateToken creates a new api token for owner. The returned string is the
+// token itself, which can't be recovered later.
+func (lm LoginManager) CreateToken(owner string, name string, expires *time.Time) (string, Token, error) {
+	id, err := SecureRandSeq(tokenIdLength)
+	if err != nil {
+		return "", Token{}, err
+	}
+	secret, err := SecureRandSeq(tokenSecretLength)
+	if err != nil {
+		return "", Token{}, err
+	}
+
+	value := tokenMarker + id + secret
+	token := Token{
+		Id:      id,
+		Owner:   owner,
+		Name:    name,
+		Hash:    hashToken(value),
+		Created: time.Now(),
+		Expires: expires,
+	}
+
+	return value, token, lm.store.CreateToken(token)
+}
+
+// TokenUser returns the user an api token belongs to, or ErrInvalidToken when
+// the token doesn't exist or has expired.
+func (lm LoginManager) TokenUser(value string) (*User, error) {
+	id, err := parseTokenId(value)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := lm.store.GetToken(id)
+	if err != nil {
+		return nil, err
+	}
+	if token == nil {
+		return nil, ErrInvalidToken
+	}
+
+	if subtle.ConstantTimeCompare(token.Hash, hashToken(value)) != 1 {
+		return nil, ErrInvalidToken
+	}
+
+	now := time.Now()
+	if token.Expired(now) {
+		return nil, ErrInvalidToken
+	}
+
+	if token.LastUsed == nil || now.Sub(*token.LastUsed) > tokenTouchInterval {
+		// when it was last used is only shown to the owner, failing to
+		// store it doesn't have to fail the request
+		err := lm.store.TouchToken(id, now)
+		if err == ErrNotFound {
+			return nil, ErrInvalidToken
+		} else if err != nil {
+			log.Printf("failed to mark token %s as used: %v", id, err)
+		}
+	}
+
+	user, err := lm.store.GetUser(token.Owner)
+	if err == ErrNotFound {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user.Pending {
+		return nil, ErrInvalidToken
+	}
+	if err := lm.restrictAdmin(&user); err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
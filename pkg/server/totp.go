@@ -0,0 +1,292 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// Two-factor authentication uses time-based one-time passwords (RFC 6238) with
+// the parameters every authenticator app supports: HMAC-SHA1, six digits and a
+// new code every 30 seconds. Codes of the step before and after the current
+// one are accepted as well, for clocks that are a little off.
+const totpPeriod = 30
+const totpDigits = 6
+const totpSkew = 1
+const totpSecretLength = 20
+const totpIssuer = "short"
+
+// Recovery codes can be used instead of a code when the authenticator is
+// lost. Every one of them works once.
+const recoveryCodeCount = 10
+const recoveryCodeLength = 10
+
+var (
+	ErrSecondFactorRequired = errors.New("second factor required")
+	ErrInvalidCode          = errors.New("invalid code")
+	ErrTOTPNotEnrolled      = errors.New("two-factor authentication isn't being set up")
+	ErrTOTPEnabled          = errors.New("two-factor authentication is already enabled")
+	ErrTOTPDisabled         = errors.New("two-factor authentication isn't enabled")
+)
+
+// Someone who logged in with their password has this long to enter their
+// second factor.
+const secondFactorTimeout = 5 * time.Minute
+
+// PendingLogin is kept in the session of someone who logged in with their
+// password, until they enter their second factor.
+type PendingLogin struct {
+	Name    string
+	Expires time.Time
+}
+
+func NewPendingLogin(name string, now time.Time) PendingLogin {
+	return PendingLogin{
+		Name:    name,
+		Expires: now.Add(secondFactorTimeout),
+	}
+}
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode returns the code of secret for the given time step.
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// checkTOTP returns the time step code belongs to, if it is a valid code for
+// secret around now.
+func checkTOTP(secret string, code string, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+func newTOTPSecret() (string, error) {
+	secret := make([]byte, totpSecretLength)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// TOTPUri is what the QR code scanned by an authenticator app holds.
+func TOTPUri(name string, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", totpIssuer)
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+
+	return fmt.Sprintf("otpauth://totp/%s:%s?%s", totpIssuer, url.PathEscape(name), v.Encode())
+}
+
+// TOTPQRCode renders the QR code of a secret as a png image.
+func TOTPQRCode(name string, secret string) ([]byte, error) {
+	return qrcode.Encode(TOTPUri(name, secret), qrcode.Medium, 256)
+}
+
+// normalizeCode removes what people tend to type in between the characters
+// of a code.
+func normalizeCode(code string) string {
+	return strings.Map(func(c rune) rune {
+		if c == ' ' || c == '-' {
+			return -1
+		}
+		return c
+	}, code)
+}
+
+func newRecoveryCodes() ([]string, [][]byte, error) {
+	var codes []string
+	var hashes [][]byte
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := SecureRandSeq(recoveryCodeLength)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		codes = append(codes, code)
+		hashes = append(hashes, hashToken(code))
+	}
+
+	return codes, hashes, nil
+}
+
+// totpRequired reports whether user has to set up two-factor authentication
+// before they can use their admin rights.
+func (lm LoginManager) totpRequired(user User) (bool, error) {
+	if !user.Admin || user.TOTPSecret != "" {
+		return false, nil
+	}
+
+	settings, err := lm.store.GetSettings()
+	if err != nil {
+		return false, err
+	}
+
+	return settings.RequireAdminTOTP, nil
+}
+
+// restrictAdmin takes away the admin rights of user for as long as they
+// haven't set up two-factor authentication while admins are required to. The
+// user must not be stored afterwards.
+func (lm LoginManager) restrictAdmin(user *User) error {
+	required, err := lm.totpRequired(*user)
+	if err != nil || !required {
+		return err
+	}
+
+	user.Admin = false
+	user.AdminNeedsTOTP = true
+	return nil
+}
+
+// BeginTOTP starts setting up two-factor authentication for user with a new
+// secret, which only takes effect once EnableTOTP is called with a code of it.
+func (lm LoginManager) BeginTOTP(name string) (string, error) {
+	user, err := lm.store.GetUser(name)
+	if err != nil {
+		return "", err
+	}
+	if user.TOTPSecret != "" {
+		return "", ErrTOTPEnabled
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return "", err
+	}
+
+	user.TOTPPending = secret
+	return secret, lm.store.UpdateUser(&user)
+}
+
+// EnableTOTP enables two-factor authentication when code belongs to the secret
+// made by BeginTOTP. It returns the recovery codes, which can't be recovered
+// later.
+func (lm LoginManager) EnableTOTP(name string, code string) ([]string, error) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, lm.store.ChangeUser(name, func(user *User) error {
+		if user.TOTPSecret != "" {
+			return ErrTOTPEnabled
+		}
+		if user.TOTPPending == "" {
+			return ErrTOTPNotEnrolled
+		}
+
+		step, ok := checkTOTP(user.TOTPPending, normalizeCode(code), time.Now())
+		if !ok {
+			return ErrInvalidCode
+		}
+
+		user.TOTPSecret = user.TOTPPending
+		user.TOTPPending = ""
+		user.TOTPLastStep = step
+		user.RecoveryCodes = hashes
+		return nil
+	})
+}
+
+// CancelTOTP throws away the secret made by BeginTOTP.
+func (lm LoginManager) CancelTOTP(name string) error {
+	user, err := lm.store.GetUser(name)
+	if err != nil {
+		return err
+	}
+
+	user.TOTPPending = ""
+	return lm.store.UpdateUser(&user)
+}
+
+// DisableTOTP turns two-factor authentication off, which takes a code or a
+// recovery code to prove the authenticator is still there.
+func (lm LoginManager) DisableTOTP(name string, code string) error {
+	return lm.store.ChangeUser(name, func(user *User) error {
+		if err := useSecondFactor(user, code); err != nil {
+			return err
+		}
+
+		user.TOTPSecret = ""
+		user.TOTPLastStep = 0
+		user.RecoveryCodes = nil
+		return nil
+	})
+}
+
+// useSecondFactor checks a code or recovery code of user, and uses it up. It
+// has to be called from Store.ChangeUser, so a code that is entered twice at
+// the same time is only accepted once.
+func useSecondFactor(user *User, code string) error {
+	if user.TOTPSecret == "" {
+		return ErrTOTPDisabled
+	}
+
+	code = normalizeCode(code)
+
+	// codes can't be used twice, even within the time they are valid
+	if step, ok := checkTOTP(user.TOTPSecret, code, time.Now()); ok && step > user.TOTPLastStep {
+		user.TOTPLastStep = step
+		return nil
+	}
+
+	hash := hashToken(code)
+	for i, recovery := range user.RecoveryCodes {
+		if subtle.ConstantTimeCompare(recovery, hash) == 1 {
+			user.RecoveryCodes = append(user.RecoveryCodes[:i:i], user.RecoveryCodes[i+1:]...)
+			return nil
+		}
+	}
+
+	return ErrInvalidCode
+}
+
+// SecondFactor is the second step of logging in for users with two-factor
+// authentication, after LogIn returned ErrSecondFactorRequired.
+func (lm LoginManager) SecondFactor(name string, code string) (SessionUser, error) {
+	err := lm.store.ChangeUser(name, func(user *User) error {
+		return useSecondFactor(user, code)
+	})
+	if err != nil {
+		return SessionUser{}, err
+	}
+
+	return SessionUser{
+		Name: name,
+	}, nil
+}
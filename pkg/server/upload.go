@@ -0,0 +1,144 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/textproto"
+	url2 "net/url"
+)
+
+// Form values other than the uploaded file are kept in memory, so they are
+// limited to this size.
+const maxFormValueSize = 64 * 1024
+
+// Forms with files can't be larger than this, unless MAX_UPLOAD_SIZE says
+// otherwise.
+const defaultMaxUploadSize = 100 << 20
+
+var errFormValueTooLarge = errors.New("form value too large")
+var errMultipleFiles = errors.New("only one file can be uploaded at a time")
+var ErrUploadTooLarge = errors.New("upload too large")
+
+func uploadTooLarge(limit int64) string {
+	if limit%(1<<20) == 0 {
+		return fmt.Sprintf("file is too large, it can be at most %d MB", limit>>20)
+	}
+	return fmt.Sprintf("file is too large, it can be at most %.1f MB", float64(limit)/(1<<20))
+}
+
+// uploadBody counts how much of a body has been read, to tell whether reading
+// it failed because it was larger than the limit.
+type uploadBody struct {
+	io.ReadCloser
+	read int64
+}
+
+func (b *uploadBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	return n, err
+}
+
+// uploadForm holds the values of a multipart form of which the uploaded file,
+// if there was one, has already been stored.
+type uploadForm struct {
+	store  Store
+	values url2.Values
+	// File is the identifier of the uploaded file, or empty when no file
+	// was uploaded.
+	File string
+}
+
+func (f *uploadForm) FormValue(key string) string {
+	return f.values.Get(key)
+}
+
+// Discard removes the uploaded file. Call it when the upload ends up not being
+// used, for example because another value in the form was invalid.
+func (f *uploadForm) Discard() {
+	if f.File == "" {
+		return
+	}
+
+	if err := f.store.RmFile(f.File); err != nil {
+		log.Printf("%v", err)
+	}
+	f.File = ""
+}
+
+// parseUploadForm reads a multipart form of at most limit bytes. A file in the
+// part called "file" is streamed into the store while it is received, instead
+// of first being buffered in memory or a temporary file. When the form is
+// larger than limit, ErrUploadTooLarge is returned and nothing is kept of the
+// file, the blob store removes what it had written.
+func parseUploadForm(store Store, w http.ResponseWriter, r *http.Request, limit int64) (*uploadForm, error) {
+	body := &uploadBody{ReadCloser: http.MaxBytesReader(w, r.Body, limit)}
+	r.Body = body
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	form := &uploadForm{
+		store:  store,
+		values: url2.Values{},
+	}
+	fail := func(err error) (*uploadForm, error) {
+		form.Discard()
+		if body.read >= limit {
+			return nil, ErrUploadTooLarge
+		}
+		return nil, err
+	}
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return form, nil
+		}
+		if err != nil {
+			return fail(err)
+		}
+
+		if part.FormName() == "file" && part.FileName() != "" {
+			if form.File != "" {
+				return fail(errMultipleFiles)
+			}
+
+			form.File, err = storeUpload(store, part.FileName(), part.Header, part)
+			if err != nil {
+				return fail(err)
+			}
+			continue
+		}
+
+		value, err := ioutil.ReadAll(io.LimitReader(part, maxFormValueSize+1))
+		if err != nil {
+			return fail(err)
+		}
+		if len(value) > maxFormValueSize {
+			return fail(errFormValueTooLarge)
+		}
+
+		form.values.Add(part.FormName(), string(value))
+	}
+}
+
+// storeUpload saves an uploaded file in the store and returns the identifier it
+// was stored under.
+func storeUpload(store Store, filename string, mime textproto.MIMEHeader, data io.Reader) (string, error) {
+	fileIdentifier := fmt.Sprintf("%s:%s", filename, RandSeq(20))
+
+	file, err := store.CreateFile(fileIdentifier, mime, data)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("uploaded %s (%d bytes)", fileIdentifier, file.Size)
+
+	return fileIdentifier, nil
+}
@@ -0,0 +1,673 @@
+package server
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Users can log in with passkeys, WebAuthn credentials that live on their
+// devices, instead of with their password. Only what passkeys need is
+// implemented: credentials are discoverable, so logging in doesn't ask for a
+// username, and the authenticator always verifies the user, with a pin or
+// biometrics. Attestation isn't asked for, so it isn't checked either.
+
+const webAuthnTimeout = 2 * time.Minute
+const webAuthnChallengeLength = 32
+const webAuthnUserIdLength = 32
+const webAuthnRpName = "short"
+
+// The COSE algorithms public keys can use, in order of preference.
+const (
+	coseES256 = -7
+	coseEdDSA = -8
+	coseRS256 = -257
+)
+
+// Flags in authenticator data.
+const (
+	authDataUserPresent  = 0x01
+	authDataUserVerified = 0x04
+	authDataAttested     = 0x40
+)
+
+var (
+	ErrInvalidCredential   = errors.New("invalid passkey")
+	ErrUnknownCredential   = errors.New("unknown passkey")
+	ErrCredentialExists    = errors.New("this passkey was already added")
+	ErrChallengeExpired    = errors.New("took too long to use the passkey, try again")
+	ErrUnsupportedKey      = errors.New("the passkey uses an unsupported kind of key")
+	ErrSignCountRegression = errors.New("the passkey may have been cloned")
+)
+
+// WebAuthnCredential is a passkey of a user.
+type WebAuthnCredential struct {
+	Id []byte
+	// Name is what the user called the passkey, to tell them apart.
+	Name string
+	// PublicKey is the COSE encoded public key of the passkey.
+	PublicKey []byte
+	// SignCount is the last signature counter of the passkey. Most passkeys
+	// keep it at zero, but if it goes down the passkey was copied.
+	SignCount uint32
+	Created   time.Time
+	LastUsed  *time.Time
+}
+
+// EncodedId is the id of the credential like browsers show it.
+func (c WebAuthnCredential) EncodedId() string {
+	return base64.RawURLEncoding.EncodeToString(c.Id)
+}
+
+// WebAuthnChallenge is kept in the session between the start and end of a
+// registration or login.
+type WebAuthnChallenge struct {
+	Challenge []byte
+	// Name is the user adding a passkey, and empty when logging in.
+	Name    string
+	Expires time.Time
+}
+
+// webAuthnBytes are binary values, which WebAuthn json represents as
+// unpadded base64url.
+type webAuthnBytes []byte
+
+func (b webAuthnBytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+func (b *webAuthnBytes) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	res, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return err
+	}
+
+	*b = res
+	return nil
+}
+
+type webAuthnEntity struct {
+	Id          webAuthnBytes `json:"id,omitempty"`
+	Name        string        `json:"name"`
+	DisplayName string        `json:"displayName,omitempty"`
+}
+
+type webAuthnRp struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type webAuthnParam struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+type webAuthnDescriptor struct {
+	Type string        `json:"type"`
+	Id   webAuthnBytes `json:"id"`
+}
+
+// WebAuthnCreationOptions are passed to navigator.credentials.create.
+type WebAuthnCreationOptions struct {
+	Challenge              webAuthnBytes        `json:"challenge"`
+	Rp                     webAuthnRp           `json:"rp"`
+	User                   webAuthnEntity       `json:"user"`
+	PubKeyCredParams       []webAuthnParam      `json:"pubKeyCredParams"`
+	Timeout                int64                `json:"timeout"`
+	ExcludeCredentials     []webAuthnDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection struct {
+		ResidentKey        string `json:"residentKey"`
+		RequireResidentKey bool   `json:"requireResidentKey"`
+		UserVerification   string `json:"userVerification"`
+	} `json:"authenticatorSelection"`
+	Attestation string `json:"attestation"`
+}
+
+// WebAuthnRequestOptions are passed to navigator.credentials.get.
+type WebAuthnRequestOptions struct {
+	Challenge        webAuthnBytes `json:"challenge"`
+	RpId             string        `json:"rpId"`
+	Timeout          int64         `json:"timeout"`
+	UserVerification string        `json:"userVerification"`
+}
+
+// WebAuthnAttestation is the credential navigator.credentials.create returns.
+type WebAuthnAttestation struct {
+	Id       webAuthnBytes `json:"rawId"`
+	Type     string        `json:"type"`
+	Response struct {
+		ClientDataJSON    webAuthnBytes `json:"clientDataJSON"`
+		AttestationObject webAuthnBytes `json:"attestationObject"`
+	} `json:"response"`
+}
+
+// WebAuthnAssertion is the credential navigator.credentials.get returns.
+type WebAuthnAssertion struct {
+	Id       webAuthnBytes `json:"rawId"`
+	Type     string        `json:"type"`
+	Response struct {
+		ClientDataJSON    webAuthnBytes `json:"clientDataJSON"`
+		AuthenticatorData webAuthnBytes `json:"authenticatorData"`
+		Signature         webAuthnBytes `json:"signature"`
+		UserHandle        webAuthnBytes `json:"userHandle"`
+	} `json:"response"`
+}
+
+type webAuthnClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+type webAuthnAuthData struct {
+	RpIdHash     []byte
+	Flags        byte
+	SignCount    uint32
+	CredentialId []byte
+	PublicKey    []byte
+}
+
+// WebAuthn checks passkeys for the site at one origin.
+type WebAuthn struct {
+	lm     *LoginManager
+	rpId   string
+	origin string
+	used   *usedChallenges
+	adding *sync.Mutex
+}
+
+// usedChallenges remembers challenges that were used until they expire.
+// Challenges are kept in the session cookie, which can be sent again after
+// they were taken out of it, so that alone doesn't stop them being used twice.
+type usedChallenges struct {
+	lock    sync.Mutex
+	expires map[string]time.Time
+}
+
+// use marks challenge as used, and reports whether it wasn't used before.
+func (u *usedChallenges) use(challenge WebAuthnChallenge, now time.Time) bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	for c, expires := range u.expires {
+		if now.After(expires) {
+			delete(u.expires, c)
+		}
+	}
+
+	key := string(challenge.Challenge)
+	if _, ok := u.expires[key]; ok {
+		return false
+	}
+	u.expires[key] = challenge.Expires
+
+	return true
+}
+
+// NewWebAuthn sets up passkeys for the site at base, the base url. Passkeys
+// belong to its host name, so they keep working when the port changes but not
+// when the site moves to another domain.
+func NewWebAuthn(lm *LoginManager, base string) (*WebAuthn, error) {
+	if !strings.Contains(base, "://") {
+		base = "https://" + base
+	}
+
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("base url %s has no host", base)
+	}
+
+	return &WebAuthn{
+		lm:     lm,
+		rpId:   u.Hostname(),
+		origin: u.Scheme + "://" + u.Host,
+		used: &usedChallenges{
+			expires: map[string]time.Time{},
+		},
+		adding: &sync.Mutex{},
+	}, nil
+}
+
+func newWebAuthnChallenge(name string, now time.Time) (WebAuthnChallenge, error) {
+	challenge := make([]byte, webAuthnChallengeLength)
+	if _, err := rand.Read(challenge); err != nil {
+		return WebAuthnChallenge{}, err
+	}
+
+	return WebAuthnChallenge{
+		Challenge: challenge,
+		Name:      name,
+		Expires:   now.Add(webAuthnTimeout),
+	}, nil
+}
+
+// BeginRegistration starts adding a passkey for the user called name.
+func (wa WebAuthn) BeginRegistration(name string) (WebAuthnChallenge, WebAuthnCreationOptions, error) {
+	user, err := wa.lm.store.GetUser(name)
+	if err != nil {
+		return WebAuthnChallenge{}, WebAuthnCreationOptions{}, err
+	}
+
+	// passkeys identify users by this id, which unlike the name never
+	// changes and doesn't tell anyone anything
+	if user.WebAuthnId == nil {
+		id := make([]byte, webAuthnUserIdLength)
+		if _, err := rand.Read(id); err != nil {
+			return WebAuthnChallenge{}, WebAuthnCreationOptions{}, err
+		}
+
+		err := wa.lm.store.ChangeUser(name, func(changed *User) error {
+			// another registration may have given the user an id first
+			if changed.WebAuthnId == nil {
+				changed.WebAuthnId = id
+			}
+			user = *changed
+			return nil
+		})
+		if err != nil {
+			return WebAuthnChallenge{}, WebAuthnCreationOptions{}, err
+		}
+	}
+
+	challenge, err := newWebAuthnChallenge(user.Name, time.Now())
+	if err != nil {
+		return WebAuthnChallenge{}, WebAuthnCreationOptions{}, err
+	}
+
+	options := WebAuthnCreationOptions{
+		Challenge: challenge.Challenge,
+		Rp: webAuthnRp{
+			Id:   wa.rpId,
+			Name: webAuthnRpName,
+		},
+		User: webAuthnEntity{
+			Id:          user.WebAuthnId,
+			Name:        user.Name,
+			DisplayName: user.Name,
+		},
+		PubKeyCredParams: []webAuthnParam{
+			{Type: "public-key", Alg: coseES256},
+			{Type: "public-key", Alg: coseEdDSA},
+			{Type: "public-key", Alg: coseRS256},
+		},
+		Timeout:            webAuthnTimeout.Milliseconds(),
+		ExcludeCredentials: []webAuthnDescriptor{},
+		Attestation:        "none",
+	}
+	options.AuthenticatorSelection.ResidentKey = "required"
+	options.AuthenticatorSelection.RequireResidentKey = true
+	options.AuthenticatorSelection.UserVerification = "required"
+
+	for _, credential := range user.Credentials {
+		options.ExcludeCredentials = append(options.ExcludeCredentials, webAuthnDescriptor{
+			Type: "public-key",
+			Id:   credential.Id,
+		})
+	}
+
+	return challenge, options, nil
+}
+
+// FinishRegistration checks the passkey made with challenge, and adds it to
+// the user that started the registration. A challenge can only be used once,
+// whether that succeeds or not.
+func (wa WebAuthn) FinishRegistration(challenge WebAuthnChallenge, name string, attestation WebAuthnAttestation) (WebAuthnCredential, error) {
+	now := time.Now()
+	if challenge.Name == "" || now.After(challenge.Expires) || !wa.used.use(challenge, now) {
+		return WebAuthnCredential{}, ErrChallengeExpired
+	}
+
+	if err := wa.checkClientData(attestation.Response.ClientDataJSON, "webauthn.create", challenge); err != nil {
+		return WebAuthnCredential{}, err
+	}
+
+	object, _, err := decodeCbor(attestation.Response.AttestationObject)
+	if err != nil {
+		return WebAuthnCredential{}, ErrInvalidCredential
+	}
+	fields, ok := object.(map[interface{}]interface{})
+	if !ok {
+		return WebAuthnCredential{}, ErrInvalidCredential
+	}
+	rawAuthData, ok := fields["authData"].([]byte)
+	if !ok {
+		return WebAuthnCredential{}, ErrInvalidCredential
+	}
+
+	authData, err := wa.checkAuthData(rawAuthData)
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+	if authData.CredentialId == nil || !bytes.Equal(authData.CredentialId, attestation.Id) {
+		return WebAuthnCredential{}, ErrInvalidCredential
+	}
+	if _, err := parseCoseKey(authData.PublicKey); err != nil {
+		return WebAuthnCredential{}, err
+	}
+
+	credential := WebAuthnCredential{
+		Id:        authData.CredentialId,
+		Name:      name,
+		PublicKey: authData.PublicKey,
+		SignCount: authData.SignCount,
+		Created:   now,
+	}
+
+	// credential ids are unique across users, which a change to one user
+	// can't check, so credentials are added one at a time
+	wa.adding.Lock()
+	defer wa.adding.Unlock()
+
+	return credential, wa.lm.addCredential(challenge.Name, credential)
+}
+
+// BeginLogin starts logging in with a passkey.
+func (wa WebAuthn) BeginLogin() (WebAuthnChallenge, WebAuthnRequestOptions, error) {
+	challenge, err := newWebAuthnChallenge("", time.Now())
+	if err != nil {
+		return WebAuthnChallenge{}, WebAuthnRequestOptions{}, err
+	}
+
+	return challenge, WebAuthnRequestOptions{
+		Challenge:        challenge.Challenge,
+		RpId:             wa.rpId,
+		Timeout:          webAuthnTimeout.Milliseconds(),
+		UserVerification: "required",
+	}, nil
+}
+
+// FinishLogin checks the passkey signed challenge, and returns the user it
+// belongs to. Passkeys verify the user themselves, so users with two-factor
+// authentication aren't asked for a code. Like with FinishRegistration, a
+// challenge can only be used once.
+func (wa WebAuthn) FinishLogin(challenge WebAuthnChallenge, assertion WebAuthnAssertion) (SessionUser, error) {
+	now := time.Now()
+	if challenge.Name != "" || now.After(challenge.Expires) || !wa.used.use(challenge, now) {
+		return SessionUser{}, ErrChallengeExpired
+	}
+
+	if err := wa.checkClientData(assertion.Response.ClientDataJSON, "webauthn.get", challenge); err != nil {
+		return SessionUser{}, err
+	}
+
+	authData, err := wa.checkAuthData(assertion.Response.AuthenticatorData)
+	if err != nil {
+		return SessionUser{}, err
+	}
+
+	user, index, err := wa.lm.findCredential(assertion.Response.UserHandle, assertion.Id)
+	if err != nil {
+		return SessionUser{}, err
+	}
+
+	key, err := parseCoseKey(user.Credentials[index].PublicKey)
+	if err != nil {
+		return SessionUser{}, err
+	}
+
+	clientDataHash := sha256.Sum256(assertion.Response.ClientDataJSON)
+	signed := append(append([]byte(nil), assertion.Response.AuthenticatorData...), clientDataHash[:]...)
+	if !key.verify(signed, assertion.Response.Signature) {
+		return SessionUser{}, ErrInvalidCredential
+	}
+
+	// the sign count is checked in the same transaction that stores it, so
+	// two logins with the same count can't both get through
+	err = wa.lm.store.ChangeUser(user.Name, func(changed *User) error {
+		credential := changed.credential(assertion.Id)
+		if credential == nil {
+			return ErrUnknownCredential
+		}
+
+		if (authData.SignCount != 0 || credential.SignCount != 0) && authData.SignCount <= credential.SignCount {
+			return ErrSignCountRegression
+		}
+
+		if changed.Pending {
+			return ErrPendingApproval
+		}
+
+		credential.SignCount = authData.SignCount
+		credential.LastUsed = &now
+		return nil
+	})
+	if err == ErrNotFound {
+		return SessionUser{}, ErrUnknownCredential
+	} else if err != nil {
+		return SessionUser{}, err
+	}
+
+	return SessionUser{
+		Name: user.Name,
+	}, nil
+}
+
+func (wa WebAuthn) checkClientData(raw []byte, typ string, challenge WebAuthnChallenge) error {
+	var clientData webAuthnClientData
+	if err := json.Unmarshal(raw, &clientData); err != nil {
+		return ErrInvalidCredential
+	}
+
+	expected := base64.RawURLEncoding.EncodeToString(challenge.Challenge)
+	if clientData.Type != typ ||
+		subtle.ConstantTimeCompare([]byte(strings.TrimRight(clientData.Challenge, "=")), []byte(expected)) != 1 ||
+		clientData.Origin != wa.origin {
+		return ErrInvalidCredential
+	}
+
+	return nil
+}
+
+// checkAuthData parses authenticator data, and checks it is meant for this
+// site and the user was verified.
+func (wa WebAuthn) checkAuthData(data []byte) (webAuthnAuthData, error) {
+	if len(data) < 37 {
+		return webAuthnAuthData{}, ErrInvalidCredential
+	}
+
+	res := webAuthnAuthData{
+		RpIdHash:  data[:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+
+	rpIdHash := sha256.Sum256([]byte(wa.rpId))
+	if subtle.ConstantTimeCompare(res.RpIdHash, rpIdHash[:]) != 1 {
+		return webAuthnAuthData{}, ErrInvalidCredential
+	}
+	if res.Flags&authDataUserPresent == 0 || res.Flags&authDataUserVerified == 0 {
+		return webAuthnAuthData{}, ErrInvalidCredential
+	}
+
+	// attested credential data: a 16 byte aaguid, the length and the
+	// credential id, followed by the public key
+	if res.Flags&authDataAttested != 0 {
+		rest := data[37:]
+		if len(rest) < 18 {
+			return webAuthnAuthData{}, ErrInvalidCredential
+		}
+		length := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if len(rest) < length {
+			return webAuthnAuthData{}, ErrInvalidCredential
+		}
+		res.CredentialId = rest[:length]
+		rest = rest[length:]
+
+		_, after, err := decodeCbor(rest)
+		if err != nil {
+			return webAuthnAuthData{}, ErrInvalidCredential
+		}
+		res.PublicKey = rest[:len(rest)-len(after)]
+	}
+
+	return res, nil
+}
+
+// coseKey is a public key of a passkey.
+type coseKey struct {
+	alg int64
+	key crypto.PublicKey
+}
+
+func parseCoseKey(data []byte) (coseKey, error) {
+	value, _, err := decodeCbor(data)
+	if err != nil {
+		return coseKey{}, ErrInvalidCredential
+	}
+	fields, ok := value.(map[interface{}]interface{})
+	if !ok {
+		return coseKey{}, ErrInvalidCredential
+	}
+
+	kty, _ := fields[int64(1)].(int64)
+	alg, _ := fields[int64(3)].(int64)
+	crv, _ := fields[int64(-1)].(int64)
+
+	switch {
+	case kty == 2 && alg == coseES256 && crv == 1:
+		x, _ := fields[int64(-2)].([]byte)
+		y, _ := fields[int64(-3)].([]byte)
+		if len(x) != 32 || len(y) != 32 {
+			return coseKey{}, ErrInvalidCredential
+		}
+		key := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return coseKey{}, ErrInvalidCredential
+		}
+		return coseKey{alg, key}, nil
+	case kty == 1 && alg == coseEdDSA && crv == 6:
+		x, _ := fields[int64(-2)].([]byte)
+		if len(x) != ed25519.PublicKeySize {
+			return coseKey{}, ErrInvalidCredential
+		}
+		return coseKey{alg, ed25519.PublicKey(x)}, nil
+	case kty == 3 && alg == coseRS256:
+		n, _ := fields[int64(-1)].([]byte)
+		e, _ := fields[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return coseKey{}, ErrInvalidCredential
+		}
+		exponent := 0
+		for _, b := range e {
+			exponent = exponent<<8 | int(b)
+		}
+		return coseKey{alg, &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}}, nil
+	default:
+		return coseKey{}, ErrUnsupportedKey
+	}
+}
+
+func (k coseKey) verify(data []byte, signature []byte) bool {
+	switch key := k.key.(type) {
+	case *ecdsa.PublicKey:
+		hash := sha256.Sum256(data)
+		return ecdsa.VerifyASN1(key, hash[:], signature)
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, data, signature)
+	case *rsa.PublicKey:
+		hash := sha256.Sum256(data)
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature) == nil
+	default:
+		return false
+	}
+}
+
+// findCredential returns the user with the passkey with the given id, and
+// where it is in their credentials. Passkeys tell which user they belong to,
+// but the user id is checked against the credential anyway.
+func (lm LoginManager) findCredential(userId []byte, id []byte) (User, int, error) {
+	users, err := lm.store.GetUsers()
+	if err != nil {
+		return User{}, 0, err
+	}
+
+	for _, user := range users {
+		if len(userId) > 0 && !bytes.Equal(user.WebAuthnId, userId) {
+			continue
+		}
+		for i, credential := range user.Credentials {
+			if bytes.Equal(credential.Id, id) {
+				return user, i, nil
+			}
+		}
+	}
+
+	return User{}, 0, ErrUnknownCredential
+}
+
+// credential returns the passkey of the user with the given id, or nil when
+// they don't have it.
+func (u *User) credential(id []byte) *WebAuthnCredential {
+	for i := range u.Credentials {
+		if bytes.Equal(u.Credentials[i].Id, id) {
+			return &u.Credentials[i]
+		}
+	}
+
+	return nil
+}
+
+func (lm LoginManager) addCredential(name string, credential WebAuthnCredential) error {
+	if _, _, err := lm.findCredential(nil, credential.Id); err == nil {
+		return ErrCredentialExists
+	} else if err != ErrUnknownCredential {
+		return err
+	}
+
+	return lm.store.ChangeUser(name, func(user *User) error {
+		if user.credential(credential.Id) != nil {
+			return ErrCredentialExists
+		}
+
+		user.Credentials = append(user.Credentials, credential)
+		return nil
+	})
+}
+
+// RmCredential removes the passkey with the given id, encoded like
+// WebAuthnCredential.EncodedId, from the user called name.
+func (lm LoginManager) RmCredential(name string, id string) error {
+	return lm.store.ChangeUser(name, func(user *User) error {
+		for i, credential := range user.Credentials {
+			if credential.EncodedId() == id {
+				user.Credentials = append(user.Credentials[:i:i], user.Credentials[i+1:]...)
+				return nil
+			}
+		}
+
+		return ErrUnknownCredential
+	})
+}
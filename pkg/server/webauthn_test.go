@@ -0,0 +1,445 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+)
+
+const testBase = "https://short.example"
+const testRpId = "short.example"
+
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestLoginManager makes a LoginManager with a memory store that has a user
+// called alice.
+func newTestLoginManager(t *testing.T) *LoginManager {
+	store, err := NewStore(StoreConfig{Backend: BackendMemory})
+	check(t, err)
+	t.Cleanup(store.Close)
+
+	// with a user already there, no admin is made
+	check(t, store.CreateUser(User{Name: "alice"}))
+	lm, err := NewLoginManager(store, filepath.Join(t.TempDir(), "admin_password"))
+	check(t, err)
+
+	return lm
+}
+
+func newTestWebAuthn(t *testing.T) *WebAuthn {
+	wa, err := NewWebAuthn(newTestLoginManager(t), testBase)
+	check(t, err)
+
+	return wa
+}
+
+// cborMap is a CBOR map that keeps the order of its keys.
+type cborMap [][2]interface{}
+
+func cborHeadBytes(major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n < 1<<8:
+		return []byte{major<<5 | 24, byte(n)}
+	case n < 1<<16:
+		return []byte{major<<5 | 25, byte(n >> 8), byte(n)}
+	default:
+		return []byte{major<<5 | 26, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}
+	}
+}
+
+// encodeCbor encodes what an authenticator puts in attestation objects and
+// public keys.
+func encodeCbor(value interface{}) []byte {
+	switch v := value.(type) {
+	case int:
+		if v < 0 {
+			return cborHeadBytes(1, uint64(-1-v))
+		}
+		return cborHeadBytes(0, uint64(v))
+	case []byte:
+		return append(cborHeadBytes(2, uint64(len(v))), v...)
+	case string:
+		return append(cborHeadBytes(3, uint64(len(v))), v...)
+	case cborMap:
+		res := cborHeadBytes(5, uint64(len(v)))
+		for _, entry := range v {
+			res = append(res, encodeCbor(entry[0])...)
+			res = append(res, encodeCbor(entry[1])...)
+		}
+		return res
+	default:
+		panic("can't encode value")
+	}
+}
+
+// testAuthenticator is a software passkey. What it puts in what it returns is
+// right unless a test changes it.
+type testAuthenticator struct {
+	alg        int
+	id         []byte
+	ecdsaKey   *ecdsa.PrivateKey
+	ed25519Key ed25519.PrivateKey
+	userHandle []byte
+
+	rpId   string
+	origin string
+	flags  byte
+	// signCount goes up with every signature, unless it is zero.
+	signCount uint32
+}
+
+func newTestAuthenticator(t *testing.T, alg int) *testAuthenticator {
+	a := &testAuthenticator{
+		alg:    alg,
+		id:     make([]byte, 16),
+		rpId:   testRpId,
+		origin: testBase,
+		flags:  authDataUserPresent | authDataUserVerified,
+	}
+	_, err := rand.Read(a.id)
+	check(t, err)
+
+	switch alg {
+	case coseES256:
+		a.ecdsaKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case coseEdDSA:
+		_, a.ed25519Key, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		t.Fatalf("unsupported algorithm %d", alg)
+	}
+	check(t, err)
+
+	return a
+}
+
+func (a *testAuthenticator) publicKey() []byte {
+	if a.alg == coseES256 {
+		x := make([]byte, 32)
+		y := make([]byte, 32)
+		a.ecdsaKey.X.FillBytes(x)
+		a.ecdsaKey.Y.FillBytes(y)
+		return encodeCbor(cborMap{{1, 2}, {3, coseES256}, {-1, 1}, {-2, x}, {-3, y}})
+	}
+
+	return encodeCbor(cborMap{{1, 1}, {3, coseEdDSA}, {-1, 6}, {-2, []byte(a.ed25519Key.Public().(ed25519.PublicKey))}})
+}
+
+func (a *testAuthenticator) sign(t *testing.T, data []byte) []byte {
+	if a.alg == coseES256 {
+		hash := sha256.Sum256(data)
+		signature, err := ecdsa.SignASN1(rand.Reader, a.ecdsaKey, hash[:])
+		check(t, err)
+		return signature
+	}
+
+	return ed25519.Sign(a.ed25519Key, data)
+}
+
+func (a *testAuthenticator) authData(attested bool) []byte {
+	rpIdHash := sha256.Sum256([]byte(a.rpId))
+	res := append([]byte(nil), rpIdHash[:]...)
+
+	flags := a.flags
+	if attested {
+		flags |= authDataAttested
+	}
+	res = append(res, flags)
+
+	var count [4]byte
+	binary.BigEndian.PutUint32(count[:], a.signCount)
+	res = append(res, count[:]...)
+
+	if attested {
+		res = append(res, make([]byte, 16)...)
+		var length [2]byte
+		binary.BigEndian.PutUint16(length[:], uint16(len(a.id)))
+		res = append(res, length[:]...)
+		res = append(res, a.id...)
+		res = append(res, a.publicKey()...)
+	}
+
+	return res
+}
+
+func (a *testAuthenticator) clientData(t *testing.T, typ string, challenge []byte) []byte {
+	res, err := json.Marshal(webAuthnClientData{
+		Type:      typ,
+		Challenge: base64.RawURLEncoding.EncodeToString(challenge),
+		Origin:    a.origin,
+	})
+	check(t, err)
+
+	return res
+}
+
+// create makes a new passkey, like navigator.credentials.create.
+func (a *testAuthenticator) create(t *testing.T, options WebAuthnCreationOptions) WebAuthnAttestation {
+	a.userHandle = options.User.Id
+
+	var res WebAuthnAttestation
+	res.Id = a.id
+	res.Type = "public-key"
+	res.Response.ClientDataJSON = a.clientData(t, "webauthn.create", options.Challenge)
+	res.Response.AttestationObject = encodeCbor(cborMap{
+		{"fmt", "none"},
+		{"attStmt", cborMap{}},
+		{"authData", a.authData(true)},
+	})
+
+	return res
+}
+
+// get signs a challenge, like navigator.credentials.get.
+func (a *testAuthenticator) get(t *testing.T, options WebAuthnRequestOptions) WebAuthnAssertion {
+	if a.signCount != 0 {
+		a.signCount += 1
+	}
+
+	var res WebAuthnAssertion
+	res.Id = a.id
+	res.Type = "public-key"
+	res.Response.ClientDataJSON = a.clientData(t, "webauthn.get", options.Challenge)
+	res.Response.AuthenticatorData = a.authData(false)
+	res.Response.UserHandle = a.userHandle
+
+	clientDataHash := sha256.Sum256(res.Response.ClientDataJSON)
+	res.Response.Signature = a.sign(t, append(append([]byte(nil), res.Response.AuthenticatorData...), clientDataHash[:]...))
+
+	return res
+}
+
+func registerPasskey(t *testing.T, wa *WebAuthn, a *testAuthenticator) error {
+	challenge, options, err := wa.BeginRegistration("alice")
+	check(t, err)
+
+	_, err = wa.FinishRegistration(challenge, "passkey", a.create(t, options))
+	return err
+}
+
+func logInWithPasskey(t *testing.T, wa *WebAuthn, a *testAuthenticator) (SessionUser, error) {
+	challenge, options, err := wa.BeginLogin()
+	check(t, err)
+
+	return wa.FinishLogin(challenge, a.get(t, options))
+}
+
+func TestWebAuthnRegisterAndLogIn(t *testing.T) {
+	for _, alg := range []int{coseES256, coseEdDSA} {
+		wa := newTestWebAuthn(t)
+		a := newTestAuthenticator(t, alg)
+
+		check(t, registerPasskey(t, wa, a))
+		user, err := wa.lm.store.GetUser("alice")
+		check(t, err)
+		if len(user.Credentials) != 1 || user.Credentials[0].EncodedId() != base64.RawURLEncoding.EncodeToString(a.id) {
+			t.Fatalf("alg %d: alice has credentials %+v after registering", alg, user.Credentials)
+		}
+
+		// a passkey can only be added once
+		if err := registerPasskey(t, wa, a); err != ErrCredentialExists {
+			t.Errorf("alg %d: registering a passkey again returned %v, expected ErrCredentialExists", alg, err)
+		}
+
+		for i := 0; i < 2; i++ {
+			su, err := logInWithPasskey(t, wa, a)
+			check(t, err)
+			if su.Name != "alice" {
+				t.Errorf("alg %d: logged in as %s, expected alice", alg, su.Name)
+			}
+		}
+
+		// the signature has to be made with the passkey that was registered
+		other := newTestAuthenticator(t, alg)
+		other.id = a.id
+		other.userHandle = a.userHandle
+		if _, err := logInWithPasskey(t, wa, other); err != ErrInvalidCredential {
+			t.Errorf("alg %d: logging in with another key returned %v, expected ErrInvalidCredential", alg, err)
+		}
+	}
+}
+
+func TestWebAuthnUnknownPasskey(t *testing.T) {
+	wa := newTestWebAuthn(t)
+	a := newTestAuthenticator(t, coseES256)
+
+	if _, err := logInWithPasskey(t, wa, a); err != ErrUnknownCredential {
+		t.Errorf("logging in with an unknown passkey returned %v, expected ErrUnknownCredential", err)
+	}
+}
+
+func TestWebAuthnWrongOrigin(t *testing.T) {
+	wa := newTestWebAuthn(t)
+	a := newTestAuthenticator(t, coseES256)
+
+	a.origin = "https://evil.example"
+	if err := registerPasskey(t, wa, a); err != ErrInvalidCredential {
+		t.Errorf("registering from another origin returned %v, expected ErrInvalidCredential", err)
+	}
+
+	a.origin = testBase
+	check(t, registerPasskey(t, wa, a))
+
+	a.origin = "https://evil.example"
+	if _, err := logInWithPasskey(t, wa, a); err != ErrInvalidCredential {
+		t.Errorf("logging in from another origin returned %v, expected ErrInvalidCredential", err)
+	}
+}
+
+func TestWebAuthnWrongRpId(t *testing.T) {
+	wa := newTestWebAuthn(t)
+	a := newTestAuthenticator(t, coseEdDSA)
+
+	a.rpId = "evil.example"
+	if err := registerPasskey(t, wa, a); err != ErrInvalidCredential {
+		t.Errorf("registering a passkey of another site returned %v, expected ErrInvalidCredential", err)
+	}
+
+	a.rpId = testRpId
+	check(t, registerPasskey(t, wa, a))
+
+	a.rpId = "evil.example"
+	if _, err := logInWithPasskey(t, wa, a); err != ErrInvalidCredential {
+		t.Errorf("logging in with a passkey of another site returned %v, expected ErrInvalidCredential", err)
+	}
+}
+
+func TestWebAuthnUserNotVerified(t *testing.T) {
+	wa := newTestWebAuthn(t)
+	a := newTestAuthenticator(t, coseES256)
+
+	a.flags = authDataUserPresent
+	if err := registerPasskey(t, wa, a); err != ErrInvalidCredential {
+		t.Errorf("registering without verifying the user returned %v, expected ErrInvalidCredential", err)
+	}
+
+	a.flags = authDataUserPresent | authDataUserVerified
+	check(t, registerPasskey(t, wa, a))
+
+	a.flags = authDataUserPresent
+	if _, err := logInWithPasskey(t, wa, a); err != ErrInvalidCredential {
+		t.Errorf("logging in without verifying the user returned %v, expected ErrInvalidCredential", err)
+	}
+}
+
+func TestWebAuthnSignCountRegression(t *testing.T) {
+	wa := newTestWebAuthn(t)
+	a := newTestAuthenticator(t, coseES256)
+
+	a.signCount = 5
+	check(t, registerPasskey(t, wa, a))
+	_, err := logInWithPasskey(t, wa, a)
+	check(t, err)
+
+	// a copy of the passkey that is behind, or that signs with the same
+	// count, was cloned
+	for _, count := range []uint32{2, 5} {
+		a.signCount = count
+		if _, err := logInWithPasskey(t, wa, a); err != ErrSignCountRegression {
+			t.Errorf("logging in with count %d after 6 returned %v, expected ErrSignCountRegression", count+1, err)
+		}
+	}
+
+	a.signCount = 10
+	_, err = logInWithPasskey(t, wa, a)
+	check(t, err)
+}
+
+func TestWebAuthnConcurrentLogIn(t *testing.T) {
+	wa := newTestWebAuthn(t)
+	a := newTestAuthenticator(t, coseES256)
+
+	a.signCount = 5
+	check(t, registerPasskey(t, wa, a))
+
+	// copies of a passkey that sign with the same count at the same time,
+	// only one of them gets in
+	const logins = 20
+	challenges := make([]WebAuthnChallenge, logins)
+	assertions := make([]WebAuthnAssertion, logins)
+	for i := range challenges {
+		var options WebAuthnRequestOptions
+		var err error
+		challenges[i], options, err = wa.BeginLogin()
+		check(t, err)
+
+		a.signCount = 5
+		assertions[i] = a.get(t, options)
+	}
+
+	errs := make(chan error, logins)
+	for i := range challenges {
+		go func(i int) {
+			_, err := wa.FinishLogin(challenges[i], assertions[i])
+			errs <- err
+		}(i)
+	}
+
+	succeeded := 0
+	for range challenges {
+		err := <-errs
+		if err == nil {
+			succeeded += 1
+		} else if err != ErrSignCountRegression {
+			t.Errorf("logging in returned %v, expected ErrSignCountRegression", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("%d logins with the same count succeeded, expected 1", succeeded)
+	}
+}
+
+func TestWebAuthnChallengeReuse(t *testing.T) {
+	wa := newTestWebAuthn(t)
+	a := newTestAuthenticator(t, coseEdDSA)
+
+	challenge, options, err := wa.BeginRegistration("alice")
+	check(t, err)
+	attestation := a.create(t, options)
+	_, err = wa.FinishRegistration(challenge, "passkey", attestation)
+	check(t, err)
+	if _, err := wa.FinishRegistration(challenge, "passkey", attestation); err != ErrChallengeExpired {
+		t.Errorf("registering with a used challenge returned %v, expected ErrChallengeExpired", err)
+	}
+
+	// the session with the challenge can be sent again, with a passkey that
+	// doesn't count its signatures the same login would work twice
+	loginChallenge, loginOptions, err := wa.BeginLogin()
+	check(t, err)
+	assertion := a.get(t, loginOptions)
+	_, err = wa.FinishLogin(loginChallenge, assertion)
+	check(t, err)
+	if _, err := wa.FinishLogin(loginChallenge, assertion); err != ErrChallengeExpired {
+		t.Errorf("logging in with a used challenge returned %v, expected ErrChallengeExpired", err)
+	}
+
+	// a challenge is used up by a failed attempt as well
+	loginChallenge, loginOptions, err = wa.BeginLogin()
+	check(t, err)
+	a.origin = "https://evil.example"
+	if _, err := wa.FinishLogin(loginChallenge, a.get(t, loginOptions)); err != ErrInvalidCredential {
+		t.Fatalf("logging in from another origin returned %v, expected ErrInvalidCredential", err)
+	}
+	a.origin = testBase
+	if _, err := wa.FinishLogin(loginChallenge, a.get(t, loginOptions)); err != ErrChallengeExpired {
+		t.Errorf("logging in with a challenge used by a failed attempt returned %v, expected ErrChallengeExpired", err)
+	}
+
+	// and the challenge of a registration can't be used to log in
+	if _, err := wa.FinishLogin(challenge, assertion); err != ErrChallengeExpired {
+		t.Errorf("logging in with a registration challenge returned %v, expected ErrChallengeExpired", err)
+	}
+}
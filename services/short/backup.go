@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"github.com/jonay2000/short/pkg/server"
+	"os"
+)
+
+// backup writes a backup of the store to the file given with -o, or to stdout.
+// The store is configured in the same way as for the server, so it can't be
+// running at the same time with badger or bolt. Use the backup button in the
+// admin panel or /__API__/v1/backup to back up a running server.
+func backup(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	output := flags.String("o", "", "file to write the backup to instead of stdout")
+	_ = flags.Parse(args)
+
+	store, err := server.NewStore(server.StoreConfigFromEnv())
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if *output == "" {
+		return store.Backup(os.Stdout)
+	}
+
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+
+	if err := store.Backup(f); err != nil {
+		_ = f.Close()
+		_ = os.Remove(*output)
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/jonay2000/short/pkg/server"
+)
+
+// check looks for aliases that are missing from the index of who owns them and
+// the other way around. The store is configured in the same way as for the
+// server, so it can't be running at the same time with badger or bolt.
+func check(args []string) error {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "repair the problems that are found")
+	_ = flags.Parse(args)
+
+	store, err := server.NewStore(server.StoreConfigFromEnv())
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	problems, err := store.CheckOwners(*repair)
+	if err != nil {
+		return err
+	}
+
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+
+	switch {
+	case len(problems) == 0:
+		fmt.Println("no problems found")
+	case *repair:
+		fmt.Printf("repaired %d problems\n", len(problems))
+	default:
+		fmt.Printf("found %d problems, run with -repair to repair them\n", len(problems))
+	}
+
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"github.com/jonay2000/short/pkg/server"
+	"os"
+)
+
+// export writes an export of everything a user owns, the same as they can
+// download themselves, to the file given with -o or to stdout. It is useful to
+// answer requests for someone's data without logging in as an admin.
+func export(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	output := flags.String("o", "", "file to write the export to instead of stdout")
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: export [-o file] <user>")
+	}
+
+	store, err := server.NewStore(server.StoreConfigFromEnv())
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if *output == "" {
+		return server.ExportUser(store, flags.Arg(0), os.Stdout)
+	}
+
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+
+	if err := server.ExportUser(store, flags.Arg(0), f); err != nil {
+		_ = f.Close()
+		_ = os.Remove(*output)
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/jonay2000/short/pkg/server"
+	"os"
+	"strings"
+)
+
+// stringList is a flag that can be given more than once.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// importLinks imports the links in an export of another shortener, see
+// server.Import. It prints what happened to every link, or what would have
+// with -dry-run.
+func importLinks(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	format := flags.String("format", server.ImportCsv, "format of the export, one of "+strings.Join(server.ImportFormats(), ", "))
+	conflict := flags.String("conflict", server.ConflictSkip, "what to do with aliases that are already taken: skip, overwrite or rename")
+	dryRun := flags.Bool("dry-run", false, "only show what would be imported")
+	defaultOwner := flags.String("default-owner", "", "user that owns links without an owner")
+	var owners stringList
+	flags.Var(&owners, "owner", "map an owner in the export to a user, as old=new (can be repeated)")
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: import [-format f] [-conflict skip|overwrite|rename] [-dry-run] [-default-owner user] [-owner old=new] <export>")
+	}
+
+	mapping, err := server.ParseOwnerMapping(owners)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	store, err := server.NewStore(server.StoreConfigFromEnv())
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	report, err := server.Import(store, f, server.ImportOptions{
+		Format:       *format,
+		Conflict:     *conflict,
+		DryRun:       *dryRun,
+		Owners:       mapping,
+		DefaultOwner: *defaultOwner,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range report.Entries {
+		alias := entry.Alias
+		if entry.Original != entry.Alias {
+			alias = fmt.Sprintf("%s (as %s)", entry.Original, entry.Alias)
+		}
+
+		fmt.Printf("%d\t%s\t%s\t%s", entry.Row, entry.Action, alias, entry.Url)
+		if entry.Reason != "" {
+			fmt.Printf("\t%s", entry.Reason)
+		}
+		fmt.Println()
+	}
+	fmt.Println(report)
+
+	return nil
+}
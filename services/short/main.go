@@ -3,9 +3,34 @@ package main
 import (
 	"github.com/jonay2000/short/pkg/server"
 	"log"
+	"os"
 )
 
+// Commands that can be given as the first argument. Without one, the server is
+// started.
+var commands = map[string]func(args []string) error{
+	"backup":     backup,
+	"check":      check,
+	"export":     export,
+	"import":     importLinks,
+	"migrate":    migrate,
+	"restore":    restore,
+	"rotatekeys": rotateKeys,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		command, ok := commands[os.Args[1]]
+		if !ok {
+			log.Fatalf("unknown command %s", os.Args[1])
+		}
+
+		if err := command(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	if err := server.StartServer(); err != nil {
 		log.Fatal(err)
 	}
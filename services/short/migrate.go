@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/jonay2000/short/pkg/server"
+)
+
+// migrate brings the database up to date with this version, which otherwise
+// happens when the server starts. With -dry-run it only shows what would be
+// done, which is useful before upgrading.
+func migrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only show what would be done")
+	_ = flags.Parse(args)
+
+	reports, err := server.Migrate(server.StoreConfigFromEnv(), *dryRun)
+	if err != nil {
+		return err
+	}
+
+	if len(reports) == 0 {
+		fmt.Printf("database is up to date (schema version %d)\n", server.SchemaVersion)
+		return nil
+	}
+
+	for _, report := range reports {
+		fmt.Printf("schema version %d: %s\n", report.Version, report.Description)
+		for _, change := range report.Changes {
+			fmt.Printf("\t%s\n", change)
+		}
+	}
+
+	if *dryRun {
+		fmt.Println("dry run, nothing was changed")
+	}
+
+	return nil
+}
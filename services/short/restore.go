@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/jonay2000/short/pkg/server"
+	"os"
+)
+
+// restore restores a backup made with backup or downloaded from the admin
+// panel. In merge mode, which is the default, whatever is already in the store
+// is kept. In replace mode, everything but the sessions is removed first, and
+// put back when the restore fails.
+func restore(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	mode := flags.String("mode", server.RestoreMerge, "merge or replace")
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: restore [-mode merge|replace] <backup>")
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	store, err := server.NewStore(server.StoreConfigFromEnv())
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	report, err := store.Restore(f, *mode)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(report)
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/jonay2000/short/pkg/server"
+	"time"
+)
+
+const rotateKeysUsage = `usage: rotatekeys
+
+Makes a new key for session cookies. Cookies made with the old keys keep
+working until they expire, so nobody is logged out.
+
+Stop the server first: it keeps the database open, and badger and bolt can only
+be opened by one process at a time. The server uses the new key once it is
+started again.
+`
+
+// rotateKeys makes a new key for session cookies, which the server uses once
+// it is restarted. Cookies made with the old keys keep working until they
+// expire, so nobody is logged out. The store is configured in the same way as
+// for the server, so it can't be running at the same time with badger or bolt.
+func rotateKeys(args []string) error {
+	flags := flag.NewFlagSet("rotatekeys", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), rotateKeysUsage)
+	}
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		return errors.New("usage: rotatekeys")
+	}
+
+	keys, err := server.SessionKeysFromEnv()
+	if err != nil {
+		return err
+	}
+	if keys != nil {
+		return server.ErrSessionKeysFromEnv
+	}
+
+	store, err := server.NewStore(server.StoreConfigFromEnv())
+	if err != nil {
+		return fmt.Errorf("%w (is the server still running? stop it first)", err)
+	}
+	defer store.Close()
+
+	keys, err = server.RotateSessionKeys(store, time.Now())
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("made a new session key, %d old keys are still accepted, start the server to use it\n", len(keys)-1)
+	return nil
+}